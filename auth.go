@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	authRealm = "owntracks-pg-recorder"
+	// authAccessTokenParameter carries an API token for clients that can't set headers,
+	// such as browsers opening a WebSocket or EventSource.
+	authAccessTokenParameter = "access_token"
+	// basicAuthCacheDuration is how long a verified password is remembered, so that
+	// every request doesn't pay for a bcrypt comparison.
+	basicAuthCacheDuration = 5 * time.Minute
+	// redactedToken replaces tokens in logged request URIs.
+	redactedToken = "REDACTED"
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("not allowed to access another user's data")
+	errAuthorizing     = errors.New("unable to check access")
+)
+
+// principal is the authenticated user making a request.
+type principal struct {
+	User  string
+	Admin bool
+}
+
+type principalContextKey struct{}
+
+// requestPrincipal returns the user that authenticated a request, or false if
+// authentication is disabled.
+func requestPrincipal(r *http.Request) (principal, bool) {
+	user, ok := r.Context().Value(principalContextKey{}).(principal)
+
+	return user, ok
+}
+
+// restrictedUser returns the only user whose data a request may read, or an empty
+// string if it may read everyone's because it's from an admin or authentication is
+// disabled.
+func restrictedUser(r *http.Request) string {
+	user, ok := requestPrincipal(r)
+	if !ok || user.Admin {
+		return ""
+	}
+
+	return user.User
+}
+
+// restrictUser checks that a request restricted to one user only asks for that user's
+// data. An empty user, meaning everyone, becomes the restricted user.
+func restrictUser(restricted string, user string) (string, error) {
+	switch {
+	case restricted == "" || user == restricted:
+		return user, nil
+	case user == "":
+		return restricted, nil
+	default:
+		return "", errForbidden
+	}
+}
+
+// authorizeUser returns the user whose data a request for user should manage, such as
+// their shares and privacy zones. Friendships only let users read each other's
+// locations, which authorizeRead allows.
+func authorizeUser(r *http.Request, user string) (string, error) {
+	return restrictUser(restrictedUser(r), user)
+}
+
+// authorizeRead restricts a filter of the locations a request reads to those it may
+// see: its own user's, or those of a user who has made it a friend. It reads its own
+// user's if the filter doesn't name one.
+func (env *Env) authorizeRead(r *http.Request, filter pointsFilter) (pointsFilter, error) {
+	access, err := env.requestVisibility(r)
+	if err != nil {
+		return filter, fmt.Errorf("%w: %w", errAuthorizing, err)
+	}
+
+	return access.restrictFilter(filter)
+}
+
+// requestError responds to a request that can't be served as asked: 403 if it asked
+// for another user's data, 500 if that couldn't be checked, otherwise 400.
+func requestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errAuthorizing):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// authenticator checks the credentials of HTTP API requests using whichever of a
+// trusted proxy header, static API tokens and the users table are configured.
+type authenticator struct {
+	// tokens maps API tokens to their users
+	tokens         map[string]string
+	basic          bool
+	proxyHeader    string
+	trustedProxies []netip.Prefix
+	admins         []string
+	verifyPassword func(ctx context.Context, user, password string) (bool, error)
+	verified       *cache.Cache
+}
+
+// newAuthenticator returns an authenticator for the configured methods, or nil if none
+// are configured and the API is public.
+func (env *Env) newAuthenticator(configuration *Configuration) (*authenticator, error) {
+	auth := &authenticator{
+		tokens:         map[string]string{},
+		basic:          configuration.AuthBasic,
+		proxyHeader:    http.CanonicalHeaderKey(strings.TrimSpace(configuration.AuthProxyHeader)),
+		verifyPassword: env.verifyUserPassword,
+		verified:       cache.New(basicAuthCacheDuration, 2*basicAuthCacheDuration),
+	}
+
+	for entry := range strings.SplitSeq(configuration.AuthTokens, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		user, token, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || token == "" {
+			return nil, fmt.Errorf("API token %q should be user:token", entry)
+		}
+
+		auth.tokens[token] = user
+	}
+
+	for network := range strings.SplitSeq(configuration.AuthTrustedProxies, ",") {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %w", network, err)
+		}
+
+		auth.trustedProxies = append(auth.trustedProxies, prefix)
+	}
+
+	for admin := range strings.SplitSeq(configuration.AuthAdmins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			auth.admins = append(auth.admins, admin)
+		}
+	}
+
+	if len(auth.tokens) == 0 && !auth.basic && auth.proxyHeader == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	return auth, nil
+}
+
+// fromTrustedProxy reports whether a request came directly from a proxy trusted to set
+// the user header.
+func (auth *authenticator) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	address, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	address = address.Unmap()
+
+	return slices.ContainsFunc(auth.trustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(address)
+	})
+}
+
+// tokenUser returns the user an API token belongs to. Every token is compared, in
+// constant time, so that timing doesn't reveal how much of a token was right.
+func (auth *authenticator) tokenUser(token string) (string, bool) {
+	var user string
+
+	for candidate, candidateUser := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			user = candidateUser
+		}
+	}
+
+	return user, user != ""
+}
+
+// basicUser checks a username and password against the users table, remembering
+// passwords that were right for a few minutes.
+func (auth *authenticator) basicUser(ctx context.Context, user, password string) (bool, error) {
+	hash := sha256.Sum256([]byte(user + "\x00" + password))
+	key := hex.EncodeToString(hash[:])
+
+	if _, ok := auth.verified.Get(key); ok {
+		return true, nil
+	}
+
+	ok, err := auth.verifyPassword(ctx, user, password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	auth.verified.SetDefault(key, struct{}{})
+
+	return true, nil
+}
+
+// authenticate returns the user making a request, trying the proxy header, then API
+// tokens, then basic auth.
+func (auth *authenticator) authenticate(r *http.Request) (string, error) {
+	if auth.proxyHeader != "" && auth.fromTrustedProxy(r) {
+		if user := r.Header.Get(auth.proxyHeader); user != "" {
+			return user, nil
+		}
+	}
+
+	if len(auth.tokens) > 0 {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get(authAccessTokenParameter)
+		}
+
+		if token != "" {
+			if user, ok := auth.tokenUser(token); ok {
+				return user, nil
+			}
+
+			return "", errUnauthenticated
+		}
+	}
+
+	if auth.basic {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			valid, err := auth.basicUser(r.Context(), user, password)
+			if err != nil {
+				return "", err
+			}
+
+			if valid {
+				return user, nil
+			}
+		}
+	}
+
+	return "", errUnauthenticated
+}
+
+// Middleware rejects requests that don't authenticate, and records the user of those
+// that do for the handlers to authorize against.
+func (auth *authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		user, err := auth.authenticate(r)
+		if err != nil {
+			if !errors.Is(err, errUnauthenticated) {
+				slog.With("err", err).ErrorContext(ctx, "Error authenticating request")
+				http.Error(w, "Unable to authenticate", http.StatusInternalServerError)
+
+				return
+			}
+
+			if auth.basic {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+			} else {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+			}
+
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+
+			return
+		}
+
+		authenticated := principal{User: user, Admin: slices.Contains(auth.admins, user)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, principalContextKey{}, authenticated)))
+	})
+}
+
+// redactRequestURI hides the tokens a request URI can carry, an API token in the query
+// string and a share link token in the path, so that they aren't written to logs.
+func redactRequestURI(uri string) string {
+	path, query, hasQuery := strings.Cut(uri, "?")
+
+	if share, ok := strings.CutPrefix(path, "/share/"); ok {
+		_, rest, hasRest := strings.Cut(share, "/")
+
+		path = "/share/" + redactedToken
+		if hasRest {
+			path += "/" + rest
+		}
+	}
+
+	if !hasQuery {
+		return path
+	}
+
+	values, err := url.ParseQuery(query)
+
+	switch {
+	case err != nil:
+		// A query that doesn't parse might still hold a token
+		query = redactedToken
+	case values.Has(authAccessTokenParameter):
+		values.Set(authAccessTokenParameter, redactedToken)
+		query = values.Encode()
+	}
+
+	return path + "?" + query
+}
+
+// redactingLogFormatter logs requests like chi's default formatter, but with their
+// URIs redacted.
+type redactingLogFormatter struct {
+	*middleware.DefaultLogFormatter
+}
+
+func (formatter redactingLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	logged := r.WithContext(r.Context())
+	logged.RequestURI = redactRequestURI(r.RequestURI)
+
+	return formatter.DefaultLogFormatter.NewLogEntry(logged)
+}
+
+// requestLogger is chi's middleware.Logger, without the tokens in request URIs.
+var requestLogger = middleware.RequestLogger(redactingLogFormatter{
+	&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+})
+
+// requireAdmin only lets admins through, for endpoints that change or expose every
+// user's data. It does nothing if authentication is disabled.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := requestPrincipal(r); ok && !user.Admin {
+			http.Error(w, "Only admins can do that", http.StatusForbidden)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyUserPassword checks a password against the bcrypt hash stored in the users
+// table, using pgcrypto.
+func (env *Env) verifyUserPassword(ctx context.Context, user, password string) (bool, error) {
+	if env.database == nil {
+		return false, errors.New("no database connection available")
+	}
+
+	var valid bool
+
+	err := env.database.QueryRowContext(ctx,
+		`select coalesce(bool_or(password_hash = crypt($2, password_hash)), false) from users where username = $1`,
+		user, password,
+	).Scan(&valid)
+	if err != nil {
+		return false, fmt.Errorf("checking password: %w", err)
+	}
+
+	return valid, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAuthenticator(t *testing.T, configuration *Configuration) *authenticator {
+	t.Helper()
+
+	env := Env{configuration: configuration}
+
+	auth, err := env.newAuthenticator(configuration)
+	require.NoError(t, err)
+	require.NotNil(t, auth)
+
+	return auth
+}
+
+// authenticatedUser runs a request through auth's middleware, returning the status and
+// the principal the handler saw.
+func authenticatedUser(auth *authenticator, r *http.Request) (int, principal) {
+	var seen principal
+
+	recorder := httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = requestPrincipal(r)
+	})).ServeHTTP(recorder, r)
+
+	return recorder.Code, seen
+}
+
+func TestNewAuthenticatorConfiguration(t *testing.T) {
+	env := Env{}
+
+	auth, err := env.newAuthenticator(&Configuration{AuthTrustedProxies: "127.0.0.1/32"})
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+
+	_, err = env.newAuthenticator(&Configuration{AuthTokens: "alice"})
+	require.Error(t, err)
+
+	_, err = env.newAuthenticator(&Configuration{AuthProxyHeader: "X-User", AuthTrustedProxies: "proxy"})
+	require.Error(t, err)
+}
+
+func TestAuthenticatorTokens(t *testing.T) {
+	auth := testAuthenticator(t, &Configuration{AuthTokens: "alice:a-token, admin:admin-token", AuthAdmins: "admin"})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/0/last", nil)
+	r.Header.Set("Authorization", "Bearer a-token")
+	status, user := authenticatedUser(auth, r)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, principal{User: "alice"}, user)
+
+	r = httptest.NewRequest(http.MethodGet, "/ws/live?access_token=admin-token", nil)
+	status, user = authenticatedUser(auth, r)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, principal{User: "admin", Admin: true}, user)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/0/last", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	status, _ = authenticatedUser(auth, r)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	recorder := httptest.NewRecorder()
+	auth.Middleware(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), "Bearer")
+}
+
+func TestAuthenticatorProxyHeader(t *testing.T) {
+	auth := testAuthenticator(t, &Configuration{AuthProxyHeader: "x-forwarded-user", AuthTrustedProxies: "10.0.0.0/8"})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/0/last", nil)
+	r.RemoteAddr = "10.1.2.3:41234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	status, user := authenticatedUser(auth, r)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "alice", user.User)
+
+	// The header is ignored from anywhere else
+	r.RemoteAddr = "192.0.2.1:41234"
+	status, _ = authenticatedUser(auth, r)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestAuthenticatorBasic(t *testing.T) {
+	auth := testAuthenticator(t, &Configuration{AuthBasic: true})
+
+	checks := 0
+	auth.verifyPassword = func(_ context.Context, user, password string) (bool, error) {
+		checks++
+
+		return user == "alice" && password == "secret", nil
+	}
+
+	for range 2 {
+		r := httptest.NewRequest(http.MethodGet, "/api/0/last", nil)
+		r.SetBasicAuth("alice", "secret")
+		status, user := authenticatedUser(auth, r)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "alice", user.User)
+	}
+
+	assert.Equal(t, 1, checks, "a verified password is remembered")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/0/last", nil)
+	r.SetBasicAuth("alice", "wrong")
+
+	recorder := httptest.NewRecorder()
+	auth.Middleware(http.NotFoundHandler()).ServeHTTP(recorder, r)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), "Basic")
+}
+
+func TestRestrictUser(t *testing.T) {
+	user, err := restrictUser("", "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", user)
+
+	user, err = restrictUser("alice", "")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	_, err = restrictUser("alice", "bob")
+	require.ErrorIs(t, err, errForbidden)
+}
+
+func TestRequestError(t *testing.T) {
+	for err, code := range map[error]int{
+		errForbidden:                           http.StatusForbidden,
+		fmt.Errorf("%w: down", errAuthorizing): http.StatusInternalServerError,
+		errors.New("invalid bbox"):             http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		requestError(recorder, err)
+		assert.Equal(t, code, recorder.Code, err.Error())
+	}
+}
+
+func TestRoutesRequireAuthentication(t *testing.T) {
+	configuration := &Configuration{AuthTokens: "alice:a-token,admin:admin-token", AuthAdmins: "admin"}
+	env := Env{configuration: configuration}
+	env.auth = testAuthenticator(t, configuration)
+	router := env.BuildRoutes(configuration)
+
+	request := func(method, target, token string) int {
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, r)
+
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/0/version", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/0/last", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/ws/last", ""))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/api/0/last?user=bob", "a-token"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/api/0/stream?user=bob", "a-token"))
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodGet, "/export/gpx/2024-01-01T00:00:00Z/2024-01-02T00:00:00Z?user=bob", "a-token"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/points/1", "a-token"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/0/import?user=bob&device=phone", "a-token"))
+}
+
+func TestRedactRequestURI(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"/api/0/last":                               "/api/0/last",
+		"/api/0/last?user=alice":                    "/api/0/last?user=alice",
+		"/ws/last?access_token=secret":              "/ws/last?access_token=REDACTED",
+		"/api/0/stream?user=alice&access_token=abc": "/api/0/stream?access_token=REDACTED&user=alice",
+		"/api/0/stream?access_token=%zz":            "/api/0/stream?REDACTED",
+		"/share/secret":                             "/share/REDACTED",
+		"/share/secret/":                            "/share/REDACTED/",
+		"/share/secret/ws?lastEventId=1":            "/share/REDACTED/ws?lastEventId=1",
+	} {
+		assert.Equal(t, expected, redactRequestURI(uri), uri)
+	}
+}
+
+func TestRequestLoggerRedactsTokens(t *testing.T) {
+	var logged bytes.Buffer
+
+	logger := middleware.RequestLogger(redactingLogFormatter{
+		&middleware.DefaultLogFormatter{Logger: log.New(&logged, "", 0), NoColor: true},
+	})
+
+	var handled string
+
+	r := httptest.NewRequest(http.MethodGet, "/share/secret/last?access_token=also-secret", nil)
+	logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = r.RequestURI
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Contains(t, logged.String(), "/share/REDACTED/last?access_token=REDACTED")
+	assert.NotContains(t, logged.String(), "secret")
+	assert.Equal(t, "/share/secret/last?access_token=also-secret", handled)
+}
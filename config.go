@@ -1,33 +1,47 @@
 package main
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Configuration struct {
-	DbUser                 string `default:""                      split_words:"false"`
-	DbName                 string `default:"locations"             split_words:"false"`
-	DbPassword             string `default:""                      split_words:"false"`
-	DbHost                 string `default:""                      split_words:"false"`
-	DbSslMode              string `default:"require"               split_words:"false"`
-	GeocodeAPIURL          string `default:""                      split_words:"false"`
-	ReverseGeocodeAPIURL   string `default:""                      split_words:"false"`
-	Domain                 string `default:""                      split_words:"false"`
-	Port                   int    `default:"8080"                  split_words:"false"`
-	MaxDBOpenConnections   int    `default:"10"                    split_words:"false"`
-	MQTTURL                string `default:""                      split_words:"false"`
-	MQTTUsername           string `default:""                      split_words:"false"`
-	MQTTPassword           string `default:""                      split_words:"false"`
-	MQTTClientID           string `default:"owntracks-pg-recorder" split_words:"false"`
-	MQTTTopic              string `default:"owntracks/#"           split_words:"false"`
-	EnableGeocodingCrawler bool   `default:"false"                 split_words:"false"`
-	Debug                  bool   `default:"false"                 split_words:"false"`
-	FilterUsers            string `default:""                      split_words:"false"`
-	DefaultUser            string `default:""                      split_words:"false"`
-	GeocodeOnInsert        bool   `default:"false"                 split_words:"true"`
-	EnablePrometheus       bool   `default:"false"                 split_words:"true"`
-	DawarichURL            string `default:""                      split_words:"false"`
-	DawarichAPIKey         string `default:""                      split_words:"false"`
+	DbUser                 string         `default:""                      split_words:"false"`
+	DbName                 string         `default:"locations"             split_words:"false"`
+	DbPassword             string         `default:""                      split_words:"false"`
+	DbHost                 string         `default:""                      split_words:"false"`
+	DbSslMode              string         `default:"require"               split_words:"false"`
+	GeocodeAPIURL          string         `default:""                      split_words:"false"`
+	ReverseGeocodeAPIURL   string         `default:""                      split_words:"false"`
+	Domain                 string         `default:""                      split_words:"false"`
+	Port                   int            `default:"8080"                  split_words:"false"`
+	MaxDBOpenConnections   int            `default:"10"                    split_words:"false"`
+	MQTTURL                string         `default:""                      split_words:"false"`
+	MQTTUsername           string         `default:""                      split_words:"false"`
+	MQTTPassword           string         `default:""                      split_words:"false"`
+	MQTTClientID           string         `default:"owntracks-pg-recorder" split_words:"false"`
+	MQTTTopic              string         `default:"owntracks/#"           split_words:"false"`
+	EnableGeocodingCrawler bool           `default:"false"                 split_words:"false"`
+	Debug                  bool           `default:"false"                 split_words:"false"`
+	FilterUsers            string         `default:""                      split_words:"false"`
+	DefaultUser            string         `default:""                      split_words:"false"`
+	GeocodeOnInsert        bool           `default:"false"                 split_words:"true"`
+	EnablePrometheus       bool           `default:"false"                 split_words:"true"`
+	DawarichURL            string         `default:""                      split_words:"false"`
+	DawarichAPIKey         string         `default:""                      split_words:"false"`
+	DawarichAccounts       string         `default:""                      split_words:"false"`
+	DawarichOutboxMaxAge   time.Duration  `default:"168h"                  split_words:"false"`
+	SinksConfig            string         `default:""                      split_words:"false"`
+	PlacePrecision         PlacePrecision `default:"city"                  split_words:"false"`
+	GeocodeLanguage        string         `default:""                      split_words:"false"`
+	WebsocketOrigins       string         `default:"*"                     split_words:"false"`
+	LiveNotify             bool           `default:"true"                  split_words:"false"`
+	AuthTokens             string         `default:""                      split_words:"false"`
+	AuthBasic              bool           `default:"false"                 split_words:"false"`
+	AuthProxyHeader        string         `default:""                      split_words:"false"`
+	AuthTrustedProxies     string         `default:"127.0.0.1/32,::1/128"  split_words:"false"`
+	AuthAdmins             string         `default:""                      split_words:"false"`
 }
 
 func getConfiguration() (*Configuration, error) {
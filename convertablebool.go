@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type ConvertibleBoolean bool
@@ -19,3 +21,25 @@ func (bit *ConvertibleBoolean) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// ConvertibleFloat is a float64 that unmarshals from a JSON number, a numeric string
+// or null, which decodes as zero.
+type ConvertibleFloat float64
+
+func (number *ConvertibleFloat) UnmarshalJSON(data []byte) error {
+	asString := strings.Trim(string(data), `"`)
+	if asString == "" || asString == "null" {
+		*number = 0
+
+		return nil
+	}
+
+	parsed, err := strconv.ParseFloat(asString, 64)
+	if err != nil {
+		return fmt.Errorf("float unmarshal error: invalid input %s", string(data))
+	}
+
+	*number = ConvertibleFloat(parsed)
+
+	return nil
+}
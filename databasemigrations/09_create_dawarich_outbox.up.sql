@@ -0,0 +1,12 @@
+create table public.dawarich_outbox
+(
+    id              bigserial primary key,
+    location_id     integer     not null references public.locations (id) on delete cascade,
+    payload         jsonb       not null,
+    created_at      timestamptz not null default now(),
+    attempts        integer     not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error      text
+);
+
+create index idx_dawarich_outbox_next_attempt_at on public.dawarich_outbox (next_attempt_at);
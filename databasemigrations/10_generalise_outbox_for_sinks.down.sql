@@ -0,0 +1,6 @@
+delete from public.sink_outbox where sink <> 'dawarich';
+alter table public.sink_outbox drop column sink;
+
+alter index public.idx_sink_outbox_next_attempt_at rename to idx_dawarich_outbox_next_attempt_at;
+alter sequence public.sink_outbox_id_seq rename to dawarich_outbox_id_seq;
+alter table public.sink_outbox rename to dawarich_outbox;
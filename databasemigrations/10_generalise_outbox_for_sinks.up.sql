@@ -0,0 +1,6 @@
+alter table public.dawarich_outbox rename to sink_outbox;
+alter sequence public.dawarich_outbox_id_seq rename to sink_outbox_id_seq;
+alter index public.idx_dawarich_outbox_next_attempt_at rename to idx_sink_outbox_next_attempt_at;
+
+alter table public.sink_outbox add column sink text not null default 'dawarich';
+alter table public.sink_outbox alter column sink drop default;
@@ -0,0 +1 @@
+drop table if exists public.dawarich_sync_checkpoints;
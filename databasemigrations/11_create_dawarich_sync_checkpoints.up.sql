@@ -0,0 +1,10 @@
+create table public.dawarich_sync_checkpoints
+(
+    account      text        not null,
+    day          date        not null,
+    "user"       text        not null default '',
+    device       text        not null default '',
+    posted       integer     not null default 0,
+    completed_at timestamptz not null default now(),
+    primary key (account, day, "user", device)
+);
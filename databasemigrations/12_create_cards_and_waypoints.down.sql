@@ -0,0 +1,2 @@
+drop table if exists public.waypoints;
+drop table if exists public.cards;
@@ -0,0 +1,23 @@
+create table public.cards
+(
+    "user"     text        not null,
+    device     text        not null default '',
+    name       text,
+    face       text,
+    tid        text,
+    updated_at timestamptz not null default now(),
+    primary key ("user", device)
+);
+
+create table public.waypoints
+(
+    id          bigserial primary key,
+    "user"      text                   not null,
+    device      text                   not null,
+    tst         timestamptz            not null,
+    description text,
+    point       geography(Point, 4326) not null,
+    radius      integer,
+    rid         text,
+    unique ("user", device, tst)
+);
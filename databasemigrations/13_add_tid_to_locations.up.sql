@@ -0,0 +1 @@
+alter table public.locations add column tid text;
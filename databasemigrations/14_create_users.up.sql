@@ -0,0 +1,8 @@
+create extension if not exists pgcrypto;
+
+create table public.users
+(
+    username      text primary key,
+    password_hash text        not null,
+    created_at    timestamptz not null default now()
+);
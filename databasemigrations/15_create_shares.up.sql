@@ -0,0 +1,13 @@
+create table public.shares
+(
+    id              bigserial primary key,
+    token_hash      text        not null unique,
+    "user"          text        not null,
+    device          text        not null default '',
+    place_precision text        not null,
+    created_by      text        not null default '',
+    created_at      timestamptz not null default now(),
+    expires_at      timestamptz not null
+);
+
+create index shares_user_expires_at on public.shares ("user", expires_at);
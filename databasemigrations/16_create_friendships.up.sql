@@ -0,0 +1,13 @@
+create table public.friendships
+(
+    id              bigserial primary key,
+    "user"          text        not null,
+    friend          text        not null,
+    place_precision text        not null,
+    starts_at       timestamptz,
+    ends_at         timestamptz,
+    created_at      timestamptz not null default now(),
+    unique ("user", friend)
+);
+
+create index friendships_friend on public.friendships (friend);
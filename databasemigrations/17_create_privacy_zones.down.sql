@@ -0,0 +1,3 @@
+drop view if exists public.redacted_locations;
+drop function if exists public.privacy_zone_at(text, geography);
+drop table if exists public.privacy_zones;
@@ -0,0 +1,59 @@
+create table public.privacy_zones
+(
+    id         bigserial primary key,
+    "user"     text                   not null,
+    label      text                   not null,
+    centre     geography(Point, 4326) not null,
+    -- Circles have a radius in metres, and polygons an area
+    radius     double precision,
+    area       geography,
+    action     text                   not null default 'centre' check (action in ('centre', 'suppress')),
+    created_at timestamptz            not null default now(),
+    check ((radius is null) <> (area is null))
+);
+
+create index privacy_zones_user on public.privacy_zones ("user");
+
+-- The user's privacy zone containing a location, preferring one that suppresses it
+create function public.privacy_zone_at(zone_user text, location geography)
+    returns setof public.privacy_zones
+    language sql
+    stable
+as
+$$
+select *
+from public.privacy_zones
+where privacy_zones."user" = zone_user
+  and case
+          when radius is null then ST_Intersects(location, area)
+          else ST_DWithin(location, centre, radius)
+      end
+order by action = 'suppress' desc, id
+limit 1
+$$;
+
+-- Locations as they're published: those in a privacy zone are moved to its centre and
+-- named by its label, or left out. The locations themselves are never changed.
+create view public.redacted_locations as
+select locations.id,
+       locations."timestamp",
+       locations.devicetimestamp,
+       locations.accuracy,
+       case
+           when zone.id is null then locations.geocoding
+           else jsonb_build_object('display_name', zone.label)
+       end                                    as geocoding,
+       locations.batterylevel,
+       locations.connectiontype,
+       locations.doze,
+       coalesce(zone.centre, locations.point) as point,
+       locations.speed,
+       locations.altitude,
+       locations.verticalaccuracy,
+       locations."user",
+       locations.device,
+       locations.cog,
+       locations.tid
+from public.locations
+         left join lateral public.privacy_zone_at(locations."user", locations.point) zone on true
+where zone.action is distinct from 'suppress';
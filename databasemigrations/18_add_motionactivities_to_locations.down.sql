@@ -0,0 +1 @@
+alter table public.locations drop column motionactivities;
@@ -0,0 +1 @@
+alter table public.locations add column motionactivities text[];
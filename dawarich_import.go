@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dawarichPageSize = 1000
+
+	// dawarichImportDevice is the device recorded for imported points whose device
+	// can't be determined
+	dawarichImportDevice = "dawarich"
+)
+
+// dawarichAPIPoint is a single point returned by GET /api/v1/points. Depending on the
+// Dawarich version, numeric fields may be returned as strings.
+//
+//nolint:tagliatelle
+type dawarichAPIPoint struct {
+	ID               int              `json:"id"`
+	Timestamp        int64            `json:"timestamp"`
+	Latitude         ConvertibleFloat `json:"latitude"`
+	Longitude        ConvertibleFloat `json:"longitude"`
+	Altitude         ConvertibleFloat `json:"altitude"`
+	Accuracy         ConvertibleFloat `json:"accuracy"`
+	VerticalAccuracy ConvertibleFloat `json:"vertical_accuracy"`
+	Velocity         ConvertibleFloat `json:"velocity"`
+	Course           ConvertibleFloat `json:"course"`
+	Battery          ConvertibleFloat `json:"battery"`
+	Connection       string           `json:"connection"`
+	TrackerID        string           `json:"tracker_id"`
+	Topic            string           `json:"topic"`
+}
+
+// dawarichConnections maps Dawarich connection names back to OwnTracks conn values.
+var dawarichConnections = map[string]string{
+	"wifi":    "w",
+	"mobile":  "m",
+	"offline": "o",
+}
+
+// MQTTMsg converts a Dawarich point into a location owned by user and device.
+// Velocity is stored by Dawarich as received from OwnTracks, in km/h.
+func (point dawarichAPIPoint) MQTTMsg(user, device string) MQTTMsg {
+	connection, ok := dawarichConnections[point.Connection]
+	if !ok && len(point.Connection) == 1 {
+		connection = point.Connection
+	}
+
+	return MQTTMsg{
+		Type:                 locationType,
+		TrackerID:            point.TrackerID,
+		Accuracy:             float32(point.Accuracy),
+		VerticalAccuracy:     float32(point.VerticalAccuracy),
+		Battery:              int(point.Battery),
+		Connection:           connection,
+		Latitude:             float64(point.Latitude),
+		Longitude:            float64(point.Longitude),
+		Speed:                float32(point.Velocity),
+		Altitude:             float32(point.Altitude),
+		Course:               int(point.Course),
+		DeviceTimestampAsInt: point.Timestamp,
+		DeviceTimestamp:      time.Unix(point.Timestamp, 0),
+		User:                 user,
+		Device:               device,
+	}
+}
+
+// dawarichImportOptions are the command line options of the import-dawarich subcommand.
+type dawarichImportOptions struct {
+	DefaultUser   string
+	DefaultDevice string
+}
+
+// dawarichPointOwner works out which OwnTracks user and device a Dawarich point belongs
+// to. The account mapping wins, then the OwnTracks topic the point was published on,
+// then the defaults from the command line. Points without a user can't be imported.
+func dawarichPointOwner(
+	account DawarichAccount,
+	point dawarichAPIPoint,
+	options dawarichImportOptions,
+) (string, string, bool) {
+	user, device := account.User, account.Device
+
+	// OwnTracks topics are owntracks/<user>/<device>
+	parts := strings.Split(point.Topic, "/")
+	if len(parts) == 3 && parts[1] != "" && parts[2] != "" && (user == "" || user == parts[1]) {
+		user = parts[1]
+
+		if device == "" {
+			device = parts[2]
+		}
+	}
+
+	if user == "" {
+		user = options.DefaultUser
+	}
+
+	if device == "" {
+		device = options.DefaultDevice
+	}
+
+	if device == "" {
+		device = dawarichImportDevice
+	}
+
+	return user, device, user != ""
+}
+
+// ImportFromDawarich pages through the points stored in each of the sink's Dawarich
+// accounts in the half-open interval [start, end) and inserts any that are missing
+// from the database.
+func (env *Env) ImportFromDawarich(
+	ctx context.Context,
+	sink *DawarichSink,
+	start, end time.Time,
+	options dawarichImportOptions,
+) (ImportStats, error) {
+	importer := env.newLocationImporter("dawarich")
+	unowned := 0
+
+	for _, account := range sink.syncAccounts() {
+		slog.With("account", account.String(), "start", start, "end", end).
+			InfoContext(ctx, "Importing points from Dawarich")
+
+		err := account.fetchPoints(ctx, start, end, func(points []dawarichAPIPoint) error {
+			for _, point := range points {
+				user, device, ok := dawarichPointOwner(account, point, options)
+				if !ok {
+					unowned++
+
+					continue
+				}
+
+				err := importer.Add(ctx, point.MQTTMsg(user, device))
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return importer.stats, fmt.Errorf("importing from account %s: %w", account, err)
+		}
+	}
+
+	if unowned > 0 {
+		slog.With("points", unowned).
+			WarnContext(ctx, "Skipped Dawarich points without an OwnTracks user, use --default-user")
+	}
+
+	return importer.Close(ctx)
+}
+
+// fetchPoints pages through GET /api/v1/points for the given time window, calling
+// handle with the points on each page.
+func (account DawarichAccount) fetchPoints(
+	ctx context.Context,
+	start, end time.Time,
+	handle func(points []dawarichAPIPoint) error,
+) error {
+	for page := 1; ; page++ {
+		points, totalPages, err := account.fetchPointsPage(ctx, start, end, page)
+		if err != nil {
+			return err
+		}
+
+		slog.With("page", page, "totalPages", totalPages, "pointsOnPage", len(points)).
+			DebugContext(ctx, "Fetched Dawarich page")
+
+		err = handle(points)
+		if err != nil {
+			return err
+		}
+
+		if page >= totalPages || totalPages == 0 {
+			return nil
+		}
+	}
+}
+
+func (account DawarichAccount) fetchPointsPage(
+	ctx context.Context,
+	start, end time.Time,
+	page int,
+) ([]dawarichAPIPoint, int, error) {
+	reqURL := account.endpoint("/api/v1/points", url.Values{
+		"start_at": {start.UTC().Format(time.RFC3339)},
+		"end_at":   {end.UTC().Format(time.RFC3339)},
+		"page":     {strconv.Itoa(page)},
+		"per_page": {strconv.Itoa(dawarichPageSize)},
+		"order":    {"asc"},
+	})
+
+	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating request for page %d: %w", page, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching page %d: %w", page, err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("dawarich returned unexpected status %d for page %d", resp.StatusCode, page)
+	}
+
+	totalPages, _ := strconv.Atoi(resp.Header.Get("X-Total-Pages"))
+
+	var points []dawarichAPIPoint
+
+	err = json.NewDecoder(resp.Body).Decode(&points)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding page %d: %w", page, err)
+	}
+
+	return points, totalPages, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDawarichAPIPointDecodesStringNumbers(t *testing.T) {
+	var point dawarichAPIPoint
+
+	err := json.Unmarshal([]byte(`{
+  "id": 7, "timestamp": 1704067200, "latitude": "51.5074", "longitude": "-0.1278",
+  "altitude": 42, "accuracy": 10.5, "vertical_accuracy": null, "velocity": "48",
+  "course": 270, "battery": 85, "connection": "wifi", "tracker_id": "AB",
+  "topic": "owntracks/alice/iphone"}`), &point)
+	require.NoError(t, err)
+
+	msg := point.MQTTMsg("alice", "iphone")
+	assert.InDelta(t, 51.5074, msg.Latitude, 0.00001)
+	assert.InDelta(t, -0.1278, msg.Longitude, 0.00001)
+	assert.InDelta(t, 48, msg.Speed, 0.001)
+	assert.Zero(t, msg.VerticalAccuracy)
+	assert.Equal(t, "w", msg.Connection)
+	assert.Equal(t, 85, msg.Battery)
+	assert.Equal(t, 270, msg.Course)
+	assert.Equal(t, time.Unix(1704067200, 0), msg.DeviceTimestamp)
+}
+
+func TestConvertibleFloatRejectsNonNumbers(t *testing.T) {
+	var number ConvertibleFloat
+
+	require.Error(t, json.Unmarshal([]byte(`"north"`), &number))
+}
+
+func TestDawarichPointOwner(t *testing.T) {
+	topic := dawarichAPIPoint{Topic: "owntracks/alice/iphone"}
+	noTopic := dawarichAPIPoint{}
+
+	tests := []struct {
+		name    string
+		account DawarichAccount
+		point   dawarichAPIPoint
+		options dawarichImportOptions
+		user    string
+		device  string
+		ok      bool
+	}{
+		{"account wins", DawarichAccount{User: "bob", Device: "pixel"}, topic, dawarichImportOptions{}, "bob", "pixel", true},
+		{"device from topic", DawarichAccount{User: "alice"}, topic, dawarichImportOptions{}, "alice", "iphone", true},
+		{"topic for another user", DawarichAccount{User: "bob"}, topic, dawarichImportOptions{}, "bob", "dawarich", true},
+		{"topic only", DawarichAccount{}, topic, dawarichImportOptions{}, "alice", "iphone", true},
+		{"defaults", DawarichAccount{}, noTopic, dawarichImportOptions{DefaultUser: "carol", DefaultDevice: "watch"}, "carol", "watch", true},
+		{"unowned", DawarichAccount{}, noTopic, dawarichImportOptions{}, "", "dawarich", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, device, ok := dawarichPointOwner(test.account, test.point, test.options)
+			assert.Equal(t, test.user, user)
+			assert.Equal(t, test.device, device)
+			assert.Equal(t, test.ok, ok)
+		})
+	}
+}
+
+func TestFetchPointsPagesThroughResults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "key", r.URL.Query().Get("api_key"))
+
+		w.Header().Set("X-Total-Pages", "2")
+
+		if r.URL.Query().Get("page") == "1" {
+			_, _ = w.Write([]byte(`[{"id": 1, "timestamp": 100}, {"id": 2, "timestamp": 200}]`))
+		} else {
+			_, _ = w.Write([]byte(`[{"id": 3, "timestamp": 300}]`))
+		}
+	}))
+	defer server.Close()
+
+	account := DawarichAccount{URL: server.URL, APIKey: "key"}
+
+	var timestamps []int64
+
+	err := account.fetchPoints(t.Context(), time.Unix(0, 0), time.Unix(1000, 0), func(points []dawarichAPIPoint) error {
+		for _, point := range points {
+			timestamps = append(timestamps, point.Timestamp)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{100, 200, 300}, timestamps)
+}
+
+func TestFetchPointsFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	account := DawarichAccount{URL: server.URL, APIKey: "key"}
+
+	err := account.fetchPoints(t.Context(), time.Unix(0, 0), time.Unix(1000, 0), func([]dawarichAPIPoint) error {
+		return nil
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
+
+func TestLocationInsertQueryNumbersEveryRow(t *testing.T) {
+	query := locationInsertQuery(2)
+
+	assert.Contains(t, query, "($1, $2,")
+	assert.Contains(t, query, "($17, $18,")
+	assert.True(t, strings.HasSuffix(query, "$32)\non conflict do nothing\nRETURNING id"))
+	assert.Len(t, locationInsertArgs(time.Now(), testMQTTMsg()), locationInsertParams)
+}
+
+func TestImportedLocationMatchesStoredTimestamp(t *testing.T) {
+	msg := testMQTTMsg()
+	msg.DeviceTimestamp = time.Date(2024, 1, 1, 0, 0, 0, 1500, time.UTC)
+
+	stored := time.Date(2024, 1, 1, 0, 0, 0, 2000, time.UTC).In(time.FixedZone("CET", 3600))
+	assert.Equal(t, stored.UnixMicro(), newImportedLocation(msg).Timestamp)
+	assert.True(t, strings.HasSuffix(locationImportQuery(1), "RETURNING id, \"user\", device, devicetimestamp, "+
+		"ST_Y(point::geometry), ST_X(point::geometry)"))
+}
+
+func TestFindSubcommand(t *testing.T) {
+	_, args, ok := findSubcommand([]string{"recorder", "import-dawarich", "--start", "x"})
+	require.True(t, ok)
+	assert.Equal(t, []string{"--start", "x"}, args)
+
+	_, _, ok = findSubcommand([]string{"recorder", "-flag", "sync-dawarich"})
+	assert.True(t, ok)
+
+	_, _, ok = findSubcommand([]string{"recorder"})
+	assert.False(t, ok)
+}
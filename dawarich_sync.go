@@ -4,36 +4,352 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
-	"strconv"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const (
+	dawarichSyncDay        = 24 * time.Hour
+	dawarichBatchSize      = 500
+	defaultSyncConcurrency = 4
 )
 
-// dawarichAPIPoint is a single point returned by GET /api/v1/points.
-type dawarichAPIPoint struct {
-	ID        int   `json:"id"`
-	Timestamp int64 `json:"timestamp"`
+// dawarichSyncOptions are the command line options of the sync-dawarich subcommand.
+type dawarichSyncOptions struct {
+	DryRun      bool
+	User        string
+	Device      string
+	Concurrency int
+}
+
+// dawarichSyncChunk is a half-open interval [Start, End) of at most one UTC day.
+type dawarichSyncChunk struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Day returns the UTC date that the chunk belongs to.
+func (chunk dawarichSyncChunk) Day() time.Time {
+	return chunk.Start.UTC().Truncate(dawarichSyncDay)
+}
+
+// Complete reports whether the chunk covers a whole day that has already finished, and
+// so can be checkpointed.
+func (chunk dawarichSyncChunk) Complete(now time.Time) bool {
+	return chunk.Start.Equal(chunk.Day()) &&
+		chunk.End.Equal(chunk.Day().Add(dawarichSyncDay)) &&
+		!chunk.End.After(now)
+}
+
+// dawarichSyncChunks splits [start, end) into chunks aligned to UTC day boundaries.
+func dawarichSyncChunks(start, end time.Time) []dawarichSyncChunk {
+	var chunks []dawarichSyncChunk
+
+	for chunkStart := start.UTC(); chunkStart.Before(end); {
+		chunkEnd := chunkStart.Truncate(dawarichSyncDay).Add(dawarichSyncDay)
+		if chunkEnd.After(end) {
+			chunkEnd = end.UTC()
+		}
+
+		chunks = append(chunks, dawarichSyncChunk{Start: chunkStart, End: chunkEnd})
+		chunkStart = chunkEnd
+	}
+
+	return chunks
+}
+
+type dawarichSyncFailure struct {
+	Account   string
+	User      string
+	Device    string
+	Timestamp time.Time
+	Err       string
+}
+
+// dawarichSyncSummary accumulates the outcome of a sync across concurrent chunks.
+type dawarichSyncSummary struct {
+	mutex sync.Mutex
+
+	DryRun           bool
+	Chunks           int
+	CheckpointedDays int
+	AlreadyPresent   int
+	Missing          int
+	Posted           int
+	FailedChunks     []string
+	Failures         []dawarichSyncFailure
+}
+
+func (summary *dawarichSyncSummary) update(fn func(summary *dawarichSyncSummary)) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+
+	fn(summary)
+}
+
+// Print writes a human readable summary, including every point that failed to sync.
+func (summary *dawarichSyncSummary) Print(w io.Writer) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+
+	mode := ""
+	if summary.DryRun {
+		mode = " (dry run)"
+	}
+
+	_, _ = fmt.Fprintf(w, "Dawarich sync summary%s\n", mode)
+	_, _ = fmt.Fprintf(w, "  Day chunks:          %d\n", summary.Chunks)
+	_, _ = fmt.Fprintf(w, "  Already checkpointed: %d\n", summary.CheckpointedDays)
+	_, _ = fmt.Fprintf(w, "  Already in Dawarich: %d\n", summary.AlreadyPresent)
+	_, _ = fmt.Fprintf(w, "  Missing:             %d\n", summary.Missing)
+	_, _ = fmt.Fprintf(w, "  Posted:              %d\n", summary.Posted)
+	_, _ = fmt.Fprintf(w, "  Failed:              %d\n", len(summary.Failures))
+
+	for _, chunk := range summary.FailedChunks {
+		_, _ = fmt.Fprintf(w, "  Failed chunk: %s\n", chunk)
+	}
+
+	slices.SortFunc(summary.Failures, func(a, b dawarichSyncFailure) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	for _, failure := range summary.Failures {
+		_, _ = fmt.Fprintf(w, "  Failed point: account=%s user=%s device=%s tst=%s err=%s\n",
+			failure.Account,
+			failure.User,
+			failure.Device,
+			failure.Timestamp.UTC().Format(time.RFC3339),
+			failure.Err,
+		)
+	}
+}
+
+// Err returns an error if any chunk or point failed to sync.
+func (summary *dawarichSyncSummary) Err() error {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+
+	if len(summary.FailedChunks) > 0 || len(summary.Failures) > 0 {
+		return fmt.Errorf(
+			"%d chunks and %d points failed to sync",
+			len(summary.FailedChunks),
+			len(summary.Failures),
+		)
+	}
+
+	return nil
+}
+
+// dawarichSyncer holds the state of one sync-dawarich run.
+type dawarichSyncer struct {
+	env     *Env
+	sink    *DawarichSink
+	options dawarichSyncOptions
+	summary *dawarichSyncSummary
+
+	// batchUnsupported records the Dawarich URLs without the batch points API
+	batchUnsupported sync.Map
 }
 
 // SyncToDawarich compares all local DB points in the half-open interval
 // [start, end) against the points already stored in Dawarich and POSTs any
-// that are missing.  Progress is logged at INFO; per-point detail at DEBUG.
-//
-//nolint:cyclop,funlen
-func (env *Env) SyncToDawarich(ctx context.Context, start, end time.Time) error {
-	slog.With("start", start, "end", end).InfoContext(ctx, "Starting Dawarich sync")
+// that are missing. The interval is processed in day-sized chunks per Dawarich
+// account; completed days are checkpointed so that an interrupted sync resumes
+// where it left off. Points from users without an account are skipped.
+func (env *Env) SyncToDawarich(
+	ctx context.Context,
+	sink *DawarichSink,
+	start, end time.Time,
+	options dawarichSyncOptions,
+) (*dawarichSyncSummary, error) {
+	if start.IsZero() {
+		err := env.database.QueryRowContext(ctx, "select coalesce(min(devicetimestamp), now()) from locations").
+			Scan(&start)
+		if err != nil {
+			return nil, fmt.Errorf("finding earliest location: %w", err)
+		}
+	}
+
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+
+	slog.With("start", start, "end", end, "dryRun", options.DryRun).
+		InfoContext(ctx, "Starting Dawarich sync")
+
+	syncer := &dawarichSyncer{
+		env:     env,
+		sink:    sink,
+		options: options,
+		summary: &dawarichSyncSummary{DryRun: options.DryRun},
+	}
+
+	chunks := dawarichSyncChunks(start, end)
+	sem := make(chan struct{}, options.Concurrency)
+
+	var waitGroup sync.WaitGroup
 
-	existing, err := env.fetchDawarichTimestamps(ctx, start, end)
+	for _, account := range sink.syncAccounts() {
+		if !syncer.includesAccount(account) {
+			continue
+		}
+
+		for _, chunk := range chunks {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				waitGroup.Wait()
+
+				return syncer.summary, ctx.Err()
+			}
+
+			waitGroup.Go(func() {
+				defer func() { <-sem }()
+
+				err := syncer.syncChunk(ctx, account, chunk)
+				if err != nil {
+					slog.With("err", err, "account", account.String(), "day", chunk.Day()).
+						ErrorContext(ctx, "Failed to sync day to Dawarich")
+					syncer.summary.update(func(summary *dawarichSyncSummary) {
+						summary.FailedChunks = append(summary.FailedChunks, fmt.Sprintf(
+							"account=%s day=%s err=%v",
+							account,
+							chunk.Day().Format(time.DateOnly),
+							err,
+						))
+					})
+				}
+			})
+		}
+	}
+
+	waitGroup.Wait()
+
+	return syncer.summary, ctx.Err()
+}
+
+// includesAccount applies the --user and --device options to an account.
+func (syncer *dawarichSyncer) includesAccount(account DawarichAccount) bool {
+	if syncer.options.User != "" && account.User != "" && account.User != syncer.options.User {
+		return false
+	}
+
+	if syncer.options.Device != "" && account.Device != "" &&
+		account.Device != syncer.options.Device {
+		return false
+	}
+
+	return true
+}
+
+func checkpointKey(account DawarichAccount) string {
+	return account.URL + " " + account.String()
+}
+
+func (syncer *dawarichSyncer) syncChunk(
+	ctx context.Context,
+	account DawarichAccount,
+	chunk dawarichSyncChunk,
+) error {
+	database := syncer.env.database
+	complete := chunk.Complete(time.Now())
+
+	if complete {
+		var checkpointed bool
+
+		err := database.QueryRowContext(ctx, `select exists(
+    select 1 from dawarich_sync_checkpoints where account = $1 and day = $2 and "user" = $3 and device = $4)`,
+			checkpointKey(account), chunk.Day(), syncer.options.User, syncer.options.Device,
+		).Scan(&checkpointed)
+		if err != nil {
+			return fmt.Errorf("reading checkpoint: %w", err)
+		}
+
+		if checkpointed {
+			syncer.summary.update(func(summary *dawarichSyncSummary) {
+				summary.Chunks++
+				summary.CheckpointedDays++
+			})
+
+			return nil
+		}
+	}
+
+	existing, err := account.fetchTimestamps(ctx, chunk.Start, chunk.End)
 	if err != nil {
 		return fmt.Errorf("fetching existing Dawarich points: %w", err)
 	}
 
-	slog.With("count", len(existing)).InfoContext(ctx, "Fetched existing Dawarich timestamps")
+	points, err := syncer.localPoints(ctx, account, chunk)
+	if err != nil {
+		return err
+	}
+
+	var missing []MQTTMsg
+
+	for _, msg := range points {
+		if _, exists := existing[msg.DeviceTimestampAsInt]; !exists {
+			missing = append(missing, msg)
+		}
+	}
+
+	slog.With("account", account.String(), "day", chunk.Day().Format(time.DateOnly)).
+		With("local", len(points), "missing", len(missing)).
+		DebugContext(ctx, "Compared day with Dawarich")
+
+	var failures []dawarichSyncFailure
+
+	if !syncer.options.DryRun && len(missing) > 0 {
+		failures = syncer.post(ctx, account, missing)
+	}
+
+	syncer.summary.update(func(summary *dawarichSyncSummary) {
+		summary.Chunks++
+		summary.AlreadyPresent += len(points) - len(missing)
+		summary.Missing += len(missing)
+		summary.Failures = append(summary.Failures, failures...)
+
+		if !syncer.options.DryRun {
+			summary.Posted += len(missing) - len(failures)
+		}
+	})
+
+	if syncer.options.DryRun || len(failures) > 0 || !complete {
+		return nil
+	}
+
+	_, err = database.ExecContext(ctx, `insert into dawarich_sync_checkpoints (account, day, "user", device, posted)
+values ($1, $2, $3, $4, $5)
+on conflict do nothing`,
+		checkpointKey(account), chunk.Day(), syncer.options.User, syncer.options.Device, len(missing),
+	)
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+
+	return nil
+}
 
-	rows, err := env.database.QueryContext(ctx, `
+// localPoints returns the recorder's points in the chunk that belong to the account,
+// with privacy zones applied.
+//
+//nolint:cyclop,funlen
+func (syncer *dawarichSyncer) localPoints(
+	ctx context.Context,
+	account DawarichAccount,
+	chunk dawarichSyncChunk,
+) ([]MQTTMsg, error) {
+	rows, err := syncer.env.database.QueryContext(ctx, `
 		SELECT
 			EXTRACT(EPOCH FROM devicetimestamp)::bigint,
 			devicetimestamp,
@@ -48,17 +364,21 @@ func (env *Env) SyncToDawarich(ctx context.Context, start, end time.Time) error
 			cog,
 			"user",
 			device
-		FROM locations
+		FROM redacted_locations
 		WHERE devicetimestamp >= $1 AND devicetimestamp < $2
+		  AND ($3 = '' OR "user" = $3)
+		  AND ($4 = '' OR device = $4)
+		  AND ($5 = '' OR "user" = $5)
+		  AND ($6 = '' OR device = $6)
 		ORDER BY devicetimestamp ASC
-	`, start, end)
+	`, chunk.Start, chunk.End, account.User, account.Device, syncer.options.User, syncer.options.Device)
 	if err != nil {
-		return fmt.Errorf("querying database: %w", err)
+		return nil, fmt.Errorf("querying database: %w", err)
 	}
 
 	defer func() { _ = rows.Close() }()
 
-	var posted, skipped int
+	var points []MQTTMsg
 
 	for rows.Next() {
 		var (
@@ -85,12 +405,11 @@ func (env *Env) SyncToDawarich(ctx context.Context, start, end time.Time) error
 			&user, &device,
 		)
 		if err != nil {
-			return fmt.Errorf("scanning row: %w", err)
+			return nil, fmt.Errorf("scanning row: %w", err)
 		}
 
-		if _, exists := existing[tst]; exists {
-			skipped++
-
+		// A user-wide account doesn't own devices that have their own account
+		if owner, ok := syncer.sink.accountFor(user, device); !ok || owner != account {
 			continue
 		}
 
@@ -129,88 +448,143 @@ func (env *Env) SyncToDawarich(ctx context.Context, start, end time.Time) error
 			msg.Course = int(cog.Int64)
 		}
 
-		err = env.sendLocationToDawarich(ctx, msg)
-		if err != nil {
-			slog.With("err", err, "tst", devTime, "user", user, "device", device).
-				WarnContext(ctx, "Failed to post point to Dawarich, skipping")
-		} else {
-			slog.With("tst", devTime, "user", user, "device", device).
-				DebugContext(ctx, "Posted missing point to Dawarich")
-
-			posted++
-		}
+		points = append(points, msg)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return fmt.Errorf("iterating rows: %w", err)
+		return nil, fmt.Errorf("iterating rows: %w", err)
 	}
 
-	slog.With("posted", posted, "skipped", skipped).InfoContext(ctx, "Dawarich sync complete")
-
-	return nil
+	return points, nil
 }
 
-// fetchDawarichTimestamps pages through GET /api/v1/points and returns the set
-// of Unix timestamps already stored in Dawarich for the given time window.
-func (env *Env) fetchDawarichTimestamps(
+// post sends missing points to Dawarich, using the batch points API where the
+// Dawarich instance supports it, and returns the points that failed.
+func (syncer *dawarichSyncer) post(
 	ctx context.Context,
-	start, end time.Time,
-) (map[int64]struct{}, error) {
-	timestamps := make(map[int64]struct{})
-	page := 1
-
-	for {
-		reqURL := fmt.Sprintf(
-			"%s/api/v1/points?api_key=%s&start_at=%s&end_at=%s&page=%d&per_page=1000&order=asc",
-			env.configuration.DawarichURL,
-			env.configuration.DawarichAPIKey,
-			start.UTC().Format(time.RFC3339),
-			end.UTC().Format(time.RFC3339),
-			page,
-		)
+	account DawarichAccount,
+	points []MQTTMsg,
+) []dawarichSyncFailure {
+	var failures []dawarichSyncFailure
+
+	failed := func(msg MQTTMsg, err error) {
+		slog.With("err", err, "tst", msg.DeviceTimestamp, "user", msg.User, "device", msg.Device).
+			WarnContext(ctx, "Failed to post point to Dawarich")
+
+		failures = append(failures, dawarichSyncFailure{
+			Account:   account.String(),
+			User:      msg.User,
+			Device:    msg.Device,
+			Timestamp: msg.DeviceTimestamp,
+			Err:       err.Error(),
+		})
+	}
 
-		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	for batch := range slices.Chunk(points, dawarichBatchSize) {
+		if _, unsupported := syncer.batchUnsupported.Load(account.URL); !unsupported {
+			err := account.postBatch(ctx, batch)
+			if err == nil {
+				continue
+			}
 
-		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, reqURL, nil)
-		if err != nil {
-			cancel()
+			if !errors.Is(err, errDawarichBatchUnsupported) {
+				for _, msg := range batch {
+					failed(msg, err)
+				}
 
-			return nil, fmt.Errorf("creating request for page %d: %w", page, err)
-		}
+				continue
+			}
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			cancel()
+			slog.With("url", account.URL).
+				InfoContext(ctx, "Dawarich batch points API unavailable, posting points individually")
+			syncer.batchUnsupported.Store(account.URL, struct{}{})
+		}
 
-			return nil, fmt.Errorf("fetching page %d: %w", page, err)
+		for _, msg := range batch {
+			err := syncer.sink.sendToAccount(ctx, account, msg)
+			if err != nil {
+				failed(msg, err)
+			}
 		}
+	}
 
-		totalPages, _ := strconv.Atoi(resp.Header.Get("X-Total-Pages"))
+	return failures
+}
 
-		var points []dawarichAPIPoint
+var errDawarichBatchUnsupported = errors.New("dawarich batch points API is not available")
 
-		decodeErr := json.NewDecoder(resp.Body).Decode(&points)
-		_ = resp.Body.Close()
+// dawarichBatchPayload is the body of POST /api/v1/points.
+type dawarichBatchPayload struct {
+	Locations []*geojson.Feature `json:"locations"`
+}
 
-		cancel()
+// newDawarichBatchFeature converts a location into the GeoJSON feature accepted by
+// Dawarich's batch points API.
+func newDawarichBatchFeature(msg MQTTMsg) *geojson.Feature {
+	feature := geojson.NewPointFeature([]float64{msg.Longitude, msg.Latitude})
+	feature.SetProperty("timestamp", time.Unix(msg.DeviceTimestampAsInt, 0).UTC().Format(time.RFC3339))
+	feature.SetProperty("altitude", msg.Altitude)
+	// OwnTracks speeds are km/h; the batch API expects m/s
+	feature.SetProperty("speed", float64(msg.Speed)/3.6)
+	feature.SetProperty("horizontal_accuracy", msg.Accuracy)
+	feature.SetProperty("vertical_accuracy", msg.VerticalAccuracy)
+	feature.SetProperty("course", msg.Course)
+	feature.SetProperty("battery_level", float64(msg.Battery)/100)
+	feature.SetProperty("device_id", msg.Device)
+
+	return feature
+}
 
-		if decodeErr != nil {
-			return nil, fmt.Errorf("decoding page %d: %w", page, decodeErr)
-		}
+// postBatch sends points with POST /api/v1/points. It returns
+// errDawarichBatchUnsupported if the Dawarich instance doesn't have that endpoint.
+func (account DawarichAccount) postBatch(ctx context.Context, points []MQTTMsg) error {
+	payload := dawarichBatchPayload{Locations: make([]*geojson.Feature, 0, len(points))}
 
-		for _, p := range points {
-			timestamps[p.Timestamp] = struct{}{}
-		}
+	for _, msg := range points {
+		payload.Locations = append(payload.Locations, newDawarichBatchFeature(msg))
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshalling Dawarich batch: %w", err)
+	}
 
-		slog.With("page", page, "totalPages", totalPages, "pointsOnPage", len(points)).
-			DebugContext(ctx, "Fetched Dawarich page")
+	endpoint := account.endpoint("/api/v1/points", url.Values{})
 
-		if page >= totalPages || totalPages == 0 {
-			break
+	status, err := sendHTTPPayload(ctx, http.MethodPost, endpoint, jsonHeaders, body)
+	if err != nil {
+		return fmt.Errorf("sending batch to Dawarich: %w", err)
+	}
+
+	if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+		return errDawarichBatchUnsupported
+	}
+
+	if !isSuccessStatus(status) {
+		return fmt.Errorf("dawarich returned unexpected status %d for batch", status)
+	}
+
+	return nil
+}
+
+// fetchTimestamps returns the set of Unix timestamps already stored in Dawarich for
+// the given time window.
+func (account DawarichAccount) fetchTimestamps(
+	ctx context.Context,
+	start, end time.Time,
+) (map[int64]struct{}, error) {
+	timestamps := make(map[int64]struct{})
+
+	err := account.fetchPoints(ctx, start, end, func(points []dawarichAPIPoint) error {
+		for _, p := range points {
+			timestamps[p.Timestamp] = struct{}{}
 		}
 
-		page++
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return timestamps, nil
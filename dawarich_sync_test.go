@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDawarichSyncChunks(t *testing.T) {
+	start := time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 1, 3, 6, 0, 0, 0, time.UTC)
+
+	chunks := dawarichSyncChunks(start, end)
+	require.Len(t, chunks, 3)
+
+	assert.Equal(t, start, chunks[0].Start)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), chunks[0].End)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), chunks[1].Start)
+	assert.Equal(t, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), chunks[1].End)
+	assert.Equal(t, end, chunks[2].End)
+
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	assert.False(t, chunks[0].Complete(now), "partial first day")
+	assert.True(t, chunks[1].Complete(now))
+	assert.False(t, chunks[2].Complete(now), "partial last day")
+	assert.False(t, chunks[1].Complete(chunks[1].Start.Add(time.Hour)), "day not over yet")
+}
+
+func TestDawarichSyncerPostFallsBackToSinglePoints(t *testing.T) {
+	var batchCalls, singleCalls int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/points":
+			batchCalls++
+
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/v1/owntracks/points":
+			singleCalls++
+
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	sink := &DawarichSink{URL: server.URL, APIKey: "key"}
+	syncer := &dawarichSyncer{sink: sink, summary: &dawarichSyncSummary{}}
+	account, _ := sink.accountFor("alice", "iphone")
+
+	points := []MQTTMsg{testMQTTMsg(), testMQTTMsg(), testMQTTMsg()}
+
+	failures := syncer.post(t.Context(), account, points)
+	assert.Empty(t, failures)
+	assert.Equal(t, 1, batchCalls)
+	assert.Equal(t, 3, singleCalls)
+
+	// The batch API isn't retried once it is known to be missing
+	failures = syncer.post(t.Context(), account, points)
+	assert.Empty(t, failures)
+	assert.Equal(t, 1, batchCalls)
+	assert.Equal(t, 6, singleCalls)
+}
+
+func TestDawarichSyncerPostBatch(t *testing.T) {
+	var received dawarichBatchPayload
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/points", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sink := &DawarichSink{URL: server.URL, APIKey: "key"}
+	syncer := &dawarichSyncer{sink: sink, summary: &dawarichSyncSummary{}}
+	account, _ := sink.accountFor("alice", "iphone")
+
+	failures := syncer.post(t.Context(), account, []MQTTMsg{testMQTTMsg()})
+	assert.Empty(t, failures)
+	require.Len(t, received.Locations, 1)
+	assert.Equal(t, []float64{-0.1278, 51.5074}, received.Locations[0].Geometry.Point)
+	assert.Equal(t, "2024-01-01T00:00:00Z", received.Locations[0].Properties["timestamp"])
+	assert.InDelta(t, 13.333, received.Locations[0].Properties["speed"], 0.001)
+}
+
+func TestDawarichSyncerPostRecordsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sink := &DawarichSink{URL: server.URL, APIKey: "key"}
+	syncer := &dawarichSyncer{sink: sink, summary: &dawarichSyncSummary{}}
+	account, _ := sink.accountFor("alice", "iphone")
+
+	failures := syncer.post(t.Context(), account, []MQTTMsg{testMQTTMsg()})
+	require.Len(t, failures, 1)
+	assert.Equal(t, "alice", failures[0].User)
+	assert.Contains(t, failures[0].Err, "500")
+
+	syncer.summary.Failures = failures
+
+	var output bytes.Buffer
+
+	syncer.summary.Print(&output)
+	assert.Contains(t, output.String(), "user=alice device=iphone tst=2024-01-01T00:00:00Z")
+	require.Error(t, syncer.summary.Err())
+}
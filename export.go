@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// exportFlushEvery is how many records an export writes between flushes.
+	exportFlushEvery = 100
+	// defaultSegmentGap is the time between points after which a track export starts
+	// a new segment
+	defaultSegmentGap = 10 * time.Minute
+)
+
+// trackPoint is a location as written to track exports.
+type trackPoint struct {
+	DeviceTimestamp time.Time
+	Latitude        float64
+	Longitude       float64
+	Altitude        *float32
+	Speed           *float32
+	Course          *int
+	User            string
+	Device          string
+}
+
+// TrackName identifies the user and device that a point belongs to.
+func (point trackPoint) TrackName() string {
+	return point.User + "/" + point.Device
+}
+
+// getTrackPoints returns the locations in [from, to] ordered by user, device and time,
+// so that each device's track can be written in one pass.
+func (env *Env) getTrackPoints(
+	ctx context.Context,
+	from, to time.Time,
+	filter pointsFilter,
+) (*sql.Rows, error) {
+	query, args := filter.query(`SELECT
+    devicetimestamp, st_y(point::geometry) AS latitude, st_x(point::geometry) AS longitude,
+    altitude, speed, cog, "user", device
+FROM `+filter.table()+`
+WHERE devicetimestamp >= $1 AND devicetimestamp <= $2
+`, `"user", device, devicetimestamp`, []any{from, to})
+
+	rows, err := env.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying track points: %w", err)
+	}
+
+	return rows, nil
+}
+
+func scanTrackPoint(rows *sql.Rows) (trackPoint, error) {
+	var point trackPoint
+
+	err := rows.Scan(
+		&point.DeviceTimestamp,
+		&point.Latitude,
+		&point.Longitude,
+		&point.Altitude,
+		&point.Speed,
+		&point.Course,
+		&point.User,
+		&point.Device,
+	)
+
+	return point, err
+}
+
+// pointsFilter restricts the locations included in an export.
+type pointsFilter struct {
+	User   string
+	Device string
+	// BBox is minLon, minLat, maxLon, maxLat, as in a GeoJSON bbox
+	BBox []float64
+	// MaxAccuracy excludes locations whose accuracy radius is larger, in metres
+	MaxAccuracy float64
+	// Last keeps only the latest Last matching locations, if it's positive
+	Last int
+	// Raw reads the stored locations, rather than redacted_locations with privacy zones
+	// applied, for the operator's own exports
+	Raw bool
+	// Precision, if it's set, reads redacted locations reduced to a friendship's
+	// precision
+	Precision PlacePrecision
+	// Since and Until, if they're set, keep only locations recorded in a friendship's
+	// window, whatever time range is asked for
+	Since *time.Time
+	Until *time.Time
+}
+
+// table returns the table or view that the filter's locations are read from.
+func (filter pointsFilter) table() string {
+	switch {
+	case filter.Precision != "":
+		return reducedLocationsTable(filter.Precision)
+	case filter.Raw:
+		return locationsTable
+	default:
+		return redactedLocationsTable
+	}
+}
+
+// reducedLocationsTable is redacted_locations as a friend sees them at precision:
+// coordinates rounded to match, an accuracy no better than the rounding, and no
+// geocoding, which would name the place more exactly.
+func reducedLocationsTable(precision PlacePrecision) string {
+	grid := math.Pow(10, -float64(precision.CoordinateDecimals()))
+
+	return fmt.Sprintf(`(SELECT id, "timestamp", devicetimestamp, greatest(accuracy, %[2]g) AS accuracy,
+    NULL::jsonb AS geocoding, batterylevel, connectiontype, doze,
+    ST_SnapToGrid(point::geometry, %[1]g)::geography AS point, speed, altitude, verticalaccuracy,
+    "user", device, cog, tid
+FROM %[3]s) AS %[3]s`, grid, grid*metresPerDegree/2, redactedLocationsTable)
+}
+
+// query completes a query of locations with the filter's conditions and the given
+// ordering.
+func (filter pointsFilter) query(query string, order string, args []any) (string, []any) {
+	conditions, args := filter.sql(args)
+	if filter.Last <= 0 {
+		return query + conditions + "ORDER BY " + order, args
+	}
+
+	limit, args := filter.limit(args)
+
+	return "SELECT * FROM (\n" + query + conditions + limit + ") AS last\nORDER BY " + order, args
+}
+
+// limit returns a clause that keeps only the filter's Last locations, or an empty
+// string if it's not set.
+func (filter pointsFilter) limit(args []any) (string, []any) {
+	if filter.Last <= 0 {
+		return "", args
+	}
+
+	return fmt.Sprintf("ORDER BY devicetimestamp DESC LIMIT $%d\n", len(args)+1), append(args, filter.Last)
+}
+
+// sql returns conditions to add to a query's where clause, numbering placeholders
+// after the given arguments.
+func (filter pointsFilter) sql(args []any) (string, []any) {
+	var conditions strings.Builder
+
+	add := func(condition string, values ...any) {
+		placeholders := make([]any, len(values))
+		for i := range values {
+			placeholders[i] = len(args) + i + 1
+		}
+
+		conditions.WriteString("AND " + fmt.Sprintf(condition, placeholders...) + "\n")
+
+		args = append(args, values...)
+	}
+
+	if filter.User != "" {
+		add(`"user" = $%d`, filter.User)
+	}
+
+	if filter.Device != "" {
+		add(`device = $%d`, filter.Device)
+	}
+
+	if len(filter.BBox) == 4 {
+		add(`ST_Intersects(point, ST_MakeEnvelope($%d, $%d, $%d, $%d, 4326)::geography)`,
+			filter.BBox[0], filter.BBox[1], filter.BBox[2], filter.BBox[3])
+	}
+
+	if filter.MaxAccuracy > 0 {
+		add(`accuracy <= $%d`, filter.MaxAccuracy)
+	}
+
+	if filter.Since != nil {
+		add(`devicetimestamp >= $%d`, *filter.Since)
+	}
+
+	if filter.Until != nil {
+		add(`devicetimestamp < $%d`, *filter.Until)
+	}
+
+	return conditions.String(), args
+}
+
+// parseBBox parses a "minLon,minLat,maxLon,maxLat" bounding box.
+func parseBBox(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox %q should be minLon,minLat,maxLon,maxLat", value)
+	}
+
+	bbox := make([]float64, 4)
+
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox %q should be minLon,minLat,maxLon,maxLat", value)
+		}
+
+		bbox[i] = number
+	}
+
+	if bbox[0] < -180 || bbox[2] > 180 || bbox[1] < -90 || bbox[3] > 90 ||
+		bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return nil, fmt.Errorf("bbox %q is out of range", value)
+	}
+
+	return bbox, nil
+}
+
+// exportFilter parses the user, device, bbox and minAccuracy query parameters. A user
+// who isn't an admin only exports their own locations and their friends'.
+func (env *Env) exportFilter(r *http.Request) (pointsFilter, error) {
+	query := r.URL.Query()
+
+	filter, err := env.authorizeRead(r, pointsFilter{User: query.Get("user"), Device: query.Get("device")})
+	if err != nil {
+		return filter, err
+	}
+
+	if bbox := query.Get("bbox"); bbox != "" {
+		filter.BBox, err = parseBBox(bbox)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	filter.MaxAccuracy, err = exportAccuracy(query)
+	if err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// exportAccuracy parses the minAccuracy query parameter, the largest accuracy radius
+// to export, or its alias maxAccuracy. It returns 0 if neither is set.
+func exportAccuracy(query url.Values) (float64, error) {
+	name, value := "minAccuracy", query.Get("minAccuracy")
+
+	if alias := query.Get("maxAccuracy"); alias != "" {
+		if value != "" {
+			return 0, errors.New("minAccuracy and maxAccuracy are the same filter, give only one")
+		}
+
+		name, value = "maxAccuracy", alias
+	}
+
+	if value == "" {
+		return 0, nil
+	}
+
+	accuracy, err := strconv.ParseFloat(value, 64)
+	if err != nil || accuracy <= 0 || math.IsInf(accuracy, 0) {
+		return 0, fmt.Errorf("%s %q should be a positive number of metres", name, value)
+	}
+
+	return accuracy, nil
+}
+
+// exportGap parses the gap query parameter, the time between points that splits a
+// track into segments.
+func exportGap(r *http.Request) (time.Duration, error) {
+	gap := r.URL.Query().Get("gap")
+	if gap == "" {
+		return defaultSegmentGap, nil
+	}
+
+	segmentGap, err := time.ParseDuration(gap)
+	if err != nil || segmentGap <= 0 {
+		return 0, fmt.Errorf("invalid gap %q", gap)
+	}
+
+	return segmentGap, nil
+}
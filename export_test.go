@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPointsFilterSQL(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	conditions, args := pointsFilter{}.sql([]any{from, to})
+	assert.Empty(t, conditions)
+	assert.Equal(t, []any{from, to}, args)
+
+	conditions, args = pointsFilter{
+		User:        "alice",
+		Device:      "iphone",
+		BBox:        []float64{-0.5, 51.3, 0.3, 51.7},
+		MaxAccuracy: 50,
+	}.sql([]any{from, to})
+	assert.Equal(t, `AND "user" = $3
+AND device = $4
+AND ST_Intersects(point, ST_MakeEnvelope($5, $6, $7, $8, 4326)::geography)
+AND accuracy <= $9
+`, conditions)
+	assert.Equal(t, []any{from, to, "alice", "iphone", -0.5, 51.3, 0.3, 51.7, float64(50)}, args)
+}
+
+func TestExportFilter(t *testing.T) {
+	filter, err := (&Env{}).exportFilter(httptest.NewRequest("GET",
+		"/export?user=alice&device=iphone&bbox=-0.5,51.3,0.3,51.7&minAccuracy=25", nil))
+	require.NoError(t, err)
+	assert.Equal(t, pointsFilter{
+		User:        "alice",
+		Device:      "iphone",
+		BBox:        []float64{-0.5, 51.3, 0.3, 51.7},
+		MaxAccuracy: 25,
+	}, filter)
+
+	for _, query := range []string{
+		"bbox=1,2,3",
+		"bbox=a,2,3,4",
+		"bbox=3,2,1,4",
+		"bbox=-190,0,0,10",
+		"minAccuracy=-1",
+		"minAccuracy=lots",
+		"maxAccuracy=0",
+		"minAccuracy=25&maxAccuracy=25",
+	} {
+		_, err := (&Env{}).exportFilter(httptest.NewRequest("GET", "/export?"+query, nil))
+		assert.Error(t, err, query)
+	}
+}
+
+func TestExportFilterAcceptsMaxAccuracyAlias(t *testing.T) {
+	filter, err := (&Env{}).exportFilter(httptest.NewRequest("GET", "/export?maxAccuracy=30", nil))
+	require.NoError(t, err)
+	assert.InDelta(t, 30, filter.MaxAccuracy, 0)
+}
+
+func TestRenderDeviceRecordAsGeoJSONIncludesOwnerAndGeocoding(t *testing.T) {
+	feature := renderDeviceRecordAsGeoJSON(testDeviceRecord("alice", "iphone", 0, `{"display_name": "Home"}`))
+
+	assert.Equal(t, "alice", feature.Properties["user"])
+	assert.Equal(t, "iphone", feature.Properties["device"])
+
+	featureJSON, err := feature.MarshalJSON()
+	require.NoError(t, err)
+
+	var decoded struct {
+		Properties struct {
+			Geocoding struct {
+				DisplayName string `json:"display_name"`
+			} `json:"geocoding"`
+		} `json:"properties"`
+	}
+
+	require.NoError(t, json.Unmarshal(featureJSON, &decoded))
+	assert.Equal(t, "Home", decoded.Properties.Geocoding.DisplayName)
+}
+
+func TestParseGeoJSONFields(t *testing.T) {
+	fields, err := parseGeoJSONFields("", geoJSONProperties)
+	require.NoError(t, err)
+	assert.Nil(t, fields)
+
+	fields, err = parseGeoJSONFields("timestamp, user,geocoding", geoJSONProperties)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"timestamp": true, "user": true, "geocoding": true}, fields)
+
+	_, err = parseGeoJSONFields("timestamp,password", geoJSONProperties)
+	assert.Error(t, err)
+}
+
+func TestPointsFilterQueryKeepsLast(t *testing.T) {
+	query, args := pointsFilter{User: "alice"}.query("SELECT * FROM locations\nWHERE true\n", "devicetimestamp", nil)
+	assert.Equal(t, "SELECT * FROM locations\nWHERE true\nAND \"user\" = $1\nORDER BY devicetimestamp", query)
+	assert.Equal(t, []any{"alice"}, args)
+
+	query, args = pointsFilter{User: "alice", Last: 5}.query("SELECT * FROM locations\nWHERE true\n",
+		"devicetimestamp", nil)
+	assert.Equal(t, `SELECT * FROM (
+SELECT * FROM locations
+WHERE true
+AND "user" = $1
+ORDER BY devicetimestamp DESC LIMIT $2
+) AS last
+ORDER BY devicetimestamp`, query)
+	assert.Equal(t, []any{"alice", 5}, args)
+}
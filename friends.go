@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	friendshipRequestMaxBytes = 4096
+	// visibilityCheckInterval is how often a WebSocket re-reads its user's friendships,
+	// so that ones that end or are removed stop applying.
+	visibilityCheckInterval = time.Minute
+)
+
+var errFriendshipNotFound = errors.New("friendship not found")
+
+// friendship lets Friend see User's latest locations, at Precision, and only between
+// StartsAt and EndsAt if they're set. It's one way: User only sees Friend if there's
+// also a friendship the other way around.
+type friendship struct {
+	ID        int64          `json:"id"`
+	User      string         `json:"user"`
+	Friend    string         `json:"friend"`
+	Precision PlacePrecision `json:"precision"`
+	StartsAt  *time.Time     `json:"startsAt,omitempty"`
+	EndsAt    *time.Time     `json:"endsAt,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// friendshipRequest is the body of a request to create or change a friendship.
+type friendshipRequest struct {
+	User      string     `json:"user"`
+	Friend    string     `json:"friend"`
+	Precision string     `json:"precision"`
+	StartsAt  *time.Time `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt"`
+}
+
+// parseFriendshipRequest reads and validates a request to create or change a
+// friendship. The precision defaults to address.
+func parseFriendshipRequest(r *http.Request) (friendship, error) {
+	var request friendshipRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return friendship{}, fmt.Errorf("invalid friendship request: %w", err)
+	}
+
+	result := friendship{
+		User:      request.User,
+		Friend:    request.Friend,
+		Precision: PlacePrecisionAddress,
+		StartsAt:  request.StartsAt,
+		EndsAt:    request.EndsAt,
+	}
+
+	switch {
+	case result.User == "" || result.Friend == "":
+		return result, errors.New("user and friend are required")
+	case result.User == result.Friend:
+		return result, errors.New("user and friend should be different users")
+	case result.StartsAt != nil && result.EndsAt != nil && !result.EndsAt.After(*result.StartsAt):
+		return result, errors.New("endsAt should be after startsAt")
+	}
+
+	if request.Precision != "" {
+		err = result.Precision.Decode(request.Precision)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+const friendshipColumns = `id, "user", friend, place_precision, starts_at, ends_at, created_at`
+
+func scanFriendship(row interface{ Scan(dest ...any) error }) (friendship, error) {
+	var (
+		result   friendship
+		startsAt sql.NullTime
+		endsAt   sql.NullTime
+	)
+
+	err := row.Scan(
+		&result.ID,
+		&result.User,
+		&result.Friend,
+		&result.Precision,
+		&startsAt,
+		&endsAt,
+		&result.CreatedAt,
+	)
+
+	if startsAt.Valid {
+		result.StartsAt = &startsAt.Time
+	}
+
+	if endsAt.Valid {
+		result.EndsAt = &endsAt.Time
+	}
+
+	return result, err
+}
+
+// saveFriendship stores a friendship, replacing any existing one between the same
+// users.
+func (env *Env) saveFriendship(ctx context.Context, newFriendship friendship) (friendship, error) {
+	result, err := scanFriendship(env.database.QueryRowContext(ctx, `insert into friendships
+    ("user", friend, place_precision, starts_at, ends_at)
+values ($1, $2, $3, $4, $5)
+on conflict ("user", friend) do update set place_precision = excluded.place_precision,
+                                           starts_at       = excluded.starts_at,
+                                           ends_at         = excluded.ends_at
+returning `+friendshipColumns,
+		newFriendship.User,
+		newFriendship.Friend,
+		string(newFriendship.Precision),
+		newFriendship.StartsAt,
+		newFriendship.EndsAt,
+	))
+	if err != nil {
+		return result, fmt.Errorf("saving friendship: %w", err)
+	}
+
+	return result, nil
+}
+
+// listFriendships returns the friendships of user and friend, where an empty string
+// matches anyone, including those that have ended or not yet started.
+func (env *Env) listFriendships(ctx context.Context, user string, friend string) ([]friendship, error) {
+	rows, err := env.database.QueryContext(ctx, `select `+friendshipColumns+`
+from friendships
+where ($1 = '' or "user" = $1)
+  and ($2 = '' or friend = $2)
+order by "user", friend`, user, friend)
+	if err != nil {
+		return nil, fmt.Errorf("listing friendships: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	friendships := []friendship{}
+
+	for rows.Next() {
+		result, err := scanFriendship(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning friendship: %w", err)
+		}
+
+		friendships = append(friendships, result)
+	}
+
+	return friendships, rows.Err()
+}
+
+// deleteFriendship removes a friendship, returning whether there was one.
+func (env *Env) deleteFriendship(ctx context.Context, id int64) (bool, error) {
+	result, err := env.database.ExecContext(ctx, `delete from friendships where id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("deleting friendship: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return deleted > 0, err
+}
+
+// friendGrant is what a friendship that applies now lets the friend see: locations
+// recorded between StartsAt and EndsAt, if they're set, at Precision.
+type friendGrant struct {
+	Precision PlacePrecision
+	StartsAt  *time.Time
+	EndsAt    *time.Time
+}
+
+// covers returns whether a location recorded at timestamp is within the grant.
+func (grant friendGrant) covers(timestamp time.Time) bool {
+	return (grant.StartsAt == nil || !timestamp.Before(*grant.StartsAt)) &&
+		(grant.EndsAt == nil || timestamp.Before(*grant.EndsAt))
+}
+
+// visibility is whose latest locations a user can see: their own, and those of the
+// users who've made them a friend, each at the precision of that friendship.
+type visibility struct {
+	User    string
+	friends map[string]friendGrant
+}
+
+// userVisibility returns whose locations user can see now.
+func (env *Env) userVisibility(ctx context.Context, user string) (*visibility, error) {
+	result := &visibility{User: user, friends: map[string]friendGrant{}}
+
+	// Without a database there are no friendships, nor any locations to see
+	if env.database == nil {
+		return result, nil
+	}
+
+	rows, err := env.database.QueryContext(ctx, `select "user", place_precision, starts_at, ends_at
+from friendships
+where friend = $1
+  and (starts_at is null or starts_at <= now())
+  and (ends_at is null or ends_at > now())`, user)
+	if err != nil {
+		return nil, fmt.Errorf("looking up friendships: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var (
+			friend   string
+			grant    friendGrant
+			startsAt sql.NullTime
+			endsAt   sql.NullTime
+		)
+
+		err = rows.Scan(&friend, &grant.Precision, &startsAt, &endsAt)
+		if err != nil {
+			return nil, fmt.Errorf("scanning friendship: %w", err)
+		}
+
+		if startsAt.Valid {
+			grant.StartsAt = &startsAt.Time
+		}
+
+		if endsAt.Valid {
+			grant.EndsAt = &endsAt.Time
+		}
+
+		result.friends[friend] = grant
+	}
+
+	return result, rows.Err()
+}
+
+// requestVisibility returns whose locations a request can see, or nil if it can see
+// everyone's because it's from an admin or authentication is disabled.
+func (env *Env) requestVisibility(r *http.Request) (*visibility, error) {
+	user := restrictedUser(r)
+	if user == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	return env.userVisibility(r.Context(), user)
+}
+
+// sees returns whether user's locations are visible.
+func (access *visibility) sees(user string) bool {
+	if access == nil || user == access.User {
+		return true
+	}
+
+	_, ok := access.friends[user]
+
+	return ok
+}
+
+// seesLocation returns whether a location is visible: its user is, and if they're a
+// friend, it was recorded within the friendship's window.
+func (access *visibility) seesLocation(location Location) bool {
+	if access == nil || location.Username == access.User {
+		return true
+	}
+
+	grant, ok := access.friends[location.Username]
+
+	return ok && grant.covers(time.Unix(location.Timestamp, 0))
+}
+
+// owns returns whether user is access's own user, who sees their locations as stored.
+// Admins and requests without authentication don't own any.
+func (access *visibility) owns(user string) bool {
+	return access != nil && user == access.User
+}
+
+// owner returns access's own user, or an empty string if it owns no locations.
+func (access *visibility) owner() string {
+	if access == nil {
+		return ""
+	}
+
+	return access.User
+}
+
+// users returns every user whose locations are visible, in order.
+func (access *visibility) users() []string {
+	users := []string{access.User}
+	for friend := range access.friends {
+		users = append(users, friend)
+	}
+
+	slices.Sort(users)
+
+	return users
+}
+
+// restrictUsers checks that every one of users is visible. An empty list, meaning
+// everyone, stays empty, so callers must still check what they send with sees.
+func (access *visibility) restrictUsers(users []string) ([]string, error) {
+	for _, user := range users {
+		if !access.sees(user) {
+			return nil, errForbidden
+		}
+	}
+
+	return users, nil
+}
+
+// restrictFilter restricts a filter of stored locations to a user access can see, or to
+// access's own user if it doesn't name one. A friend's locations are read with their
+// privacy zones applied, reduced to the friendship's precision, and only from within the
+// friendship's window, so that a friend can't read history from before it started.
+func (access *visibility) restrictFilter(filter pointsFilter) (pointsFilter, error) {
+	switch {
+	case access == nil:
+		return filter, nil
+	case filter.User == "":
+		filter.User = access.User
+	case !access.sees(filter.User):
+		return filter, errForbidden
+	}
+
+	if grant, ok := access.friends[filter.User]; ok {
+		filter.Raw = false
+		filter.Precision = grant.Precision
+		filter.Since = grant.StartsAt
+		filter.Until = grant.EndsAt
+	}
+
+	return filter, nil
+}
+
+// reduce rounds a friend's location to the precision of their friendship, and names
+// its place at that precision rather than giving the full geocoding. A user's own
+// locations aren't changed.
+func (access *visibility) reduce(ctx context.Context, location Location) Location {
+	if access == nil {
+		return location
+	}
+
+	grant, ok := access.friends[location.Username]
+	if !ok {
+		return location
+	}
+
+	precision := grant.Precision
+
+	decimals := precision.CoordinateDecimals()
+	location.Latitude = roundCoordinate(location.Latitude, decimals)
+	location.Longitude = roundCoordinate(location.Longitude, decimals)
+	// The position is now only known to within half of the rounding
+	location.Accuracy = max(location.Accuracy, float32(math.Pow(10, -float64(decimals))*metresPerDegree/2))
+
+	if location.Geocoding != "" {
+		location.Geocoding = location.GeocodedName(ctx, precision)
+	}
+
+	return location
+}
+
+// visibleLocation prepares a location being pushed live to someone with access. It
+// returns false if they can't see it. Only the user themselves sees inside their
+// privacy zones, and friends see the rest at the friendship's precision.
+func (env *Env) visibleLocation(ctx context.Context, access *visibility, location Location) (Location, bool) {
+	if !access.seesLocation(location) {
+		return location, false
+	}
+
+	if !access.owns(location.Username) {
+		var ok bool
+
+		location, ok = env.redactLiveLocation(ctx, location)
+		if !ok {
+			return location, false
+		}
+	}
+
+	return access.reduce(ctx, location), true
+}
+
+// visibleLastLocations is GetLastLocations for the users that access can see, with
+// privacy zones applied to everyone's locations but access's own user's, and friends'
+// then reduced. A friend's latest location from outside the friendship's window is left
+// out. An empty user means every visible user.
+func (env *Env) visibleLastLocations(
+	ctx context.Context,
+	access *visibility,
+	user string,
+	device string,
+) ([]Location, error) {
+	if access == nil {
+		return env.GetRedactedLastLocations(ctx, user, device)
+	}
+
+	users := access.users()
+
+	if user != "" {
+		if !access.sees(user) {
+			return nil, errForbidden
+		}
+
+		users = []string{user}
+	}
+
+	var locations []Location
+
+	for _, visible := range users {
+		getLastLocations := env.GetRedactedLastLocations
+		if access.owns(visible) {
+			getLastLocations = env.GetLastLocations
+		}
+
+		userLocations, err := getLastLocations(ctx, visible, device)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, location := range userLocations {
+			if access.seesLocation(location) {
+				locations = append(locations, access.reduce(ctx, location))
+			}
+		}
+	}
+
+	return locations, nil
+}
+
+// ListFriendshipsHandler lists the friendships of the user and friend query
+// parameters, or everyone's.
+func (env *Env) ListFriendshipsHandler(w http.ResponseWriter, r *http.Request) {
+	friendships, err := env.listFriendships(r.Context(), r.URL.Query().Get("user"), r.URL.Query().Get("friend"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, friendships)
+}
+
+// SaveFriendshipHandler creates a friendship from the JSON body, or replaces the
+// existing one between the same users.
+func (env *Env) SaveFriendshipHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, friendshipRequestMaxBytes)
+
+	newFriendship, err := parseFriendshipRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	newFriendship, err = env.saveFriendship(ctx, newFriendship)
+	if err != nil {
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.With("user", newFriendship.User).With("friend", newFriendship.Friend).
+		With("precision", newFriendship.Precision).
+		InfoContext(ctx, "Saved friendship")
+
+	respondJSON(w, newFriendship)
+}
+
+// DeleteFriendshipHandler removes a friendship.
+func (env *Env) DeleteFriendshipHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid friendship id", http.StatusBadRequest)
+
+		return
+	}
+
+	deleted, err := env.deleteFriendship(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if !deleted {
+		http.Error(w, errFriendshipNotFound.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
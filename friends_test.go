@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFriendshipRequest(t *testing.T) {
+	parse := func(body string) (friendship, error) {
+		return parseFriendshipRequest(httptest.NewRequest(http.MethodPost, "/api/0/friendships", strings.NewReader(body)))
+	}
+
+	result, err := parse(`{"user": "alice", "friend": "bob"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", result.User)
+	assert.Equal(t, "bob", result.Friend)
+	assert.Equal(t, PlacePrecisionAddress, result.Precision)
+	assert.Nil(t, result.StartsAt)
+
+	result, err = parse(`{"user": "alice", "friend": "bob", "precision": "city",
+		"startsAt": "2024-06-01T09:00:00Z", "endsAt": "2024-06-01T17:00:00Z"}`)
+	require.NoError(t, err)
+	assert.Equal(t, PlacePrecisionCity, result.Precision)
+	require.NotNil(t, result.EndsAt)
+	assert.Equal(t, 17, result.EndsAt.Hour())
+
+	for _, body := range []string{
+		`{"user": "alice"}`,
+		`{"user": "alice", "friend": "alice"}`,
+		`{"user": "alice", "friend": "bob", "precision": "street"}`,
+		`{"user": "alice", "friend": "bob", "startsAt": "2024-06-01T17:00:00Z", "endsAt": "2024-06-01T09:00:00Z"}`,
+	} {
+		_, err = parse(body)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	var everyone *visibility
+
+	assert.True(t, everyone.sees("anyone"))
+
+	users, err := everyone.restrictUsers([]string{"alice", "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, users)
+
+	access := &visibility{User: "carol", friends: map[string]friendGrant{"bob": {Precision: PlacePrecisionCity}}}
+	assert.True(t, access.sees("carol"))
+	assert.True(t, access.sees("bob"))
+	assert.False(t, access.sees("alice"))
+	assert.Equal(t, []string{"bob", "carol"}, access.users())
+
+	users, err = access.restrictUsers(nil)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	_, err = access.restrictUsers([]string{"bob", "alice"})
+	require.ErrorIs(t, err, errForbidden)
+
+	_, err = (&Env{}).visibleLastLocations(t.Context(), access, "alice", "")
+	require.ErrorIs(t, err, errForbidden)
+}
+
+func TestVisibilityRestrictsFilters(t *testing.T) {
+	var everyone *visibility
+
+	filter, err := everyone.restrictFilter(pointsFilter{Raw: true})
+	require.NoError(t, err)
+	assert.Equal(t, pointsFilter{Raw: true}, filter)
+
+	access := &visibility{User: "carol", friends: map[string]friendGrant{"bob": {Precision: PlacePrecisionCity}}}
+
+	filter, err = access.restrictFilter(pointsFilter{Device: "iphone", Raw: true})
+	require.NoError(t, err)
+	assert.Equal(t, pointsFilter{User: "carol", Device: "iphone", Raw: true}, filter)
+
+	filter, err = access.restrictFilter(pointsFilter{User: "bob", Raw: true})
+	require.NoError(t, err)
+	assert.Equal(t, pointsFilter{User: "bob", Precision: PlacePrecisionCity}, filter)
+	assert.Contains(t, filter.table(), "ST_SnapToGrid(point::geometry, 0.01)")
+	assert.Contains(t, filter.table(), "FROM redacted_locations) AS redacted_locations")
+
+	_, err = access.restrictFilter(pointsFilter{User: "alice"})
+	require.ErrorIs(t, err, errForbidden)
+}
+
+func TestFriendCannotReadOutsideTheFriendship(t *testing.T) {
+	startsAt := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	endsAt := startsAt.Add(8 * time.Hour)
+	access := &visibility{User: "carol", friends: map[string]friendGrant{
+		"bob": {Precision: PlacePrecisionCity, StartsAt: &startsAt, EndsAt: &endsAt},
+	}}
+
+	filter, err := access.restrictFilter(pointsFilter{User: "bob", Raw: true})
+	require.NoError(t, err)
+
+	conditions, args := filter.sql([]any{time.Time{}, time.Now()})
+	assert.Equal(t, `AND "user" = $3
+AND devicetimestamp >= $4
+AND devicetimestamp < $5
+`, conditions)
+	assert.Equal(t, []any{"bob", startsAt, endsAt}, args[2:])
+
+	// Carol's own history isn't limited
+	filter, err = access.restrictFilter(pointsFilter{Raw: true})
+	require.NoError(t, err)
+	assert.Nil(t, filter.Since)
+	assert.Nil(t, filter.Until)
+
+	before := Location{Username: "bob", Timestamp: startsAt.Add(-time.Minute).Unix()}
+	during := Location{Username: "bob", Timestamp: startsAt.Add(time.Hour).Unix()}
+	after := Location{Username: "bob", Timestamp: endsAt.Unix()}
+
+	assert.False(t, access.seesLocation(before))
+	assert.True(t, access.seesLocation(during))
+	assert.False(t, access.seesLocation(after))
+	assert.True(t, access.seesLocation(Location{Username: "carol"}))
+
+	_, ok := (&Env{}).visibleLocation(t.Context(), access, before)
+	assert.False(t, ok)
+}
+
+func TestVisibilityOwnsOnlyItsUser(t *testing.T) {
+	var everyone *visibility
+
+	assert.False(t, everyone.owns("alice"))
+	assert.Empty(t, everyone.owner())
+
+	access := &visibility{User: "carol", friends: map[string]friendGrant{"bob": {Precision: PlacePrecisionCity}}}
+	assert.True(t, access.owns("carol"))
+	assert.False(t, access.owns("bob"))
+	assert.Equal(t, "carol", access.owner())
+}
+
+func TestVisibleEventsLeaveOutFriendsTransitions(t *testing.T) {
+	env := &Env{}
+	access := &visibility{User: "carol", friends: map[string]friendGrant{"bob": {Precision: PlacePrecisionCity}}}
+
+	_, ok := env.visibleEvent(t.Context(), access, liveEvent{Type: "transition", User: "carol"})
+	assert.True(t, ok)
+
+	_, ok = env.visibleEvent(t.Context(), access, liveEvent{Type: "transition", User: "bob"})
+	assert.False(t, ok)
+
+	_, ok = env.visibleEvent(t.Context(), nil, liveEvent{Type: "transition", User: "bob"})
+	assert.True(t, ok)
+
+	_, ok = env.visibleEvent(t.Context(), access, liveEvent{
+		Type:     locationType,
+		User:     "alice",
+		Location: Location{Username: "alice"},
+	})
+	assert.False(t, ok)
+}
+
+func TestVisibilityReducesFriendsLocations(t *testing.T) {
+	access := &visibility{User: "carol", friends: map[string]friendGrant{"bob": {Precision: PlacePrecisionCity}}}
+	location := Location{
+		Username:  "bob",
+		Latitude:  51.50551,
+		Longitude: -0.07539,
+		Accuracy:  5,
+		Geocoding: `{"address": {"road": "Tower Bridge Road", "city": "London"}}`,
+	}
+
+	reduced := access.reduce(t.Context(), location)
+	assert.InDelta(t, 51.51, reduced.Latitude, 1e-9)
+	assert.InDelta(t, -0.08, reduced.Longitude, 1e-9)
+	assert.Equal(t, "London", reduced.Geocoding)
+	assert.Greater(t, reduced.Accuracy, float32(500))
+
+	location.Username = "carol"
+	assert.Equal(t, location, access.reduce(t.Context(), location))
+}
+
+func TestFriendshipRoutesAreAdminOnly(t *testing.T) {
+	configuration := &Configuration{AuthTokens: "alice:a-token"}
+	env := Env{configuration: configuration}
+	env.auth = testAuthenticator(t, configuration)
+	router := env.BuildRoutes(configuration)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		r := httptest.NewRequest(method, "/api/0/friendships", nil)
+		r.Header.Set("Authorization", "Bearer a-token")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, r)
+		assert.Equal(t, http.StatusForbidden, recorder.Code, method)
+	}
+
+	// Without friendships, other users' devices aren't listed
+	r := httptest.NewRequest(http.MethodGet, "/api/0/list?user=bob", nil)
+	r.Header.Set("Authorization", "Bearer a-token")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, r)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
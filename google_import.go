@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// googleE7 is the scale of Records.json's integer coordinates
+	googleE7 = 1e7
+
+	// googleE7Overflow is subtracted from Records.json coordinates that were written
+	// as unsigned 32 bit integers by some versions of Takeout
+	googleE7Overflow = 1 << 32
+
+	// metersPerSecondToKMH converts Google's speeds to the km/h used by OwnTracks
+	metersPerSecondToKMH = 3.6
+)
+
+var errInvalidGoogleLatLng = errors.New("invalid Google latLng")
+
+// googleImportOptions are the command line options of the import-google subcommand.
+type googleImportOptions struct {
+	User   string
+	Device string
+}
+
+// googleActivity is a Records.json activity classification: how confident, out of
+// 100, Google was of each type of activity at a time.
+type googleActivity struct {
+	Activity []struct {
+		Type       string `json:"type"`
+		Confidence int    `json:"confidence"`
+	} `json:"activity"`
+}
+
+// googleMotionActivities maps Google's activity types to the motion activities that
+// OwnTracks reports on iOS.
+var googleMotionActivities = map[string]string{
+	"STILL":                   "stationary",
+	"ON_FOOT":                 "walking",
+	"WALKING":                 "walking",
+	"RUNNING":                 "running",
+	"ON_BICYCLE":              "cycling",
+	"IN_VEHICLE":              "automotive",
+	"IN_ROAD_VEHICLE":         "automotive",
+	"IN_RAIL_VEHICLE":         "automotive",
+	"IN_CAR":                  "automotive",
+	"IN_BUS":                  "automotive",
+	"IN_FOUR_WHEELER_VEHICLE": "automotive",
+	"IN_TWO_WHEELER_VEHICLE":  "automotive",
+	"EXITING_VEHICLE":         "automotive",
+}
+
+// googleRecord is a location in the legacy Records.json export.
+type googleRecord struct {
+	LatitudeE7       int64   `json:"latitudeE7"`
+	LongitudeE7      int64   `json:"longitudeE7"`
+	Accuracy         float32 `json:"accuracy"`
+	Altitude         float32 `json:"altitude"`
+	VerticalAccuracy float32 `json:"verticalAccuracy"`
+	Velocity         float32 `json:"velocity"`
+	Heading          int     `json:"heading"`
+	Timestamp        string  `json:"timestamp"`
+	TimestampMs      string  `json:"timestampMs"`
+	// Activity holds classifications made around the time of the location, the first
+	// being the closest
+	Activity []googleActivity `json:"activity"`
+}
+
+// motionActivities returns the most confident of the record's first activity
+// classification as an OwnTracks motion activity, or nil if there's none.
+func (record googleRecord) motionActivities() []string {
+	if len(record.Activity) == 0 {
+		return nil
+	}
+
+	best := ""
+	confidence := -1
+
+	for _, activity := range record.Activity[0].Activity {
+		if activity.Confidence > confidence {
+			best = activity.Type
+			confidence = activity.Confidence
+		}
+	}
+
+	if best == "" {
+		return nil
+	}
+
+	motion, ok := googleMotionActivities[best]
+	if !ok {
+		motion = "unknown"
+	}
+
+	return []string{motion}
+}
+
+func googleE7Degrees(value int64, limit float64) float64 {
+	degrees := float64(value) / googleE7
+	if degrees > limit {
+		degrees = float64(value-googleE7Overflow) / googleE7
+	}
+
+	return degrees
+}
+
+func (record googleRecord) MQTTMsg() (MQTTMsg, error) {
+	var timestamp time.Time
+
+	switch {
+	case record.Timestamp != "":
+		var err error
+
+		timestamp, err = time.Parse(time.RFC3339, record.Timestamp)
+		if err != nil {
+			return MQTTMsg{}, fmt.Errorf("parsing timestamp: %w", err)
+		}
+	case record.TimestampMs != "":
+		milliseconds, err := strconv.ParseInt(record.TimestampMs, 10, 64)
+		if err != nil {
+			return MQTTMsg{}, fmt.Errorf("parsing timestampMs: %w", err)
+		}
+
+		timestamp = time.UnixMilli(milliseconds)
+	default:
+		return MQTTMsg{}, errors.New("record has no timestamp")
+	}
+
+	return MQTTMsg{
+		Type:                 locationType,
+		Latitude:             googleE7Degrees(record.LatitudeE7, 90),
+		Longitude:            googleE7Degrees(record.LongitudeE7, 180),
+		Accuracy:             record.Accuracy,
+		Altitude:             record.Altitude,
+		VerticalAccuracy:     record.VerticalAccuracy,
+		Speed:                record.Velocity * metersPerSecondToKMH,
+		Course:               record.Heading,
+		MotionActivities:     record.motionActivities(),
+		DeviceTimestampAsInt: timestamp.Unix(),
+		DeviceTimestamp:      timestamp,
+	}, nil
+}
+
+// googleLatLng is a coordinate pair in a Timeline export, either "51.5°, -0.12°"
+// (Android) or "geo:51.5,-0.12" (iOS).
+type googleLatLng string
+
+func (latLng googleLatLng) Parse() (float64, float64, error) {
+	value := strings.TrimPrefix(string(latLng), "geo:")
+	value = strings.ReplaceAll(value, "°", "")
+
+	latitude, longitude, found := strings.Cut(value, ",")
+	if !found {
+		return 0, 0, fmt.Errorf("%w: %q", errInvalidGoogleLatLng, string(latLng))
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latitude), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", errInvalidGoogleLatLng, string(latLng))
+	}
+
+	lon, err := strconv.ParseFloat(strings.TrimSpace(longitude), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", errInvalidGoogleLatLng, string(latLng))
+	}
+
+	return lat, lon, nil
+}
+
+// googlePlace is a location in a Timeline export, which is a latLng string on iOS
+// and an object with a latLng field on Android.
+type googlePlace struct {
+	LatLng googleLatLng `json:"latLng"`
+}
+
+func (place *googlePlace) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &place.LatLng)
+	}
+
+	type plain googlePlace
+
+	return json.Unmarshal(data, (*plain)(place))
+}
+
+// googleTimelinePoint is a point on a semantic segment's path. iOS exports give its
+// time as an offset from the start of the segment.
+type googleTimelinePoint struct {
+	Point                              googleLatLng `json:"point"`
+	Time                               time.Time    `json:"time"`
+	DurationMinutesOffsetFromStartTime string       `json:"durationMinutesOffsetFromStartTime"`
+}
+
+// googleSemanticSegment is an entry of Timeline.json's semanticSegments: a path
+// travelled, a visit to a place, or an activity between two places.
+type googleSemanticSegment struct {
+	StartTime    time.Time             `json:"startTime"`
+	EndTime      time.Time             `json:"endTime"`
+	TimelinePath []googleTimelinePoint `json:"timelinePath"`
+	Visit        *struct {
+		TopCandidate struct {
+			PlaceLocation googlePlace `json:"placeLocation"`
+		} `json:"topCandidate"`
+	} `json:"visit"`
+	Activity *struct {
+		Start googlePlace `json:"start"`
+		End   googlePlace `json:"end"`
+	} `json:"activity"`
+}
+
+type googleTimedLatLng struct {
+	LatLng googleLatLng
+	Time   time.Time
+}
+
+// points returns the located, timed points in the segment.
+func (segment googleSemanticSegment) points() []googleTimedLatLng {
+	var points []googleTimedLatLng
+
+	for _, point := range segment.TimelinePath {
+		pointTime := point.Time
+
+		if pointTime.IsZero() && point.DurationMinutesOffsetFromStartTime != "" {
+			minutes, err := strconv.Atoi(point.DurationMinutesOffsetFromStartTime)
+			if err == nil {
+				pointTime = segment.StartTime.Add(time.Duration(minutes) * time.Minute)
+			}
+		}
+
+		points = append(points, googleTimedLatLng{LatLng: point.Point, Time: pointTime})
+	}
+
+	if segment.Visit != nil {
+		location := segment.Visit.TopCandidate.PlaceLocation.LatLng
+		points = append(points,
+			googleTimedLatLng{LatLng: location, Time: segment.StartTime},
+			googleTimedLatLng{LatLng: location, Time: segment.EndTime},
+		)
+	}
+
+	if segment.Activity != nil {
+		points = append(points,
+			googleTimedLatLng{LatLng: segment.Activity.Start.LatLng, Time: segment.StartTime},
+			googleTimedLatLng{LatLng: segment.Activity.End.LatLng, Time: segment.EndTime},
+		)
+	}
+
+	return points
+}
+
+// googleRawSignal is an entry of Timeline.json's rawSignals. Only position signals
+// are imported.
+type googleRawSignal struct {
+	Position *struct {
+		LatLng               googleLatLng `json:"LatLng"` //nolint:tagliatelle
+		AccuracyMeters       float32      `json:"accuracyMeters"`
+		AltitudeMeters       float32      `json:"altitudeMeters"`
+		SpeedMetersPerSecond float32      `json:"speedMetersPerSecond"`
+		Timestamp            time.Time    `json:"timestamp"`
+	} `json:"position"`
+}
+
+func newGoogleMQTTMsg(latLng googleLatLng, timestamp time.Time) (MQTTMsg, error) {
+	if timestamp.IsZero() {
+		return MQTTMsg{}, errors.New("point has no time")
+	}
+
+	lat, lon, err := latLng.Parse()
+	if err != nil {
+		return MQTTMsg{}, err
+	}
+
+	return MQTTMsg{
+		Type:                 locationType,
+		Latitude:             lat,
+		Longitude:            lon,
+		DeviceTimestampAsInt: timestamp.Unix(),
+		DeviceTimestamp:      timestamp,
+	}, nil
+}
+
+// decodeJSONArray streams the elements of the JSON array at the decoder's position.
+func decodeJSONArray[T any](decoder *json.Decoder, handle func(element T) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected an array, found %v", token)
+	}
+
+	for decoder.More() {
+		var element T
+
+		err = decoder.Decode(&element)
+		if err != nil {
+			return err
+		}
+
+		err = handle(element)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = decoder.Token()
+
+	return err
+}
+
+// googleDecoder streams a Google location history export, which may be a legacy
+// Records.json, an Android Timeline.json or an iOS location-history.json.
+type googleDecoder struct {
+	ctx     context.Context //nolint:containedctx
+	emit    func(msg MQTTMsg) error
+	invalid int
+}
+
+func (decoder *googleDecoder) emitPoint(msg MQTTMsg, err error) error {
+	if err != nil {
+		decoder.invalid++
+
+		slog.With("err", err).DebugContext(decoder.ctx, "Skipping invalid Google location")
+
+		return nil
+	}
+
+	return decoder.emit(msg)
+}
+
+func (decoder *googleDecoder) emitSegment(segment googleSemanticSegment) error {
+	for _, point := range segment.points() {
+		err := decoder.emitPoint(newGoogleMQTTMsg(point.LatLng, point.Time))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (decoder *googleDecoder) emitRawSignal(signal googleRawSignal) error {
+	if signal.Position == nil {
+		return nil
+	}
+
+	msg, err := newGoogleMQTTMsg(signal.Position.LatLng, signal.Position.Timestamp)
+	msg.Accuracy = signal.Position.AccuracyMeters
+	msg.Altitude = signal.Position.AltitudeMeters
+	msg.Speed = signal.Position.SpeedMetersPerSecond * metersPerSecondToKMH
+
+	return decoder.emitPoint(msg, err)
+}
+
+func (decoder *googleDecoder) Decode(reader io.Reader) error {
+	jsonDecoder := json.NewDecoder(reader)
+
+	token, err := jsonDecoder.Token()
+	if err != nil {
+		return fmt.Errorf("reading Google export: %w", err)
+	}
+
+	switch token {
+	case json.Delim('['):
+		// iOS exports are a bare array of semantic segments
+		for jsonDecoder.More() {
+			var segment googleSemanticSegment
+
+			err = jsonDecoder.Decode(&segment)
+			if err != nil {
+				return fmt.Errorf("decoding segment: %w", err)
+			}
+
+			err = decoder.emitSegment(segment)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case json.Delim('{'):
+	default:
+		return fmt.Errorf("unrecognised Google export starting with %v", token)
+	}
+
+	for jsonDecoder.More() {
+		key, err := jsonDecoder.Token()
+		if err != nil {
+			return fmt.Errorf("reading Google export: %w", err)
+		}
+
+		switch key {
+		case "locations":
+			err = decodeJSONArray(jsonDecoder, func(record googleRecord) error {
+				return decoder.emitPoint(record.MQTTMsg())
+			})
+		case "semanticSegments":
+			err = decodeJSONArray(jsonDecoder, decoder.emitSegment)
+		case "rawSignals":
+			err = decodeJSONArray(jsonDecoder, decoder.emitRawSignal)
+		default:
+			var skipped json.RawMessage
+
+			err = jsonDecoder.Decode(&skipped)
+		}
+
+		if err != nil {
+			return fmt.Errorf("decoding %v: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// ImportGoogle imports a Google location history export, assigning every point to the
+// given user and device.
+func (env *Env) ImportGoogle(
+	ctx context.Context,
+	reader io.Reader,
+	options googleImportOptions,
+) (ImportStats, error) {
+	importer := env.newLocationImporter("google")
+
+	decoder := &googleDecoder{ctx: ctx, emit: func(msg MQTTMsg) error {
+		msg.User = options.User
+		msg.Device = options.Device
+
+		return importer.Add(ctx, msg)
+	}}
+
+	err := decoder.Decode(reader)
+	if err != nil {
+		return importer.stats, err
+	}
+
+	if decoder.invalid > 0 {
+		slog.With("points", decoder.invalid).WarnContext(ctx, "Skipped invalid Google locations")
+	}
+
+	stats, err := importer.Close(ctx)
+	stats.Invalid = decoder.invalid
+
+	return stats, err
+}
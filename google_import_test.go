@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeGoogleExport(t *testing.T, export string) ([]MQTTMsg, int) {
+	t.Helper()
+
+	var points []MQTTMsg
+
+	decoder := &googleDecoder{ctx: t.Context(), emit: func(msg MQTTMsg) error {
+		points = append(points, msg)
+
+		return nil
+	}}
+
+	require.NoError(t, decoder.Decode(strings.NewReader(export)))
+
+	return points, decoder.invalid
+}
+
+func TestDecodeGoogleRecords(t *testing.T) {
+	points, invalid := decodeGoogleExport(t, `{"locations": [
+  {"latitudeE7": 515074000, "longitudeE7": -1278000, "accuracy": 20, "velocity": 10, "heading": 90,
+   "altitude": 30, "verticalAccuracy": 5, "timestamp": "2024-01-01T00:00:00.000Z",
+   "activity": [{"activity": [{"type": "STILL", "confidence": 100}], "timestamp": "2024-01-01T00:00:00Z"}]},
+  {"latitudeE7": 4294067296, "longitudeE7": 10000000, "accuracy": 5, "timestampMs": "1704067260000"},
+  {"latitudeE7": 1, "longitudeE7": 1}
+]}`)
+
+	require.Len(t, points, 2)
+	assert.Equal(t, 1, invalid)
+
+	assert.InDelta(t, 51.5074, points[0].Latitude, 0.000001)
+	assert.InDelta(t, -0.1278, points[0].Longitude, 0.000001)
+	assert.InDelta(t, 36, points[0].Speed, 0.001)
+	assert.Equal(t, 90, points[0].Course)
+	assert.Equal(t, int64(1704067200), points[0].DeviceTimestampAsInt)
+	assert.Equal(t, []string{"stationary"}, points[0].MotionActivities)
+
+	assert.InDelta(t, -0.09, points[1].Latitude, 0.000001)
+	assert.Equal(t, int64(1704067260), points[1].DeviceTimestampAsInt)
+	assert.Nil(t, points[1].MotionActivities)
+}
+
+func TestGoogleRecordMotionActivities(t *testing.T) {
+	for activity, expected := range map[string][]string{
+		`[]`: nil,
+		`[{"activity": [{"type": "IN_VEHICLE", "confidence": 60}, {"type": "ON_FOOT", "confidence": 30}]},
+		  {"activity": [{"type": "RUNNING", "confidence": 100}]}]`: {"automotive"},
+		`[{"activity": [{"type": "STILL", "confidence": 20}, {"type": "ON_BICYCLE", "confidence": 70}]}]`: {"cycling"},
+		`[{"activity": [{"type": "TILTING", "confidence": 100}]}]`:                                        {"unknown"},
+	} {
+		var record googleRecord
+
+		require.NoError(t, json.Unmarshal([]byte(`{"activity": `+activity+`}`), &record))
+		assert.Equal(t, expected, record.motionActivities(), activity)
+	}
+}
+
+func TestDecodeGoogleTimeline(t *testing.T) {
+	points, invalid := decodeGoogleExport(t, `{
+  "semanticSegments": [
+    {"startTime": "2024-01-01T10:00:00.000+01:00", "endTime": "2024-01-01T11:00:00.000+01:00",
+     "timelinePath": [{"point": "51.5°, -0.12°", "time": "2024-01-01T10:05:00.000+01:00"}]},
+    {"startTime": "2024-01-01T11:00:00.000+01:00", "endTime": "2024-01-01T12:00:00.000+01:00",
+     "visit": {"topCandidate": {"placeLocation": {"latLng": "51.6°, -0.13°"}}}},
+    {"startTime": "2024-01-01T12:00:00.000+01:00", "endTime": "2024-01-01T12:30:00.000+01:00",
+     "activity": {"start": {"latLng": "51.6°, -0.13°"}, "end": {"latLng": "bogus"}}}
+  ],
+  "rawSignals": [
+    {"position": {"LatLng": "51.7°, -0.14°", "accuracyMeters": 12, "speedMetersPerSecond": 2,
+                  "timestamp": "2024-01-01T13:00:00.000+01:00"}},
+    {"wifiScan": {}}
+  ],
+  "userLocationProfile": {"frequentPlaces": []}
+}`)
+
+	require.Len(t, points, 5)
+	assert.Equal(t, 1, invalid)
+
+	assert.InDelta(t, 51.5, points[0].Latitude, 0.000001)
+	assert.Equal(t, time.Date(2024, 1, 1, 9, 5, 0, 0, time.UTC).Unix(), points[0].DeviceTimestampAsInt)
+	assert.InDelta(t, 51.6, points[1].Latitude, 0.000001)
+	assert.Equal(t, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC).Unix(), points[2].DeviceTimestampAsInt)
+	assert.InDelta(t, 12, points[4].Accuracy, 0.001)
+	assert.InDelta(t, 7.2, points[4].Speed, 0.001)
+}
+
+func TestDecodeGoogleIOSTimeline(t *testing.T) {
+	points, invalid := decodeGoogleExport(t, `[
+  {"startTime": "2024-01-01T10:00:00.000+00:00", "endTime": "2024-01-01T11:00:00.000+00:00",
+   "timelinePath": [{"point": "geo:51.5,-0.12", "durationMinutesOffsetFromStartTime": "15"}]},
+  {"startTime": "2024-01-01T11:00:00.000+00:00", "endTime": "2024-01-01T12:00:00.000+00:00",
+   "visit": {"topCandidate": {"placeLocation": "geo:51.6,-0.13"}}}
+]`)
+
+	require.Len(t, points, 3)
+	assert.Zero(t, invalid)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC).Unix(), points[0].DeviceTimestampAsInt)
+	assert.InDelta(t, -0.13, points[2].Longitude, 0.000001)
+}
+
+func TestDecodeGoogleRejectsOtherJSON(t *testing.T) {
+	decoder := &googleDecoder{ctx: t.Context(), emit: func(MQTTMsg) error { return nil }}
+
+	require.Error(t, decoder.Decode(strings.NewReader(`"hello"`)))
+	require.Error(t, decoder.Decode(strings.NewReader(`{"locations": {}}`)))
+}
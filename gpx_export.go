@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	gpxNamespace       = "http://www.topografix.com/GPX/1/1"
+	gpxTPXNamespace    = "http://www.garmin.com/xmlschemas/TrackPointExtension/v2"
+	gpxSchemaLocations = "http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd " +
+		"http://www.garmin.com/xmlschemas/TrackPointExtension/v2 " +
+		"http://www.garmin.com/xmlschemas/TrackPointExtensionv2.xsd"
+)
+
+// gpxTrackPointExtension carries speed and course using Garmin's TrackPointExtension,
+// which is understood by most GPX consumers.
+type gpxTrackPointExtension struct {
+	Speed  *float64 `xml:"gpxtpx:speed,omitempty"`
+	Course *int     `xml:"gpxtpx:course,omitempty"`
+}
+
+type gpxExtensions struct {
+	TrackPointExtension gpxTrackPointExtension `xml:"gpxtpx:TrackPointExtension"`
+}
+
+type gpxTrackPoint struct {
+	XMLName    xml.Name       `xml:"trkpt"`
+	Latitude   float64        `xml:"lat,attr"`
+	Longitude  float64        `xml:"lon,attr"`
+	Elevation  *float32       `xml:"ele,omitempty"`
+	Time       string         `xml:"time"`
+	Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+func newGPXTrackPoint(point trackPoint) gpxTrackPoint {
+	trackPoint := gpxTrackPoint{
+		Latitude:  point.Latitude,
+		Longitude: point.Longitude,
+		Elevation: point.Altitude,
+		Time:      point.DeviceTimestamp.UTC().Format(time.RFC3339),
+	}
+
+	if point.Speed != nil || point.Course != nil {
+		extension := gpxTrackPointExtension{Course: point.Course}
+
+		if point.Speed != nil {
+			// OwnTracks speeds are km/h; GPX uses m/s
+			speed := float64(*point.Speed) / metersPerSecondToKMH
+			extension.Speed = &speed
+		}
+
+		trackPoint.Extensions = &gpxExtensions{TrackPointExtension: extension}
+	}
+
+	return trackPoint
+}
+
+// gpxWriter streams track points, which must be ordered by user, device and time, as
+// a GPX 1.1 document with one trk per user and device.
+type gpxWriter struct {
+	encoder    *xml.Encoder
+	segmentGap time.Duration
+
+	track    string
+	lastTime time.Time
+}
+
+func newGPXWriter(w io.Writer, segmentGap time.Duration) *gpxWriter {
+	return &gpxWriter{encoder: xml.NewEncoder(w), segmentGap: segmentGap}
+}
+
+func (writer *gpxWriter) start(name string, attributes ...xml.Attr) error {
+	return writer.encoder.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}, Attr: attributes})
+}
+
+func (writer *gpxWriter) end(name string) error {
+	return writer.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+// Begin writes the XML declaration and opens the gpx element.
+func (writer *gpxWriter) Begin() error {
+	err := writer.encoder.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)})
+	if err != nil {
+		return err
+	}
+
+	return writer.start("gpx",
+		xml.Attr{Name: xml.Name{Local: "version"}, Value: "1.1"},
+		xml.Attr{Name: xml.Name{Local: "creator"}, Value: "owntracks-pg-recorder"},
+		xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: gpxNamespace},
+		xml.Attr{Name: xml.Name{Local: "xmlns:gpxtpx"}, Value: gpxTPXNamespace},
+		xml.Attr{Name: xml.Name{Local: "xmlns:xsi"}, Value: "http://www.w3.org/2001/XMLSchema-instance"},
+		xml.Attr{Name: xml.Name{Local: "xsi:schemaLocation"}, Value: gpxSchemaLocations},
+	)
+}
+
+// Write adds a point, opening a new trk when the user or device changes and a new
+// trkseg after a gap in time.
+func (writer *gpxWriter) Write(point trackPoint) error {
+	var err error
+
+	switch {
+	case point.TrackName() != writer.track:
+		if writer.track != "" {
+			err = writer.closeTrack()
+			if err != nil {
+				return err
+			}
+		}
+
+		writer.track = point.TrackName()
+
+		err = writer.openTrack()
+	case point.DeviceTimestamp.Sub(writer.lastTime) > writer.segmentGap:
+		err = writer.end("trkseg")
+		if err == nil {
+			err = writer.start("trkseg")
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	writer.lastTime = point.DeviceTimestamp
+
+	return writer.encoder.Encode(newGPXTrackPoint(point))
+}
+
+func (writer *gpxWriter) openTrack() error {
+	err := writer.start("trk")
+	if err != nil {
+		return err
+	}
+
+	err = writer.encoder.EncodeElement(writer.track, xml.StartElement{Name: xml.Name{Local: "name"}})
+	if err != nil {
+		return err
+	}
+
+	return writer.start("trkseg")
+}
+
+func (writer *gpxWriter) closeTrack() error {
+	err := writer.end("trkseg")
+	if err != nil {
+		return err
+	}
+
+	return writer.end("trk")
+}
+
+// Flush writes any buffered XML to the underlying writer.
+func (writer *gpxWriter) Flush() error {
+	return writer.encoder.Flush()
+}
+
+// Close closes any open track and the gpx element.
+func (writer *gpxWriter) Close() error {
+	if writer.track != "" {
+		err := writer.closeTrack()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writer.end("gpx")
+	if err != nil {
+		return err
+	}
+
+	return writer.encoder.Close()
+}
+
+// writeGPX writes the track points in rows as a GPX document.
+func writeGPX(
+	ctx context.Context,
+	rows *sql.Rows,
+	w io.Writer,
+	segmentGap time.Duration,
+	flush func(),
+) error {
+	writer := newGPXWriter(w, segmentGap)
+
+	err := writer.Begin()
+	if err != nil {
+		return err
+	}
+
+	for counter := 0; rows.Next(); counter++ {
+		point, err := scanTrackPoint(rows)
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error scanning row")
+
+			continue
+		}
+
+		err = writer.Write(point)
+		if err != nil {
+			return err
+		}
+
+		if counter%exportFlushEvery == 0 {
+			_ = writer.Flush()
+
+			flush()
+		}
+	}
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	return writer.Close()
+}
+
+// ExportGPX exports location data as a gzipped GPX 1.1 file, with a trk per user and
+// device. A new trkseg starts wherever consecutive points are more than the gap query
+// parameter apart.
+func (env *Env) ExportGPX(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	from, to, err := exportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	segmentGap, err := exportGap(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	filter, err := env.exportFilter(r)
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	rows, err := env.getTrackPoints(ctx, from, to, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	gzipWriter := writeExportHTTPHeader(w, "owntracks.gpx", "application/gpx+xml")
+
+	defer func() {
+		_ = gzipWriter.Close()
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}()
+
+	err = writeGPX(ctx, rows, gzipWriter, segmentGap, flushExport(w, gzipWriter))
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming GPX export")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTrackPoint(user, device string, offset time.Duration) trackPoint {
+	altitude := float32(42)
+	speed := float32(36)
+	course := 90
+
+	return trackPoint{
+		DeviceTimestamp: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Add(offset),
+		Latitude:        51.5074,
+		Longitude:       -0.1278,
+		Altitude:        &altitude,
+		Speed:           &speed,
+		Course:          &course,
+		User:            user,
+		Device:          device,
+	}
+}
+
+func TestGPXWriterSplitsTracksAndSegments(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := newGPXWriter(&buffer, 10*time.Minute)
+	require.NoError(t, writer.Begin())
+
+	for _, point := range []trackPoint{
+		testTrackPoint("alice", "iphone", 0),
+		testTrackPoint("alice", "iphone", time.Minute),
+		testTrackPoint("alice", "iphone", time.Hour),
+		testTrackPoint("alice", "ipad", 0),
+		{DeviceTimestamp: time.Unix(0, 0), Latitude: 1, Longitude: 2, User: "bob<", Device: "x"},
+	} {
+		require.NoError(t, writer.Write(point))
+	}
+
+	require.NoError(t, writer.Close())
+
+	gpx := buffer.String()
+	assert.True(t, strings.HasPrefix(gpx, `<?xml version="1.0" encoding="UTF-8"?>`))
+	assert.Equal(t, 3, strings.Count(gpx, "<trk>"))
+	assert.Equal(t, 4, strings.Count(gpx, "<trkseg>"))
+	assert.Equal(t, strings.Count(gpx, "<trkseg>"), strings.Count(gpx, "</trkseg>"))
+	assert.Contains(t, gpx, "<name>alice/iphone</name>")
+	assert.Contains(t, gpx, "<name>bob&lt;/x</name>")
+	assert.Contains(t, gpx, `<trkpt lat="51.5074" lon="-0.1278"><ele>42</ele><time>2024-01-01T10:00:00Z</time>`)
+	assert.Contains(t, gpx, "<gpxtpx:speed>10</gpxtpx:speed><gpxtpx:course>90</gpxtpx:course>")
+	assert.Contains(t, gpx, `<trkpt lat="1" lon="2"><time>1970-01-01T00:00:00Z</time></trkpt>`)
+	assert.True(t, strings.HasSuffix(gpx, "</trkseg></trk></gpx>"))
+
+	points, invalid := decodeTrack(t, buffer.Bytes())
+	assert.Len(t, points, 5)
+	assert.Zero(t, invalid)
+}
+
+func TestGPXWriterWithoutPoints(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := newGPXWriter(&buffer, time.Minute)
+	require.NoError(t, writer.Begin())
+	require.NoError(t, writer.Close())
+
+	assert.True(t, strings.HasSuffix(buffer.String(), "></gpx>"))
+	assert.NotContains(t, buffer.String(), "<trk>")
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	kmlNamespace   = "http://www.opengis.net/kml/2.2"
+	kmlGxNamespace = "http://www.google.com/kml/ext/2.2"
+
+	// kmlStopMinDuration is how long consecutive points must share a geocoded name to
+	// be shown as a stop
+	kmlStopMinDuration = 5 * time.Minute
+
+	// kmlTrackChunkSize is the most points written to one gx:Track. gx:Track needs
+	// every when before the first gx:coord, so a device's points are split into
+	// tracks of a gx:MultiTrack to bound how many coordinates are held at once
+	kmlTrackChunkSize = 1000
+)
+
+// kmlStop is a run of consecutive points with the same geocoded name.
+type kmlStop struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+	Begin     time.Time
+	End       time.Time
+}
+
+func formatKMLCoordinate(deviceRecord DeviceRecord, separator string) string {
+	coordinate := strconv.FormatFloat(deviceRecord.Longitude, 'f', -1, 64) + separator +
+		strconv.FormatFloat(deviceRecord.Latitude, 'f', -1, 64)
+
+	if deviceRecord.Altitude != nil {
+		coordinate += separator + strconv.FormatFloat(float64(*deviceRecord.Altitude), 'f', -1, 32)
+	}
+
+	return coordinate
+}
+
+// kmlWriter streams DeviceRecords, which must be ordered by user, device and time, as
+// a KML document with a folder per user and device. Each folder holds a gx:MultiTrack,
+// so that Google Earth's time slider can play it back, and a placemark for each stop.
+type kmlWriter struct {
+	ctx     context.Context //nolint:containedctx
+	encoder *xml.Encoder
+
+	track string
+	// coords are the coordinates of the open gx:Track's whens
+	coords []string
+	stops  []kmlStop
+}
+
+func newKMLWriter(ctx context.Context, w io.Writer) *kmlWriter {
+	return &kmlWriter{ctx: ctx, encoder: xml.NewEncoder(w)}
+}
+
+func (writer *kmlWriter) start(name string, attributes ...xml.Attr) error {
+	return writer.encoder.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}, Attr: attributes})
+}
+
+func (writer *kmlWriter) end(name string) error {
+	return writer.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+func (writer *kmlWriter) element(name string, value string) error {
+	return writer.encoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+// Begin writes the XML declaration and opens the kml and Document elements.
+func (writer *kmlWriter) Begin() error {
+	err := writer.encoder.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)})
+	if err == nil {
+		err = writer.start("kml",
+			xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: kmlNamespace},
+			xml.Attr{Name: xml.Name{Local: "xmlns:gx"}, Value: kmlGxNamespace},
+		)
+	}
+
+	if err == nil {
+		err = writer.start("Document")
+	}
+
+	if err == nil {
+		err = writer.element("name", "OwnTracks")
+	}
+
+	return err
+}
+
+// Write adds a point to its device's track.
+func (writer *kmlWriter) Write(deviceRecord DeviceRecord) error {
+	name := deviceRecord.User + "/" + deviceRecord.Device
+
+	if name != writer.track {
+		if writer.track != "" {
+			err := writer.closeTrack()
+			if err != nil {
+				return err
+			}
+		}
+
+		writer.track = name
+
+		err := writer.openTrack()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(writer.coords) == kmlTrackChunkSize {
+		err := writer.endTrackChunk()
+		if err == nil {
+			err = writer.start("gx:Track")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writer.element("when", deviceRecord.DeviceTimestamp.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	writer.coords = append(writer.coords, formatKMLCoordinate(deviceRecord, " "))
+	writer.addToStops(deviceRecord)
+
+	return nil
+}
+
+func (writer *kmlWriter) addToStops(deviceRecord DeviceRecord) {
+	if deviceRecord.Geocoding == nil {
+		return
+	}
+
+	location := Location{Geocoding: *deviceRecord.Geocoding}
+	name := location.GeocodedName(writer.ctx, PlacePrecisionAddress)
+
+	if last := len(writer.stops) - 1; last >= 0 && writer.stops[last].Name == name {
+		writer.stops[last].End = *deviceRecord.DeviceTimestamp
+
+		return
+	}
+
+	// Only the latest stop can still be growing, so drop it if it was too short
+	if last := len(writer.stops) - 1; last >= 0 &&
+		writer.stops[last].End.Sub(writer.stops[last].Begin) < kmlStopMinDuration {
+		writer.stops = writer.stops[:last]
+	}
+
+	writer.stops = append(writer.stops, kmlStop{
+		Name:      name,
+		Latitude:  deviceRecord.Latitude,
+		Longitude: deviceRecord.Longitude,
+		Begin:     *deviceRecord.DeviceTimestamp,
+		End:       *deviceRecord.DeviceTimestamp,
+	})
+}
+
+func (writer *kmlWriter) openTrack() error {
+	err := writer.start("Folder")
+	if err == nil {
+		err = writer.element("name", writer.track)
+	}
+
+	if err == nil {
+		err = writer.start("Placemark")
+	}
+
+	if err == nil {
+		err = writer.element("name", writer.track)
+	}
+
+	if err == nil {
+		err = writer.start("gx:MultiTrack")
+	}
+
+	if err == nil {
+		// Join the chunks up so that they draw as one line
+		err = writer.element("gx:interpolate", "1")
+	}
+
+	if err == nil {
+		err = writer.start("gx:Track")
+	}
+
+	return err
+}
+
+// endTrackChunk writes the coordinates of the open gx:Track and closes it.
+func (writer *kmlWriter) endTrackChunk() error {
+	for _, coord := range writer.coords {
+		err := writer.element("gx:coord", coord)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.coords = writer.coords[:0]
+
+	return writer.end("gx:Track")
+}
+
+func (writer *kmlWriter) closeTrack() error {
+	err := writer.endTrackChunk()
+	if err == nil {
+		err = writer.end("gx:MultiTrack")
+	}
+
+	if err == nil {
+		err = writer.end("Placemark")
+	}
+
+	for _, stop := range writer.stops {
+		if err != nil {
+			return err
+		}
+
+		if stop.End.Sub(stop.Begin) >= kmlStopMinDuration && stop.Name != "Unknown" {
+			err = writer.writeStop(stop)
+		}
+	}
+
+	if err == nil {
+		err = writer.end("Folder")
+	}
+
+	writer.stops = writer.stops[:0]
+
+	return err
+}
+
+func (writer *kmlWriter) writeStop(stop kmlStop) error {
+	err := writer.start("Placemark")
+	if err == nil {
+		err = writer.element("name", stop.Name)
+	}
+
+	if err == nil {
+		err = writer.start("TimeSpan")
+	}
+
+	if err == nil {
+		err = writer.element("begin", stop.Begin.UTC().Format(time.RFC3339))
+	}
+
+	if err == nil {
+		err = writer.element("end", stop.End.UTC().Format(time.RFC3339))
+	}
+
+	if err == nil {
+		err = writer.end("TimeSpan")
+	}
+
+	if err == nil {
+		err = writer.start("Point")
+	}
+
+	if err == nil {
+		err = writer.element("coordinates",
+			formatKMLCoordinate(DeviceRecord{Latitude: stop.Latitude, Longitude: stop.Longitude}, ","))
+	}
+
+	if err == nil {
+		err = writer.end("Point")
+	}
+
+	if err == nil {
+		err = writer.end("Placemark")
+	}
+
+	return err
+}
+
+// Flush writes any buffered XML to the underlying writer.
+func (writer *kmlWriter) Flush() error {
+	return writer.encoder.Flush()
+}
+
+// Close finishes any open track and closes the document.
+func (writer *kmlWriter) Close() error {
+	if writer.track != "" {
+		err := writer.closeTrack()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writer.end("Document")
+	if err == nil {
+		err = writer.end("kml")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writer.encoder.Close()
+}
+
+// ExportKML exports location data as a gzipped KML document, or as a KMZ archive if
+// the kmz query parameter is true.
+//
+//nolint:funlen
+func (env *Env) ExportKML(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	from, to, err := exportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	kmz, _ := strconv.ParseBool(r.URL.Query().Get("kmz"))
+
+	filter, err := env.exportFilter(r)
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	rows, err := env.getPointsByDevice(ctx, from, to, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	var (
+		output io.Writer
+		flush  func()
+		finish func()
+	)
+
+	if kmz {
+		w.Header().Set("Content-Type", "application/vnd.google-earth.kmz")
+		w.Header().Set("Content-Disposition", "attachment; filename=owntracks.kmz")
+		w.WriteHeader(http.StatusOK)
+
+		zipWriter := zip.NewWriter(w)
+
+		output, err = zipWriter.Create("doc.kml")
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error creating KMZ")
+
+			return
+		}
+
+		flush = func() {
+			_ = zipWriter.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		finish = func() { _ = zipWriter.Close() }
+	} else {
+		gzipWriter := writeExportHTTPHeader(w, "owntracks.kml", "application/vnd.google-earth.kml+xml")
+
+		output = gzipWriter
+		flush = flushExport(w, gzipWriter)
+		finish = func() { _ = gzipWriter.Close() }
+	}
+
+	writer := newKMLWriter(ctx, output)
+
+	defer func() {
+		err := writer.Close()
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error finishing KML export")
+		}
+
+		finish()
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}()
+
+	err = writer.Begin()
+	if err == nil {
+		err = streamDeviceRecords(ctx, rows, func() {
+			_ = writer.Flush()
+
+			flush()
+		}, writer.Write)
+	}
+
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming KML export")
+	}
+}
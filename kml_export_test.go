@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDeviceRecord(user, device string, offset time.Duration, geocoding string) DeviceRecord {
+	timestamp := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Add(offset)
+	altitude := float32(42)
+
+	record := DeviceRecord{
+		DeviceTimestamp: &timestamp,
+		Timestamp:       &timestamp,
+		Latitude:        51.5074,
+		Longitude:       -0.1278,
+		Altitude:        &altitude,
+		User:            user,
+		Device:          device,
+	}
+
+	if geocoding != "" {
+		record.Geocoding = &geocoding
+	}
+
+	return record
+}
+
+func TestKMLWriter(t *testing.T) {
+	home := `{"address": {"house_number": "1", "road": "High Street", "city": "London"}}`
+	shop := `{"address": {"road": "Market Street", "city": "London"}}`
+
+	var buffer bytes.Buffer
+
+	writer := newKMLWriter(t.Context(), &buffer)
+	require.NoError(t, writer.Begin())
+
+	for _, record := range []DeviceRecord{
+		testDeviceRecord("alice", "iphone", 0, home),
+		testDeviceRecord("alice", "iphone", 10*time.Minute, home),
+		testDeviceRecord("alice", "iphone", 11*time.Minute, ""),
+		testDeviceRecord("alice", "iphone", 12*time.Minute, shop),
+		testDeviceRecord("alice", "iphone", 13*time.Minute, shop),
+		testDeviceRecord("bob", "pixel", 0, ""),
+	} {
+		require.NoError(t, writer.Write(record))
+	}
+
+	require.NoError(t, writer.Close())
+
+	kml := buffer.String()
+	assert.Equal(t, 2, strings.Count(kml, "<Folder>"))
+	assert.Equal(t, 2, strings.Count(kml, "<gx:Track>"))
+	assert.Contains(t, kml, "<when>2024-01-01T10:00:00Z</when><when>2024-01-01T10:10:00Z</when>")
+	assert.Contains(t, kml, "<gx:coord>-0.1278 51.5074 42</gx:coord>")
+
+	// Only the stop at home lasted long enough to be shown
+	assert.Equal(t, 1, strings.Count(kml, "<TimeSpan>"))
+	assert.Contains(t, kml, "High Street")
+	assert.NotContains(t, kml, "Market Street")
+	assert.Contains(t, kml, "<begin>2024-01-01T10:00:00Z</begin><end>2024-01-01T10:10:00Z</end>")
+	assert.Contains(t, kml, "<coordinates>-0.1278,51.5074</coordinates>")
+
+	points, invalid := decodeTrack(t, buffer.Bytes())
+	assert.Len(t, points, 6)
+	assert.Zero(t, invalid)
+}
+
+func TestKMLWriterSplitsLongTracks(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := newKMLWriter(t.Context(), &buffer)
+	require.NoError(t, writer.Begin())
+
+	for i := range kmlTrackChunkSize + 1 {
+		require.NoError(t, writer.Write(testDeviceRecord("alice", "iphone", time.Duration(i)*time.Second, "")))
+		assert.LessOrEqual(t, len(writer.coords), kmlTrackChunkSize)
+	}
+
+	require.NoError(t, writer.Close())
+
+	kml := buffer.String()
+	assert.Equal(t, 1, strings.Count(kml, "<gx:MultiTrack>"))
+	assert.Equal(t, 2, strings.Count(kml, "<gx:Track>"))
+
+	points, invalid := decodeTrack(t, buffer.Bytes())
+	assert.Len(t, points, kmlTrackChunkSize+1)
+	assert.Zero(t, invalid)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const (
+	geoJSONFormatPoints     = "points"
+	geoJSONFormatLineString = "linestring"
+
+	// metresPerDegree converts a simplification tolerance in metres to degrees of
+	// latitude. Degrees of longitude shrink towards the poles, so east-west tolerance is
+	// effectively tighter there.
+	metresPerDegree = 111320
+)
+
+// trackLineProperties are the properties trackLine.Feature sets on a feature.
+var trackLineProperties = []string{"user", "device", "start", "end", "points"}
+
+// trackLine is one user and device's track over an export range, as a GeoJSON
+// LineString, or a MultiLineString if it was split at time gaps.
+type trackLine struct {
+	User     string
+	Device   string
+	Start    time.Time
+	End      time.Time
+	Points   int
+	Geometry []byte
+}
+
+// Feature converts a trackLine to a GeoJSON Feature.
+func (line trackLine) Feature() (*geojson.Feature, error) {
+	geometry, err := geojson.UnmarshalGeometry(line.Geometry)
+	if err != nil {
+		return nil, fmt.Errorf("parsing track geometry: %w", err)
+	}
+
+	feature := geojson.NewFeature(geometry)
+	feature.SetProperty("user", line.User)
+	feature.SetProperty("device", line.Device)
+	feature.SetProperty("start", line.Start.Unix())
+	feature.SetProperty("end", line.End.Unix())
+	feature.SetProperty("points", line.Points)
+
+	return feature, nil
+}
+
+// getTrackLines returns a trackLine per user and device for the locations in
+// [from, to]. Each run of points with no more than gap between them becomes a line,
+// and lines are simplified with the given tolerance in metres. Runs of a single point
+// aren't lines and are dropped.
+func (env *Env) getTrackLines(
+	ctx context.Context,
+	from, to time.Time,
+	filter pointsFilter,
+	gap time.Duration,
+	tolerance float64,
+) (*sql.Rows, error) {
+	conditions, args := filter.sql([]any{from, to, gap.Seconds(), tolerance / metresPerDegree})
+	limit, args := filter.limit(args)
+
+	rows, err := env.database.QueryContext(ctx, `WITH points AS (
+    SELECT "user", device, devicetimestamp, point::geometry AS geom,
+        coalesce(devicetimestamp - lag(devicetimestamp) OVER track > make_interval(secs => $3), false) AS gap
+    FROM `+filter.table()+`
+    WHERE devicetimestamp >= $1 AND devicetimestamp <= $2
+    `+conditions+`WINDOW track AS (PARTITION BY "user", device ORDER BY devicetimestamp)
+    `+limit+`), segments AS (
+    SELECT "user", device, devicetimestamp, geom,
+        count(*) FILTER (WHERE gap) OVER (PARTITION BY "user", device ORDER BY devicetimestamp) AS segment
+    FROM points
+), lines AS (
+    SELECT "user", device, min(devicetimestamp) AS start, max(devicetimestamp) AS finish,
+        count(*) AS points, ST_MakeLine(geom ORDER BY devicetimestamp) AS line
+    FROM segments
+    GROUP BY "user", device, segment
+    HAVING count(*) > 1
+), tracks AS (
+    SELECT "user", device, min(start) AS start, max(finish) AS finish, sum(points)::bigint AS points,
+        ST_SimplifyPreserveTopology(ST_Collect(line ORDER BY start), $4) AS track
+    FROM lines
+    GROUP BY "user", device
+)
+SELECT "user", device, start, finish, points,
+    ST_AsGeoJSON(CASE WHEN ST_NumGeometries(track) = 1 THEN ST_GeometryN(track, 1) ELSE track END)
+FROM tracks
+ORDER BY "user", device`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying track lines: %w", err)
+	}
+
+	return rows, nil
+}
+
+func scanTrackLine(rows *sql.Rows) (trackLine, error) {
+	var line trackLine
+
+	err := rows.Scan(&line.User, &line.Device, &line.Start, &line.End, &line.Points, &line.Geometry)
+	if err != nil {
+		return line, fmt.Errorf("scanning track line: %w", err)
+	}
+
+	return line, nil
+}
+
+// geoJSONFormat parses the format query parameter of a GeoJSON export, which is either
+// a feature per point or a line per track.
+func geoJSONFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", geoJSONFormatPoints:
+		return geoJSONFormatPoints, nil
+	case geoJSONFormatLineString:
+		return geoJSONFormatLineString, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected %s or %s", format, geoJSONFormatPoints, geoJSONFormatLineString)
+	}
+}
+
+// trackLineQuery is how a linestring GeoJSON export is split and simplified.
+type trackLineQuery struct {
+	Gap       time.Duration
+	Tolerance float64
+	Fields    map[string]bool
+}
+
+// parseTrackLineQuery parses the gap, tolerance and fields query parameters of a
+// linestring GeoJSON export.
+func parseTrackLineQuery(r *http.Request) (trackLineQuery, error) {
+	var (
+		query trackLineQuery
+		err   error
+	)
+
+	query.Gap, err = exportGap(r)
+	if err != nil {
+		return query, err
+	}
+
+	if tolerance := r.URL.Query().Get("tolerance"); tolerance != "" {
+		query.Tolerance, err = strconv.ParseFloat(tolerance, 64)
+		if err != nil || query.Tolerance < 0 {
+			return query, fmt.Errorf("tolerance %q should be a non-negative number of metres", tolerance)
+		}
+	}
+
+	query.Fields, err = parseGeoJSONFields(r.URL.Query().Get("fields"), trackLineProperties)
+
+	return query, err
+}
+
+// writeTrackLines writes the track lines in rows as a GeoJSON FeatureCollection.
+func writeTrackLines(
+	ctx context.Context,
+	w io.Writer,
+	rows *sql.Rows,
+	fields map[string]bool,
+	flush func(),
+) error {
+	_, err := io.WriteString(w, featureCollectionHeader)
+	if err != nil {
+		return err
+	}
+
+	written := false
+
+	for rows.Next() {
+		line, err := scanTrackLine(rows)
+		if err != nil {
+			return err
+		}
+
+		feature, err := line.Feature()
+		if err != nil {
+			slog.With("err", err).With("user", line.User).With("device", line.Device).
+				ErrorContext(ctx, "Error converting track to GeoJSON")
+
+			continue
+		}
+
+		featureBytes, err := selectProperties(feature, fields).MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("marshalling track: %w", err)
+		}
+
+		if written {
+			_, _ = io.WriteString(w, ",")
+		}
+
+		_, err = w.Write(featureBytes)
+		if err != nil {
+			return err
+		}
+
+		written = true
+
+		flush()
+	}
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	_, err = io.WriteString(w, featureCollectionFooter)
+
+	return err
+}
+
+// exportTrackLines responds to a linestring GeoJSON export with a gzipped
+// FeatureCollection of a line per user and device.
+func (env *Env) exportTrackLines(
+	w http.ResponseWriter,
+	r *http.Request,
+	from, to time.Time,
+	filter pointsFilter,
+) {
+	ctx := r.Context()
+
+	query, err := parseTrackLineQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	rows, err := env.getTrackLines(ctx, from, to, filter, query.Gap, query.Tolerance)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	gzipWriter := writeExportHTTPHeader(w, "owntracks-geojson.json", "application/json")
+
+	defer func() {
+		_ = gzipWriter.Close()
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}()
+
+	err = writeTrackLines(ctx, gzipWriter, rows, query.Fields, flushExport(w, gzipWriter))
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming GeoJSON track export")
+	}
+}
+
+// otTrackLines responds to a linestring /api/0/locations request with an uncompressed
+// FeatureCollection, as the rest of the OwnTracks API isn't compressed.
+func (env *Env) otTrackLines(
+	w http.ResponseWriter,
+	r *http.Request,
+	from, to time.Time,
+	filter pointsFilter,
+) {
+	ctx := r.Context()
+
+	query, err := parseTrackLineQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	rows, err := env.getTrackLines(ctx, from, to, filter, query.Gap, query.Tolerance)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = writeTrackLines(ctx, w, rows, query.Fields, func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming track lines")
+	}
+}
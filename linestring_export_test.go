@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackLineFeature(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	line := trackLine{
+		User:     "alice",
+		Device:   "iphone",
+		Start:    start,
+		End:      start.Add(time.Hour),
+		Points:   120,
+		Geometry: []byte(`{"type":"MultiLineString","coordinates":[[[-0.12,51.5],[-0.11,51.51]],[[-0.1,51.52],[-0.09,51.53]]]}`),
+	}
+
+	feature, err := line.Feature()
+	require.NoError(t, err)
+	assert.Equal(t, geojson.GeometryMultiLineString, feature.Geometry.Type)
+	assert.Len(t, feature.Geometry.MultiLineString, 2)
+	assert.Equal(t, "alice", feature.Properties["user"])
+	assert.Equal(t, start.Unix(), feature.Properties["start"])
+	assert.Equal(t, 120, feature.Properties["points"])
+
+	selected := selectProperties(feature, map[string]bool{"user": true, "points": true})
+	assert.Equal(t, map[string]any{"user": "alice", "points": 120}, selected.Properties)
+
+	line.Geometry = []byte(`not json`)
+	_, err = line.Feature()
+	assert.Error(t, err)
+}
+
+func TestGeoJSONFormat(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                   geoJSONFormatPoints,
+		"?format=points":     geoJSONFormatPoints,
+		"?format=linestring": geoJSONFormatLineString,
+	} {
+		format, err := geoJSONFormat(httptest.NewRequest("GET", "/export"+query, nil))
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, format, query)
+	}
+
+	_, err := geoJSONFormat(httptest.NewRequest("GET", "/export?format=polygon", nil))
+	assert.Error(t, err)
+}
+
+func TestParseTrackLineQuery(t *testing.T) {
+	query, err := parseTrackLineQuery(httptest.NewRequest("GET", "/export", nil))
+	require.NoError(t, err)
+	assert.Equal(t, trackLineQuery{Gap: defaultSegmentGap}, query)
+
+	query, err = parseTrackLineQuery(httptest.NewRequest("GET",
+		"/export?gap=1h&tolerance=25&fields=user,device", nil))
+	require.NoError(t, err)
+	assert.Equal(t, trackLineQuery{
+		Gap:       time.Hour,
+		Tolerance: 25,
+		Fields:    map[string]bool{"user": true, "device": true},
+	}, query)
+
+	for _, invalid := range []string{"gap=soon", "tolerance=-1", "tolerance=far", "fields=accuracy"} {
+		_, err := parseTrackLineQuery(httptest.NewRequest("GET", "/export?"+invalid, nil))
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// liveSubscriberBuffer is how many locations a subscriber can fall behind by before
+	// it's dropped as a slow consumer.
+	liveSubscriberBuffer = 64
+
+	liveWriteWait      = 10 * time.Second
+	livePongWait       = 60 * time.Second
+	livePingPeriod     = livePongWait * 9 / 10
+	liveMaxMessageSize = 4096
+
+	liveSubscribeType   = "subscribe"
+	liveUnsubscribeType = "unsubscribe"
+	liveLastMessage     = "LAST"
+
+	// Types of OwnTracks message that are published live without being stored
+	transitionType = "transition"
+	statusType     = "status"
+	lwtType        = "lwt"
+)
+
+// liveLocations publishes newly stored locations and other OwnTracks messages to live
+// subscribers.
+var liveLocations = newLiveHub()
+
+// liveEvent is a newly stored location, or another OwnTracks message such as a
+// transition, as published to live subscribers.
+type liveEvent struct {
+	// Type is the OwnTracks _type of the message
+	Type   string `json:"type"`
+	User   string `json:"user"`
+	Device string `json:"device"`
+	// ID is the stored location's id, or 0 for messages that aren't stored
+	ID       int      `json:"id,omitempty"`
+	Location Location `json:"location"`
+	// Payload is the message as received, for messages other than locations
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// newLiveEvent converts a stored location message to a liveEvent.
+func newLiveEvent(id int, msg MQTTMsg) liveEvent {
+	battery := msg.Battery
+
+	return liveEvent{Type: locationType, User: msg.User, Device: msg.Device, ID: id, Location: Location{
+		Type:             locationType,
+		Timestamp:        msg.DeviceTimestamp.Unix(),
+		Accuracy:         msg.Accuracy,
+		Latitude:         msg.Latitude,
+		Longitude:        msg.Longitude,
+		Altitude:         msg.Altitude,
+		VerticalAccuracy: msg.VerticalAccuracy,
+		Course:           float32(msg.Course),
+		Speed:            msg.Speed,
+		Username:         msg.User,
+		Device:           msg.Device,
+		TrackerID:        msg.TrackerID,
+		Battery:          &battery,
+		Connection:       msg.Connection,
+	}}
+}
+
+// liveFilter restricts the locations a subscriber is sent to those of some users and
+// devices. An empty list matches every user or device.
+type liveFilter struct {
+	Users   []string `json:"users"`
+	Devices []string `json:"devices"`
+}
+
+func (filter liveFilter) matches(event liveEvent) bool {
+	return (len(filter.Users) == 0 || slices.Contains(filter.Users, event.User)) &&
+		(len(filter.Devices) == 0 || slices.Contains(filter.Devices, event.Device))
+}
+
+// liveSubscriber receives the published locations that match its filter.
+type liveSubscriber struct {
+	events chan liveEvent
+
+	mutex  sync.Mutex
+	filter liveFilter
+}
+
+// Events returns the subscriber's locations. It's closed if the subscriber is dropped
+// for falling too far behind.
+func (subscriber *liveSubscriber) Events() <-chan liveEvent {
+	return subscriber.events
+}
+
+// SetFilter changes which locations the subscriber is sent.
+func (subscriber *liveSubscriber) SetFilter(filter liveFilter) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	subscriber.filter = filter
+}
+
+func (subscriber *liveSubscriber) matches(event liveEvent) bool {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	return subscriber.filter.matches(event)
+}
+
+// liveHub fans published locations out to subscribers without ever blocking the
+// publisher. A subscriber whose buffer is full is dropped rather than waited for.
+type liveHub struct {
+	mutex       sync.Mutex
+	subscribers map[*liveSubscriber]struct{}
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{subscribers: map[*liveSubscriber]struct{}{}}
+}
+
+// Subscribe registers a subscriber for the locations that match filter.
+func (hub *liveHub) Subscribe(filter liveFilter) *liveSubscriber {
+	subscriber := &liveSubscriber{events: make(chan liveEvent, liveSubscriberBuffer), filter: filter}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.subscribers[subscriber] = struct{}{}
+
+	return subscriber
+}
+
+// Unsubscribe removes a subscriber, if it hasn't already been dropped.
+func (hub *liveHub) Unsubscribe(subscriber *liveSubscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.remove(subscriber)
+}
+
+func (hub *liveHub) remove(subscriber *liveSubscriber) {
+	if _, ok := hub.subscribers[subscriber]; ok {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// Publish sends an event to every subscriber whose filter matches it.
+func (hub *liveHub) Publish(event liveEvent) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for subscriber := range hub.subscribers {
+		if !subscriber.matches(event) {
+			continue
+		}
+
+		select {
+		case subscriber.events <- event:
+		default:
+			slog.With("user", event.User).With("device", event.Device).
+				Warn("Dropping live subscriber that isn't keeping up")
+			hub.remove(subscriber)
+		}
+	}
+}
+
+// websocketCheckOrigin returns a websocket origin check for the configured origins: "*"
+// allows any, otherwise a comma-separated list of allowed origins. Same-origin requests
+// and those without an Origin header, which don't come from browsers, are always
+// allowed.
+func websocketCheckOrigin(origins string) func(r *http.Request) bool {
+	if strings.TrimSpace(origins) == "*" {
+		return func(_ *http.Request) bool { return true }
+	}
+
+	var allowed []string
+
+	for origin := range strings.SplitSeq(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed = append(allowed, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		for _, candidate := range allowed {
+			if strings.EqualFold(origin, candidate) {
+				return true
+			}
+		}
+
+		originURL, err := url.Parse(origin)
+
+		return err == nil && strings.EqualFold(originURL.Host, r.Host)
+	}
+}
+
+// liveMessage is a message from a websocket client: a subscription filter, or a request
+// to stop receiving locations.
+type liveMessage struct {
+	Type string `json:"_type"`
+	liveFilter
+}
+
+// LiveWebsocketHandler pushes newly stored locations, but not other live events, to the
+// client once it subscribes by sending {"_type": "subscribe"}, with optional users and
+// devices lists. Sending LAST returns the latest location of every device, as it always
+// has.
+func (env *Env) LiveWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	env.serveLiveWebsocket(w, r, false)
+}
+
+// LiveAllWebsocketHandler is LiveWebsocketHandler with every location subscribed to
+// from the start.
+func (env *Env) LiveAllWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	env.serveLiveWebsocket(w, r, true)
+}
+
+//nolint:funlen,cyclop
+func (env *Env) serveLiveWebsocket(w http.ResponseWriter, r *http.Request, subscribeAll bool) {
+	ctx := r.Context()
+
+	// A user who isn't an admin only receives their own locations and their friends'
+	access, err := env.requestVisibility(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	var visible atomic.Pointer[visibility]
+	visible.Store(access)
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     websocketCheckOrigin(env.configuration.WebsocketOrigins),
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(ctx, "Failed to set websocket upgrade")
+
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	subscriptions := make(chan *liveFilter)
+	replies := make(chan []byte)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	defer close(stop)
+
+	go env.readLiveWebsocket(ctx, conn, &visible, liveWebsocketChannels{subscriptions, replies, done, stop})
+
+	var subscriber *liveSubscriber
+
+	defer func() {
+		if subscriber != nil {
+			liveLocations.Unsubscribe(subscriber)
+		}
+	}()
+
+	if subscribeAll {
+		subscriber = liveLocations.Subscribe(liveFilter{})
+	}
+
+	ticker := time.NewTicker(livePingPeriod)
+	defer ticker.Stop()
+
+	// Friendships that end or are removed stop applying without reconnecting
+	var checks <-chan time.Time
+
+	if access != nil {
+		checker := time.NewTicker(visibilityCheckInterval)
+		defer checker.Stop()
+
+		checks = checker.C
+	}
+
+	write := func(messageType int, data []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+
+		return conn.WriteMessage(messageType, data)
+	}
+
+	for {
+		var events <-chan liveEvent
+		if subscriber != nil {
+			events = subscriber.Events()
+		}
+
+		select {
+		case <-done:
+			return
+		case filter := <-subscriptions:
+			switch {
+			case filter == nil && subscriber != nil:
+				liveLocations.Unsubscribe(subscriber)
+
+				subscriber = nil
+			case filter != nil && subscriber == nil:
+				subscriber = liveLocations.Subscribe(*filter)
+			case filter != nil:
+				subscriber.SetFilter(*filter)
+			}
+		case reply := <-replies:
+			err = write(websocket.TextMessage, reply)
+		case event, ok := <-events:
+			if !ok {
+				subscriber = nil
+
+				_ = write(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+
+				return
+			}
+
+			if event.Type != locationType {
+				continue
+			}
+
+			location, ok := env.visibleLocation(ctx, visible.Load(), event.Location)
+			if !ok {
+				continue
+			}
+
+			locationBytes, marshalErr := json.Marshal(location)
+			if marshalErr != nil {
+				slog.With("err", marshalErr).
+					ErrorContext(ctx, "Error formatting location for websocket")
+
+				continue
+			}
+
+			err = write(websocket.TextMessage, locationBytes)
+		case <-ticker.C:
+			err = write(websocket.PingMessage, nil)
+		case <-checks:
+			refreshed, checkErr := env.userVisibility(ctx, access.User)
+			if checkErr != nil {
+				slog.With("err", checkErr).
+					WarnContext(ctx, "Unable to refresh websocket's friendships")
+
+				continue
+			}
+
+			visible.Store(refreshed)
+		}
+
+		if err != nil {
+			slog.With("err", err).
+				WarnContext(ctx, "error writing message to ws")
+
+			return
+		}
+	}
+}
+
+// liveWebsocketChannels connect a websocket's reader to its writer, which owns the
+// connection's subscription and is the only goroutine that writes to it.
+type liveWebsocketChannels struct {
+	// subscriptions carries new filters, or nil to unsubscribe
+	subscriptions chan<- *liveFilter
+	replies       chan<- []byte
+	// done is closed by the reader when the client goes away
+	done chan<- struct{}
+	// stop is closed by the writer when it gives up on the client
+	stop <-chan struct{}
+}
+
+// readLiveWebsocket handles messages from a websocket client until it disconnects or
+// stops answering pings, passing subscription changes and replies to the writer. The
+// client can only subscribe to and get the latest locations of the users it can see.
+func (env *Env) readLiveWebsocket(
+	ctx context.Context,
+	conn *websocket.Conn,
+	visible *atomic.Pointer[visibility],
+	channels liveWebsocketChannels,
+) {
+	defer close(channels.done)
+
+	conn.SetReadLimit(liveMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(livePongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if string(msg) == liveLastMessage {
+			reply, err := env.lastLocationsMessage(ctx, visible.Load())
+			if err != nil {
+				slog.With("err", err).
+					ErrorContext(ctx, "Error fetching last locations")
+
+				continue
+			}
+
+			select {
+			case channels.replies <- reply:
+			case <-channels.stop:
+				return
+			}
+
+			continue
+		}
+
+		var message liveMessage
+
+		err = json.Unmarshal(msg, &message)
+		if err != nil {
+			slog.With("err", err).
+				DebugContext(ctx, "Ignoring unrecognised websocket message")
+
+			continue
+		}
+
+		var filter *liveFilter
+
+		switch message.Type {
+		case liveSubscribeType:
+			users, err := visible.Load().restrictUsers(message.Users)
+			if err != nil {
+				slog.With("err", err).With("users", message.Users).
+					DebugContext(ctx, "Ignoring subscription to other users")
+
+				continue
+			}
+
+			message.Users = users
+			filter = &message.liveFilter
+		case liveUnsubscribeType:
+		default:
+			continue
+		}
+
+		select {
+		case channels.subscriptions <- filter:
+		case <-channels.stop:
+			return
+		}
+	}
+}
+
+func (env *Env) lastLocationsMessage(ctx context.Context, access *visibility) ([]byte, error) {
+	locations, err := env.visibleLastLocations(ctx, access, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(locations)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// liveNotifyChannel is the Postgres channel that instances sharing a database
+	// announce live events and cache updates on.
+	liveNotifyChannel = "owntracks_live"
+	// liveNotifyMaxPayload is the largest payload Postgres accepts in a notification.
+	// Anything bigger is only seen by the instance that produced it.
+	liveNotifyMaxPayload = 7999
+
+	liveListenerMinReconnect = 10 * time.Second
+	liveListenerMaxReconnect = time.Minute
+	liveListenerPingInterval = 90 * time.Second
+)
+
+// liveInstanceID identifies this instance's notifications, so that it doesn't publish
+// its own events twice.
+var liveInstanceID = rand.Text()
+
+// liveNotifyDatabase is the database that live events are announced to other instances
+// through, or nil if they aren't.
+var liveNotifyDatabase *sql.DB
+
+// liveNotification is what an instance announces on liveNotifyChannel: a live event for
+// its subscribers, or a reverse geocoding result for its cache.
+type liveNotification struct {
+	Origin  string       `json:"origin"`
+	Event   *liveEvent   `json:"event,omitempty"`
+	Geocode *liveGeocode `json:"geocode,omitempty"`
+}
+
+// liveGeocode is a reverse geocoding result, keyed as in reverseGeocodeCache.
+type liveGeocode struct {
+	Key       string `json:"key"`
+	Geocoding string `json:"geocoding"`
+}
+
+// publishLiveEvent publishes an event that isn't stored, such as a transition, to this
+// instance's subscribers and announces it to the others. Stored locations are announced
+// by notifyLiveEvents instead.
+func publishLiveEvent(ctx context.Context, event liveEvent) {
+	liveLocations.Publish(event)
+	notifyLive(ctx, liveNotification{Event: &event})
+}
+
+// notifyLive announces a notification to other instances, if that's enabled. Failures
+// are logged rather than returned, as the instance's own work is already done.
+func notifyLive(ctx context.Context, notification liveNotification) {
+	if liveNotifyDatabase == nil {
+		return
+	}
+
+	payload, err := liveNotificationPayload(notification)
+	if err != nil {
+		slog.With("err", err).WarnContext(ctx, "Not notifying other instances")
+
+		return
+	}
+
+	_, err = liveNotifyDatabase.ExecContext(ctx, "select pg_notify($1, $2)", liveNotifyChannel, payload)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Unable to notify other instances")
+	}
+}
+
+// notifyLiveEvents announces events for locations being stored to other instances as
+// part of the transaction storing them, so that they're delivered only if, and once,
+// it commits. Events too large for a notification are left out. Each instance's own
+// subscribers are published to once the transaction has committed.
+func notifyLiveEvents(
+	ctx context.Context,
+	tx interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	},
+	events []liveEvent,
+) error {
+	if liveNotifyDatabase == nil || len(events) == 0 {
+		return nil
+	}
+
+	payloads := make([]string, 0, len(events))
+
+	for _, event := range events {
+		payload, err := liveNotificationPayload(liveNotification{Event: &event})
+		if err != nil {
+			slog.With("err", err).With("id", event.ID).WarnContext(ctx, "Not notifying other instances")
+
+			continue
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	_, err := tx.ExecContext(ctx, "select pg_notify($1, payload) from unnest($2::text[]) as payload",
+		liveNotifyChannel, pq.Array(payloads))
+	if err != nil {
+		return fmt.Errorf("notifying other instances: %w", err)
+	}
+
+	return nil
+}
+
+// liveNotificationPayload marshals a notification from this instance, checking that
+// it fits in a Postgres notification.
+func liveNotificationPayload(notification liveNotification) (string, error) {
+	notification.Origin = liveInstanceID
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return "", fmt.Errorf("marshalling notification: %w", err)
+	}
+
+	if len(payload) > liveNotifyMaxPayload {
+		return "", fmt.Errorf("notification of %d bytes is too large", len(payload))
+	}
+
+	return string(payload), nil
+}
+
+// handleLiveNotification applies a notification from another instance: events are
+// published to this instance's subscribers and geocoding results are cached.
+func handleLiveNotification(ctx context.Context, payload string) {
+	var notification liveNotification
+
+	err := json.Unmarshal([]byte(payload), &notification)
+	if err != nil {
+		slog.With("err", err).WarnContext(ctx, "Ignoring unreadable notification")
+
+		return
+	}
+
+	if notification.Origin == liveInstanceID {
+		return
+	}
+
+	if notification.Event != nil {
+		liveLocations.Publish(*notification.Event)
+	}
+
+	if notification.Geocode != nil {
+		reverseGeocodeCache.Set(notification.Geocode.Key, notification.Geocode.Geocoding, 0)
+	}
+}
+
+// ListenLiveNotifications listens for other instances' notifications until the context
+// is cancelled, reconnecting if the connection drops. Events announced while it's
+// disconnected are missed, but SSE clients can resume from the database.
+func (env *Env) ListenLiveNotifications(ctx context.Context) {
+	listener := pq.NewListener(
+		env.configuration.databaseConnectionString(),
+		liveListenerMinReconnect,
+		liveListenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventConnected:
+				slog.InfoContext(ctx, "Listening for notifications from other instances")
+			case pq.ListenerEventReconnected:
+				slog.WarnContext(ctx, "Reconnected to notifications, some may have been missed")
+			case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+				slog.With("err", err).ErrorContext(ctx, "Lost connection for notifications")
+			}
+		},
+	)
+
+	defer func() { _ = listener.Close() }()
+
+	err := listener.Listen(liveNotifyChannel)
+	if err != nil {
+		slog.With("err", err).With("channel", liveNotifyChannel).
+			ErrorContext(ctx, "Unable to listen for notifications")
+
+		return
+	}
+
+	ticker := time.NewTicker(liveListenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-listener.Notify:
+			// A nil notification means the connection was re-established
+			if notification != nil {
+				handleLiveNotification(ctx, notification.Extra)
+			}
+		case <-ticker.C:
+			go func() { _ = listener.Ping() }()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// otherInstanceNotification returns notification's payload as if another instance had
+// sent it.
+func otherInstanceNotification(t *testing.T, notification liveNotification) string {
+	t.Helper()
+
+	notification.Origin = "another-instance"
+
+	payload, err := json.Marshal(notification)
+	require.NoError(t, err)
+
+	return string(payload)
+}
+
+func TestHandleLiveNotificationPublishesOtherInstancesEvents(t *testing.T) {
+	subscriber := liveLocations.Subscribe(liveFilter{})
+	defer liveLocations.Unsubscribe(subscriber)
+
+	event := testLiveEvent(7, "alice", "iphone")
+
+	handleLiveNotification(t.Context(), otherInstanceNotification(t, liveNotification{Event: &event}))
+
+	received := <-subscriber.Events()
+	assert.Equal(t, event, received)
+
+	// This instance's own notifications were published when they were sent
+	payload, err := liveNotificationPayload(liveNotification{Event: &event})
+	require.NoError(t, err)
+
+	handleLiveNotification(t.Context(), payload)
+	assert.Empty(t, subscriber.Events())
+}
+
+func TestHandleLiveNotificationCachesGeocoding(t *testing.T) {
+	key := reverseGeocodeCacheKey(51.5055, -0.0754, "")
+
+	t.Cleanup(func() { reverseGeocodeCache.Delete(key) })
+
+	handleLiveNotification(t.Context(), otherInstanceNotification(t, liveNotification{
+		Geocode: &liveGeocode{Key: key, Geocoding: `{"display_name":"Tower Bridge"}`},
+	}))
+
+	cached, ok := reverseGeocodeCache.Get(key)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"display_name":"Tower Bridge"}`, cached.(string))
+}
+
+func TestLiveNotificationPayloadRejectsOversizedNotifications(t *testing.T) {
+	event := liveEvent{
+		Type:    transitionType,
+		Payload: json.RawMessage(`"` + strings.Repeat("x", liveNotifyMaxPayload) + `"`),
+	}
+
+	_, err := liveNotificationPayload(liveNotification{Event: &event})
+	assert.Error(t, err)
+}
+
+// recordingExecer records the statements a transaction would execute.
+type recordingExecer struct {
+	args [][]any
+}
+
+func (execer *recordingExecer) ExecContext(_ context.Context, _ string, args ...any) (sql.Result, error) {
+	execer.args = append(execer.args, args)
+
+	return nil, nil //nolint:nilnil
+}
+
+func TestNotifyLiveEventsInTransaction(t *testing.T) {
+	var tx recordingExecer
+
+	require.NoError(t, notifyLiveEvents(t.Context(), &tx, []liveEvent{testLiveEvent(1, "alice", "iphone")}))
+	assert.Empty(t, tx.args, "notifications are disabled")
+
+	liveNotifyDatabase = &sql.DB{}
+
+	t.Cleanup(func() { liveNotifyDatabase = nil })
+
+	oversized := liveEvent{
+		Type:    transitionType,
+		Payload: json.RawMessage(`"` + strings.Repeat("x", liveNotifyMaxPayload) + `"`),
+	}
+
+	require.NoError(t, notifyLiveEvents(t.Context(), &tx, []liveEvent{
+		testLiveEvent(1, "alice", "iphone"),
+		oversized,
+		testLiveEvent(2, "bob", "pixel"),
+	}))
+	require.Len(t, tx.args, 1, "every event is announced in one statement")
+	assert.Equal(t, liveNotifyChannel, tx.args[0][0])
+
+	payloads, err := tx.args[0][1].(driver.Valuer).Value()
+	require.NoError(t, err)
+	assert.Contains(t, payloads, `\"id\":1`)
+	assert.Contains(t, payloads, `\"id\":2`)
+	assert.NotContains(t, payloads, "xxxx")
+}
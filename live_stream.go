@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// streamBacklogBatch is how many missed locations are read at a time when a client
+	// resumes a stream.
+	streamBacklogBatch = 500
+	// streamBacklogMaxLocations is the most locations, by id, that a resuming client
+	// catches up on. Ids count everyone's locations, so this also bounds how many are
+	// read for it.
+	streamBacklogMaxLocations = 10000
+	// streamResetType is the event sent instead of the backlog to a client resuming from
+	// further back than streamBacklogMaxLocations.
+	streamResetType = "reset"
+	// streamKeepalive is how often an idle stream sends a comment, so that proxies don't
+	// time it out.
+	streamKeepalive = 30 * time.Second
+)
+
+// listParameter returns the values of a query parameter that may be repeated or
+// comma-separated.
+func listParameter(r *http.Request, name string) []string {
+	var values []string
+
+	for _, value := range r.URL.Query()[name] {
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+
+	return values
+}
+
+// streamResumeID returns the id of the last location a reconnecting client received,
+// from the Last-Event-ID header or, for clients that can't set it, the lastEventId
+// query parameter. It returns false if the client isn't resuming.
+func streamResumeID(r *http.Request) (int, bool, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+
+	if value == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid Last-Event-ID %q", value)
+	}
+
+	return id, true, nil
+}
+
+// latestLocationID returns the id of the most recently stored location, or 0 if there
+// are none.
+func (env *Env) latestLocationID(ctx context.Context) (int, error) {
+	if env.database == nil {
+		return 0, errors.New("no database connection available")
+	}
+
+	var id int
+
+	err := env.database.QueryRowContext(ctx, `select coalesce(max(id), 0) from locations`).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("reading latest location id: %w", err)
+	}
+
+	return id, nil
+}
+
+// streamCatchUpFrom returns the id to send a resuming client's backlog after. If it
+// missed more than streamBacklogMaxLocations it isn't sent them, but only what's stored
+// from now on, and true so that it can be told to reset.
+func streamCatchUpFrom(afterID int, latestID int) (int, bool) {
+	if latestID-afterID > streamBacklogMaxLocations {
+		return latestID, true
+	}
+
+	return afterID, false
+}
+
+// getLocationEventsAfter reads up to limit stored locations matching filter with ids
+// after afterID, in id order. Privacy zones are applied to everyone's locations but
+// owner's, so suppressed locations are read but not returned. It also returns the id of
+// the last location read if there may be more after it, or 0 if there aren't.
+//
+//nolint:funlen
+func (env *Env) getLocationEventsAfter(
+	ctx context.Context,
+	afterID int,
+	filter liveFilter,
+	owner string,
+	limit int,
+) ([]liveEvent, int, error) {
+	if env.database == nil {
+		return nil, 0, errors.New("no database connection available")
+	}
+
+	rows, err := env.database.QueryContext(ctx, `select locations.id,
+       "user",
+       device,
+       ST_Y(coalesce(zone.centre, point)::geometry),
+       ST_X(coalesce(zone.centre, point)::geometry),
+       coalesce(zone.label, ''),
+       coalesce(zone.action = 'suppress', false),
+       devicetimestamp,
+       accuracy,
+       coalesce(altitude, 0),
+       coalesce(verticalaccuracy, 0),
+       coalesce(speed, 0),
+       coalesce(cog, 0),
+       coalesce(tid, ''),
+       batterylevel,
+       coalesce(connectiontype::text, '')
+from (select *
+      from locations
+      where id > $1
+        and ($2::text[] is null or "user" = any ($2::text[]))
+        and ($3::text[] is null or device = any ($3::text[]))
+      order by id
+      limit $4) locations
+         left join lateral privacy_zone_at(locations."user", locations.point) zone on locations."user" <> $5
+order by locations.id`, afterID, pq.Array(filter.Users), pq.Array(filter.Devices), limit, owner)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying locations to resume: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	var (
+		events []liveEvent
+		read   int
+		lastID int
+	)
+
+	for rows.Next() {
+		var (
+			event      = liveEvent{Type: locationType, Location: Location{Type: locationType}}
+			timestamp  time.Time
+			zoneLabel  string
+			suppressed bool
+		)
+
+		err = rows.Scan(
+			&event.ID,
+			&event.Location.Username,
+			&event.Location.Device,
+			&event.Location.Latitude,
+			&event.Location.Longitude,
+			&zoneLabel,
+			&suppressed,
+			&timestamp,
+			&event.Location.Accuracy,
+			&event.Location.Altitude,
+			&event.Location.VerticalAccuracy,
+			&event.Location.Speed,
+			&event.Location.Course,
+			&event.Location.TrackerID,
+			&event.Location.Battery,
+			&event.Location.Connection,
+		)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scanning location to resume: %w", err)
+		}
+
+		read++
+		lastID = event.ID
+
+		if suppressed {
+			continue
+		}
+
+		if zoneLabel != "" {
+			event.Location.Geocoding = privacyZoneGeocoding(zoneLabel)
+		}
+
+		event.User = event.Location.Username
+		event.Device = event.Location.Device
+		event.Location.Timestamp = timestamp.Unix()
+		events = append(events, event)
+	}
+
+	if read < limit {
+		lastID = 0
+	}
+
+	return events, lastID, rows.Err()
+}
+
+// writeServerSentEvent writes an event in the text/event-stream format. Locations carry
+// their id so that a client can resume after them; other events have none.
+func writeServerSentEvent(w io.Writer, event liveEvent) error {
+	var data bytes.Buffer
+
+	if event.Type == locationType {
+		err := json.NewEncoder(&data).Encode(event.Location)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := json.Compact(&data, event.Payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	var message strings.Builder
+
+	if event.ID != 0 {
+		fmt.Fprintf(&message, "id: %d\n", event.ID)
+	}
+
+	fmt.Fprintf(&message, "event: %s\ndata: %s\n\n", event.Type, bytes.TrimSpace(data.Bytes()))
+
+	_, err := io.WriteString(w, message.String())
+
+	return err
+}
+
+// visibleEvent prepares an event for a stream with access, returning false if it
+// shouldn't be sent. Friends' locations are prepared as for websockets, and their other
+// events, which can name places, are left out.
+func (env *Env) visibleEvent(ctx context.Context, access *visibility, event liveEvent) (liveEvent, bool) {
+	if event.Type != locationType {
+		return event, access == nil || event.User == access.User
+	}
+
+	location, ok := env.visibleLocation(ctx, access, event.Location)
+	event.Location = location
+
+	return event, ok
+}
+
+// StreamHandler streams new locations, transitions and device status as Server-Sent
+// Events, filtered by the user and device query parameters. A client that reconnects
+// with Last-Event-ID is first sent the stored locations it missed, unless it missed too
+// many, when it's sent a reset event instead. A user who isn't an admin only receives
+// their own events and their friends' locations from within the friendship.
+//
+//nolint:funlen,cyclop
+func (env *Env) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	afterID, resume, err := streamResumeID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	access, err := env.requestVisibility(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	users, err := access.restrictUsers(listParameter(r, "user"))
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	filter := liveFilter{Users: users, Devices: listParameter(r, "device")}
+
+	reset := false
+
+	if resume {
+		// Read before subscribing, so that anything stored after it is in the backlog
+		var latestID int
+
+		latestID, err = env.latestLocationID(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		afterID, reset = streamCatchUpFrom(afterID, latestID)
+	}
+
+	// The backlog is read for the users that are visible now, rather than everyone's
+	backlog := filter
+	if access != nil && len(backlog.Users) == 0 {
+		backlog.Users = access.users()
+	}
+
+	// Subscribe before reading the backlog so that nothing stored in between is missed.
+	// Anything sent from both is skipped by id.
+	subscriber := liveLocations.Subscribe(filter)
+	defer liveLocations.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(event liveEvent) bool {
+		if event.ID > afterID {
+			afterID = event.ID
+		}
+
+		err := writeServerSentEvent(w, event)
+		if err != nil {
+			slog.With("err", err).With("type", event.Type).
+				WarnContext(ctx, "Error writing to event stream")
+
+			return false
+		}
+
+		return true
+	}
+
+	if reset && !write(liveEvent{Type: streamResetType, Payload: json.RawMessage(`{}`)}) {
+		return
+	}
+
+	for resume {
+		events, lastID, err := env.getLocationEventsAfter(ctx, afterID, backlog, access.owner(), streamBacklogBatch)
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error reading missed locations for event stream")
+
+			return
+		}
+
+		for _, event := range events {
+			// The backlog already has privacy zones applied
+			if !access.seesLocation(event.Location) {
+				continue
+			}
+
+			event.Location = access.reduce(ctx, event.Location)
+
+			if !write(event) {
+				return
+			}
+		}
+
+		flusher.Flush()
+
+		afterID = max(afterID, lastID)
+		resume = lastID != 0
+	}
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+
+	// Friendships are re-read so that ones that end stop applying
+	var checks <-chan time.Time
+
+	if access != nil {
+		checker := time.NewTicker(visibilityCheckInterval)
+		defer checker.Stop()
+
+		checks = checker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case <-checks:
+			refreshed, checkErr := env.userVisibility(ctx, access.User)
+			if checkErr != nil {
+				slog.With("err", checkErr).
+					WarnContext(ctx, "Unable to refresh event stream's friendships")
+
+				continue
+			}
+
+			access = refreshed
+		case event, ok := <-subscriber.Events():
+			if !ok {
+				// Dropped for falling behind: the client reconnects and resumes
+				return
+			}
+
+			if event.ID != 0 && event.ID <= afterID {
+				continue
+			}
+
+			event, ok = env.visibleEvent(ctx, access, event)
+			if !ok {
+				continue
+			}
+
+			if !write(event) {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
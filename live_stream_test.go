@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteServerSentEvent(t *testing.T) {
+	var buffer bytes.Buffer
+
+	require.NoError(t, writeServerSentEvent(&buffer, testLiveEvent(42, "alice", "iphone")))
+	assert.True(t, strings.HasPrefix(buffer.String(), "id: 42\nevent: location\ndata: {"))
+	assert.True(t, strings.HasSuffix(buffer.String(), "}\n\n"))
+	assert.Equal(t, 1, strings.Count(buffer.String(), "data:"))
+
+	buffer.Reset()
+
+	require.NoError(t, writeServerSentEvent(&buffer, liveEvent{
+		Type:    transitionType,
+		User:    "alice",
+		Device:  "iphone",
+		Payload: []byte("{\n  \"_type\": \"transition\",\n  \"event\": \"enter\"\n}"),
+	}))
+	assert.Equal(t, "event: transition\ndata: {\"_type\":\"transition\",\"event\":\"enter\"}\n\n", buffer.String())
+}
+
+func TestStreamResumeID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/0/stream", nil)
+	_, resume, err := streamResumeID(r)
+	require.NoError(t, err)
+	assert.False(t, resume)
+
+	r.Header.Set("Last-Event-ID", "1234")
+	id, resume, err := streamResumeID(r)
+	require.NoError(t, err)
+	assert.True(t, resume)
+	assert.Equal(t, 1234, id)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/0/stream?lastEventId=99", nil)
+	id, _, err = streamResumeID(r)
+	require.NoError(t, err)
+	assert.Equal(t, 99, id)
+
+	r.Header.Set("Last-Event-ID", "nope")
+	_, _, err = streamResumeID(r)
+	assert.Error(t, err)
+}
+
+func TestStreamCatchUpFrom(t *testing.T) {
+	afterID, reset := streamCatchUpFrom(1000, 1500)
+	assert.Equal(t, 1000, afterID)
+	assert.False(t, reset)
+
+	afterID, reset = streamCatchUpFrom(0, streamBacklogMaxLocations)
+	assert.Equal(t, 0, afterID)
+	assert.False(t, reset)
+
+	afterID, reset = streamCatchUpFrom(0, streamBacklogMaxLocations+1)
+	assert.Equal(t, streamBacklogMaxLocations+1, afterID)
+	assert.True(t, reset)
+
+	var buffer bytes.Buffer
+
+	require.NoError(t, writeServerSentEvent(&buffer, liveEvent{Type: streamResetType, Payload: []byte(`{}`)}))
+	assert.Equal(t, "event: reset\ndata: {}\n\n", buffer.String())
+}
+
+func TestListParameter(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/0/stream?user=alice,bob&user=carol&device=", nil)
+
+	assert.Equal(t, []string{"alice", "bob", "carol"}, listParameter(r, "user"))
+	assert.Empty(t, listParameter(r, "device"))
+}
+
+func TestTopicOwner(t *testing.T) {
+	for topic, owner := range map[string][2]string{
+		"owntracks/alice/iphone":        {"alice", "iphone"},
+		"owntracks/alice/iphone/event":  {"alice", "iphone"},
+		"owntracks/alice/iphone/status": {"alice", "iphone"},
+		"owntracks/alice":               {"alice", ""},
+		"owntracks":                     {"", ""},
+	} {
+		user, device := topicOwner(topic)
+		assert.Equal(t, owner, [2]string{user, device}, topic)
+	}
+}
+
+func TestStreamHandlerStreamsLiveEvents(t *testing.T) {
+	env := Env{configuration: &Configuration{}}
+	server := httptest.NewServer(env.BuildRoutes(env.configuration))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/0/stream?user=alice", nil)
+	require.NoError(t, err)
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+
+	defer func() { _ = response.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	waitForLiveSubscribers(t, 1)
+
+	liveLocations.Publish(testLiveEvent(1, "bob", "pixel"))
+	liveLocations.Publish(testLiveEvent(2, "alice", "iphone"))
+	liveLocations.Publish(liveEvent{Type: statusType, User: "alice", Device: "iphone", Payload: []byte(`{"_type":"status"}`)})
+
+	reader := bufio.NewReader(response.Body)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	assert.Equal(t, "id: 2", readLine())
+	assert.Equal(t, "event: location", readLine())
+	assert.Contains(t, readLine(), `"username":"alice"`)
+	assert.Empty(t, readLine())
+	assert.Equal(t, "event: status", readLine())
+	assert.Equal(t, `data: {"_type":"status"}`, readLine())
+
+	cancel()
+	waitForLiveSubscribers(t, 0)
+}
+
+func TestStreamHandlerRejectsInvalidLastEventID(t *testing.T) {
+	env := Env{configuration: &Configuration{}}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/0/stream", nil)
+	request.Header.Set("Last-Event-ID", "-1")
+
+	env.StreamHandler(recorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLiveEvent(id int, user, device string) liveEvent {
+	msg := testMQTTMsg()
+	msg.User = user
+	msg.Device = device
+
+	return newLiveEvent(id, msg)
+}
+
+func TestLiveHubFiltersLocations(t *testing.T) {
+	hub := newLiveHub()
+	subscriber := hub.Subscribe(liveFilter{Users: []string{"alice"}})
+
+	hub.Publish(testLiveEvent(1, "bob", "pixel"))
+	hub.Publish(testLiveEvent(2, "alice", "iphone"))
+
+	subscriber.SetFilter(liveFilter{Devices: []string{"ipad"}})
+	hub.Publish(testLiveEvent(3, "alice", "iphone"))
+	hub.Publish(testLiveEvent(4, "alice", "ipad"))
+
+	hub.Unsubscribe(subscriber)
+
+	var ids []int
+	for event := range subscriber.Events() {
+		ids = append(ids, event.ID)
+	}
+
+	assert.Equal(t, []int{2, 4}, ids)
+}
+
+func TestLiveHubDropsSlowSubscribers(t *testing.T) {
+	hub := newLiveHub()
+	slow := hub.Subscribe(liveFilter{})
+	fast := hub.Subscribe(liveFilter{})
+
+	for id := range liveSubscriberBuffer + 1 {
+		hub.Publish(testLiveEvent(id, "alice", "iphone"))
+
+		<-fast.Events()
+	}
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+
+	assert.Equal(t, liveSubscriberBuffer, received)
+	assert.Len(t, hub.subscribers, 1)
+
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(fast)
+}
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	request := func(origin string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://recorder.example.com/ws/live", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+
+		return r
+	}
+
+	assert.True(t, websocketCheckOrigin("*")(request("https://evil.example.net")))
+
+	check := websocketCheckOrigin("https://map.example.com, https://ha.example.com/")
+	assert.True(t, check(request("")))
+	assert.True(t, check(request("https://map.example.com")))
+	assert.True(t, check(request("https://HA.example.com")))
+	assert.True(t, check(request("http://recorder.example.com")))
+	assert.False(t, check(request("https://evil.example.net")))
+}
+
+func dialLiveWebsocket(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+
+	conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	require.NoError(t, err)
+
+	_ = response.Body.Close()
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func waitForLiveSubscribers(t *testing.T, count int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		liveLocations.mutex.Lock()
+		defer liveLocations.mutex.Unlock()
+
+		return len(liveLocations.subscribers) == count
+	}, time.Second, time.Millisecond)
+}
+
+func readLiveLocation(t *testing.T, conn *websocket.Conn) Location {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	var location Location
+	require.NoError(t, conn.ReadJSON(&location))
+
+	return location
+}
+
+func TestLiveWebsocketPushesSubscribedLocations(t *testing.T) {
+	env := Env{configuration: &Configuration{WebsocketOrigins: "*"}}
+	server := httptest.NewServer(env.BuildRoutes(env.configuration))
+	t.Cleanup(server.Close)
+
+	conn := dialLiveWebsocket(t, server, "/ws/last")
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"_type": "subscribe", "users": ["alice"]}`)))
+	waitForLiveSubscribers(t, 1)
+
+	liveLocations.Publish(testLiveEvent(1, "bob", "pixel"))
+	liveLocations.Publish(testLiveEvent(2, "alice", "iphone"))
+
+	location := readLiveLocation(t, conn)
+	assert.Equal(t, locationType, location.Type)
+	assert.Equal(t, "alice", location.Username)
+	assert.Equal(t, "iphone", location.Device)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"_type": "unsubscribe"}`)))
+	waitForLiveSubscribers(t, 0)
+}
+
+func TestLiveAllWebsocketSubscribesOnConnect(t *testing.T) {
+	env := Env{configuration: &Configuration{WebsocketOrigins: "*"}}
+	server := httptest.NewServer(env.BuildRoutes(env.configuration))
+	t.Cleanup(server.Close)
+
+	conn := dialLiveWebsocket(t, server, "/ws/live")
+	waitForLiveSubscribers(t, 1)
+
+	liveLocations.Publish(testLiveEvent(1, "bob", "pixel"))
+
+	location := readLiveLocation(t, conn)
+	assert.Equal(t, "bob", location.Username)
+
+	locationJSON, err := json.Marshal(location)
+	require.NoError(t, err)
+	assert.Contains(t, string(locationJSON), `"tid":`)
+
+	require.NoError(t, conn.Close())
+	waitForLiveSubscribers(t, 0)
+}
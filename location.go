@@ -7,13 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-chi/chi/v5"
-	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
 	"github.com/martinlindhe/unit"
 	geojson "github.com/paulmach/go.geojson"
 )
@@ -41,30 +44,65 @@ type Location struct {
 	Geocoding        string  `binding:"optional" json:"addr"`
 	Username         string  `binding:"optional" json:"username"`
 	Device           string  `binding:"optional" json:"device"`
+	TrackerID        string  `binding:"optional" json:"tid,omitempty"`
+	Battery          *int    `binding:"optional" json:"batt,omitempty"`
+	Connection       string  `binding:"optional" json:"conn,omitempty"`
+	// Name and Face are from the device's card, if it has one
+	Name string `binding:"optional" json:"name,omitempty"`
+	Face string `binding:"optional" json:"face,omitempty"`
+}
+
+// GetLastLocations returns the latest location of every device, optionally only those
+// of one user or device, with the device's card if there is one. A card for the device
+// itself takes precedence over one for the user as a whole.
+func (env *Env) GetLastLocations(ctx context.Context, user string, device string) ([]Location, error) {
+	return env.getLastLocations(ctx, locationsTable, user, device)
+}
+
+// GetRedactedLastLocations is GetLastLocations with privacy zones applied, for
+// publishing beyond the devices' users.
+func (env *Env) GetRedactedLastLocations(ctx context.Context, user string, device string) ([]Location, error) {
+	return env.getLastLocations(ctx, redactedLocationsTable, user, device)
 }
 
 //nolint:funlen
-func (env *Env) GetLastLocations(ctx context.Context) (*[]Location, error) {
+func (env *Env) getLastLocations(ctx context.Context, table string, user string, device string) ([]Location, error) {
 	if env.database == nil {
 		return nil, errors.New("no database connection available")
 	}
 
 	defer timeTrack(ctx, time.Now())
 
-	query := `select distinct on ("user") "user",
-                            device,
-                            geocoding,
-                            ST_Y(ST_AsText(point)),
-                            ST_X(ST_AsText(point)),
-                            devicetimestamp,
-                            accuracy,
-                            altitude,
-                            verticalAccuracy,
-                            speed
-from locations
-order by "user", devicetimestamp desc`
-
-	rows, err := env.database.QueryContext(ctx, query)
+	//nolint:gosec
+	query := `select last."user",
+       last.device,
+       last.geocoding,
+       ST_Y(ST_AsText(last.point)),
+       ST_X(ST_AsText(last.point)),
+       last.devicetimestamp,
+       last.accuracy,
+       last.altitude,
+       last.verticalAccuracy,
+       last.speed,
+       last.batterylevel,
+       coalesce(last.connectiontype::text, ''),
+       coalesce(last.tid, card.tid, ''),
+       coalesce(card.name, ''),
+       coalesce(card.face, '')
+from (select distinct on ("user", device) *
+      from ` + table + `
+      where ($1 = '' or "user" = $1)
+        and ($2 = '' or device = $2)
+      order by "user", device, devicetimestamp desc) last
+         left join lateral (select name, face, tid
+                            from cards
+                            where cards."user" = last."user"
+                              and cards.device in (last.device, '')
+                            order by cards.device desc
+                            limit 1) card on true
+order by last."user", last.device`
+
+	rows, err := env.database.QueryContext(ctx, query, user, device)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +134,11 @@ order by "user", devicetimestamp desc`
 			&location.Altitude,
 			&location.VerticalAccuracy,
 			&location.Speed,
+			&location.Battery,
+			&location.Connection,
+			&location.TrackerID,
+			&location.Name,
+			&location.Face,
 		)
 		if geocodingMaybe.Valid {
 			location.Geocoding = geocodingMaybe.String
@@ -111,9 +154,11 @@ order by "user", devicetimestamp desc`
 		}
 	}
 
-	return &locations, nil
+	return locations, rows.Err()
 }
 
+// GetLastLocationForUser returns the user's latest location with privacy zones
+// applied, as it's published on /location/.
 func (env *Env) GetLastLocationForUser(ctx context.Context, user string) (*Location, error) {
 	if env.database == nil {
 		return nil, errors.New("no database connection available")
@@ -131,7 +176,7 @@ func (env *Env) GetLastLocationForUser(ctx context.Context, user string) (*Locat
        altitude,
        verticalAccuracy,
        speed
-from locations
+from redacted_locations
 where "user" = $1
 order by devicetimestamp desc limit 1`
 	location := Location{Type: locationType}
@@ -180,39 +225,47 @@ func (env *Env) GetTotalDistanceInMiles(ctx context.Context) (float64, error) {
 	return distanceInMeters.Miles(), nil
 }
 
+// GetLocationsBetweenDates returns the locations in [from, to) that match filter,
+// latest first. Locations without a recorded speed get one calculated from the
+// previous location of the same device.
+//
 //nolint:funlen
 func (env *Env) GetLocationsBetweenDates(
 	ctx context.Context,
 	from time.Time,
 	to time.Time,
-	user string,
-	device string,
-) (*[]Location, error) {
+	filter pointsFilter,
+) ([]Location, error) {
 	if env.database == nil {
 		return nil, errors.New("no database connection available")
 	}
 
 	defer timeTrack(ctx, time.Now())
 
-	query := `select coalesce(geocoding -> 'results' -> 0 ->> 'formatted_address', ''),
-       ST_Y(ST_AsText(point)),
-       ST_X(ST_AsText(point)),
+	query, args := filter.query(`select coalesce(geocoding -> 'results' -> 0 ->> 'formatted_address', '') as geocoding,
+       ST_Y(ST_AsText(point))        as latitude,
+       ST_X(ST_AsText(point))        as longitude,
        devicetimestamp,
-       coalesce(speed, coalesce(3.6 * ST_Distance(point, lag(point, 1, point) over (order by devicetimestamp asc)) /
-                                extract('epoch' from
-                                        (devicetimestamp - lag(devicetimestamp) over (order by devicetimestamp asc))),
+       coalesce(speed, coalesce(3.6 * ST_Distance(point, lag(point, 1, point) over (
+                                    partition by "user", device order by devicetimestamp asc)) /
+                                extract('epoch' from (devicetimestamp - lag(devicetimestamp) over (
+                                    partition by "user", device order by devicetimestamp asc))),
                                 0))  as speed,
        coalesce(altitude, 0)         as altitude,
        accuracy,
-       coalesce(verticalaccuracy, 0) as verticalaccuraccy
-from locations
+       coalesce(verticalaccuracy, 0) as verticalaccuracy,
+       coalesce(cog, 0)              as cog,
+       "user",
+       device,
+       coalesce(tid, '')             as tid,
+       batterylevel,
+       coalesce(connectiontype::text, '') as connectiontype
+from `+filter.table()+`
 where devicetimestamp >= $1
   and devicetimestamp < $2
-  and "user" = $3
-  and device = $4
-order by devicetimestamp desc`
+`, "devicetimestamp desc", []any{from, to})
 
-	rows, err := env.database.QueryContext(ctx, query, from, to, user, device)
+	rows, err := env.database.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -224,7 +277,7 @@ order by devicetimestamp desc`
 	}
 
 	var (
-		locations []Location
+		locations = []Location{}
 		timestamp time.Time
 	)
 
@@ -239,6 +292,12 @@ order by devicetimestamp desc`
 			&location.Altitude,
 			&location.Accuracy,
 			&location.VerticalAccuracy,
+			&location.Course,
+			&location.Username,
+			&location.Device,
+			&location.TrackerID,
+			&location.Battery,
+			&location.Connection,
 		)
 		location.Timestamp = timestamp.Unix()
 
@@ -246,12 +305,10 @@ order by devicetimestamp desc`
 			return nil, err
 		}
 
-		location.Username = user
-		location.Device = device
 		locations = append(locations, location)
 	}
 
-	return &locations, nil
+	return locations, rows.Err()
 }
 
 func (env *Env) LocationHandler(w http.ResponseWriter, r *http.Request) {
@@ -278,10 +335,13 @@ func (env *Env) LocationHandler(w http.ResponseWriter, r *http.Request) {
 		"Last-Modified",
 		time.Unix(location.Timestamp, 0).Format("Mon, 02 Jan 2006 15:04:05 GMT"),
 	)
+	precision := env.configuration.PlacePrecision
+	decimals := precision.CoordinateDecimals()
+
 	respondJSON(w, map[string]any{
-		"name":          location.GeocodedName(ctx),
-		"latitude":      fmt.Sprintf("%.2f", location.Latitude),
-		"longitude":     fmt.Sprintf("%.2f", location.Longitude),
+		"name":          location.GeocodedName(ctx, precision),
+		"latitude":      fmt.Sprintf("%.*f", decimals, location.Latitude),
+		"longitude":     fmt.Sprintf("%.*f", decimals, location.Longitude),
 		"totalDistance": humanize.FormatFloat("#,###.##", distance),
 	})
 }
@@ -303,19 +363,40 @@ func (env *Env) LocationHeadHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// OTListUserHandler lists the users with locations, or the devices of the user given
+// in the query string. A user who isn't an admin only sees themselves and the users who
+// have made them a friend.
 func (env *Env) OTListUserHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		rows *sql.Rows
-		err  error
-	)
+	var rows *sql.Rows
+
+	access, err := env.requestVisibility(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if user := r.URL.Query().Get("user"); user != "" {
+		if !access.sees(user) {
+			requestError(w, errForbidden)
+
+			return
+		}
 
-	if r.URL.Query().Get("user") != "" {
 		rows, err = env.database.Query(
 			`select distinct "device" from locations where "user"=$1 order by "device";`,
-			r.URL.Query().Get("user"),
+			user,
 		)
 	} else {
-		rows, err = env.database.Query(`select distinct "user" from locations order by "user";`)
+		var users []string
+		if access != nil {
+			users = access.users()
+		}
+
+		rows, err = env.database.Query(
+			`select distinct "user" from locations where ($1::text[] is null or "user" = any ($1::text[])) order by "user";`,
+			pq.Array(users),
+		)
 	}
 
 	if err != nil {
@@ -353,307 +434,53 @@ func (env *Env) OTListUserHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// OTLastPosHandler returns the latest location of every device, filtered by the user
+// and device query parameters. fields selects the keys of each location. A user who
+// isn't an admin only sees their own devices and their friends', at the precision of
+// each friendship.
+//
 //nolint:cyclop
 func (env *Env) OTLastPosHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	user := r.URL.Query().Get("user")
-
-	device := r.URL.Query().Get("device")
-	if user != "" && device != "" {
-		location, err := env.GetLastLocationForUser(ctx, user)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-
-			return
-		}
-
-		respondJSON(w, [1]*Location{location})
-	} else {
-		locations, err := env.GetLastLocations(ctx)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-
-			return
-		}
-
-		if locations == nil || len(*locations) == 0 {
-			http.Error(w, "No location found", http.StatusInternalServerError)
-
-			return
-		}
-
-		var filteredLocations []Location
-
-		for _, location := range *locations {
-			if device == "" || location.Device == device {
-				if user == "" || (location.Username == user) {
-					filteredLocations = append(filteredLocations, location)
-				}
-			}
-		}
-
-		respondJSON(w, filteredLocations)
-	}
-}
-
-const iso8061fmt = "2006-01-02T15:04:05"
-
-func (env *Env) OTLocationsHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	from := r.URL.Query().Get("from")
-	if from == "" {
-		from = time.Now().AddDate(0, 0, -1).Format(iso8061fmt)
-	}
-
-	to := r.URL.Query().Get("to")
-	if to == "" {
-		to = time.Now().Format(iso8061fmt)
-	}
-
-	fromTime, err := time.Parse(iso8061fmt, from)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid from time %v: %v", from, err), http.StatusBadRequest)
-
-		return
-	}
 
-	toTime, err := time.Parse(iso8061fmt, to)
+	fields, err := parseGeoJSONFields(r.URL.Query().Get("fields"), otLastFields)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid to time %v: %v", to, err), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 
 		return
 	}
 
-	user := r.URL.Query().Get("user")
-	device := r.URL.Query().Get("device")
-
-	locations, err := env.GetLocationsBetweenDates(ctx, fromTime, toTime, user, device)
+	access, err := env.requestVisibility(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
-	if locations == nil {
-		http.Error(w, "No locations found", http.StatusInternalServerError)
-
-		return
-	}
-
-	response := struct {
-		Data []Location `json:"data"`
-	}{*locations}
-	responseBytes, _ := json.Marshal(response) //nolint:errchkjson
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(responseBytes)
-}
-
-func OTVersionHandler(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, map[string]any{"version": "1.0-owntracks-pg-recorder"})
-}
-
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-func (env *Env) wshandler(w http.ResponseWriter, r *http.Request) {
-	// At the moment, this is just an echo impl. At some point publish new updates down this.
-	wsUpgrader.CheckOrigin = func(_ *http.Request) bool { return true }
-
-	ctx := r.Context()
-
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.With("err", err).
-			ErrorContext(ctx, "Failed to set websocket upgrade")
-
-		return
-	}
-
-	for {
-		t, msg, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
-
-		switch string(msg) {
-		case "LAST":
-			locations, err := env.GetLastLocations(ctx)
-			if err != nil {
-				slog.With("err", err).
-					ErrorContext(r.Context(), "Error fetching last locations")
-
-				break
-			}
-
-			locationAsBytes, err := json.Marshal(*locations)
-			if err != nil {
-				slog.With("err", err).
-					ErrorContext(r.Context(), "Error formatting location for websocket")
-
-				break
-			}
-
-			err = conn.WriteMessage(t, locationAsBytes)
-			if err != nil {
-				slog.With("err", err).
-					WarnContext(r.Context(), "error writing message to ws")
-			}
-		}
-	}
-}
-
-//nolint:cyclop,funlen
-func (env *Env) PlaceHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	if env.database == nil {
-		http.Error(w, "No database connection available", http.StatusInternalServerError)
+	locations, err := env.visibleLastLocations(ctx, access, r.URL.Query().Get("user"), r.URL.Query().Get("device"))
+	if errors.Is(err, errForbidden) {
+		requestError(w, err)
 
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024)
-	place := r.FormValue("place")
-
-	geocoding, err := env.GetGeocoding(ctx, place)
 	if err != nil {
-		InternalError(ctx, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
-	if len(geocoding.Features) == 0 {
-		env.respondHTML(w, "placeResults.gohtml", map[string]any{resultsKey: nil, "place": place})
+	if len(locations) == 0 {
+		http.Error(w, "No location found", http.StatusNotFound)
 
 		return
 	}
 
-	feature := geocoding.Features[0]
-
-	var rows *sql.Rows
-
-	//nolint:gocritic
-	if feature.Properties["bounds"] != nil {
-		bounds := feature.Properties["bounds"].(map[string]any)
-		rows, err = env.database.Query(`select count(*) as c, date (devicetimestamp)
-from locations
-where point && ST_SetSRID(ST_MakeBox2D(ST_Point($1
-    , $2)
-    , ST_Point($3
-    , $4))
-    , 4326)
-group by date (devicetimestamp)
-order by c desc limit 20
-`, bounds["northeast"].(map[string]any)["lng"],
-			bounds["northeast"].(map[string]any)["lat"],
-			bounds["southwest"].(map[string]any)["lng"],
-			bounds["southwest"].(map[string]any)["lat"],
-		)
-	} else if feature.Geometry.IsPoint() &&
-		feature.Geometry.Point != nil &&
-		feature.Properties["confidence"] != nil &&
-		feature.Properties["confidence"].(float64) >= 1 &&
-		feature.Properties["confidence"].(float64) <= 10 {
-		var radius int
-
-		switch confidence := feature.Properties["confidence"].(float64); confidence {
-		case 10:
-			radius = 250
-		case 9:
-			radius = 500
-		case 8:
-			radius = 1000
-		case 7:
-			radius = 5000
-		case 6:
-			radius = 7500
-		case 5:
-			radius = 10000
-		case 4:
-			radius = 15000
-		case 3:
-			radius = 20000
-		case 2:
-			fallthrough
-		case 1:
-			fallthrough
-		default:
-			radius = 25000
-		}
-
-		rows, err = env.database.Query(`select count(*) as c, date (devicetimestamp)
-from locations
-where ST_DWithin(point
-    , ST_SetSRID(ST_Point( $1
-    , $2)
-    , 4326)
-    , $3)
-group by date (devicetimestamp)
-order by c desc limit 20
-`, feature.Geometry.Point[0], feature.Geometry.Point[1], radius)
-	} else {
-		http.Error(
-			w,
-			"No valid geometries found in geocoding response",
-			http.StatusInternalServerError,
-		)
-
-		return
-	}
-
-	if err != nil {
-		InternalError(ctx, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-
-		return
-	}
-
-	defer func(rows *sql.Rows) {
-		_ = rows.Close()
-	}(rows)
-
-	if rows.Err() != nil {
-		InternalError(ctx, rows.Err())
-		http.Error(w, rows.Err().Error(), http.StatusInternalServerError)
-
-		return
-	}
-
-	var results []LocationCountPerDay
-
-	for rows.Next() {
-		var result LocationCountPerDay
-
-		err := rows.Scan(&result.LocationCount, &result.Date)
-		if err != nil {
-			InternalError(ctx, err)
-			http.Error(
-				w,
-				fmt.Sprintf("Error fetching values from database: %v", err),
-				http.StatusInternalServerError,
-			)
-
-			return
-		}
-
-		results = append(results, result)
-	}
+	respondJSON(w, selectLocationFields(locations, fields))
+}
 
-	env.respondHTML(
-		w,
-		"placeResults.gohtml",
-		map[string]any{
-			resultsKey:  results,
-			"place":     place,
-			"formatted": feature.Properties["formatted"],
-		},
-	)
+func OTVersionHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, map[string]any{"version": "1.0-owntracks-pg-recorder"})
 }
 
 type LocationWithMetadata struct {
@@ -817,13 +644,6 @@ ORDER BY speed DESC LIMIT %d
 	env.respondHTML(w, "inaccurateLocations.gohtml", map[string]any{resultsKey: locations})
 }
 
-type (
-	LocationCountPerDay struct {
-		LocationCount int
-		Date          time.Time
-	}
-)
-
 //nolint:tagliatelle
 type DeviceRecord struct {
 	DeviceTimestamp  *time.Time `binding:"required" json:"device_timestamp"`
@@ -842,24 +662,151 @@ type DeviceRecord struct {
 	Device           string     `binding:"required" json:"device"`
 }
 
-func (env *Env) getPoints(from *time.Time, to *time.Time) (*sql.Rows, error) {
-	query := `SELECT
+// pointsQuery selects DeviceRecords from table.
+func pointsQuery(table string) string {
+	return `SELECT
     devicetimestamp, timestamp, accuracy, geocoding, batterylevel, connectiontype, doze, st_y(
     st_astext(
     point)) AS latitude, st_x(
     st_astext(
     point)) AS longitude, speed, altitude, verticalaccuracy, "user", device
 
-FROM locations
+FROM ` + table + `
 WHERE deviceTimestamp>=$1 AND deviceTimestamp<=$2
-ORDER by devicetimestamp ASC`
+`
+}
+
+func (env *Env) getPoints(
+	ctx context.Context,
+	from time.Time,
+	to time.Time,
+	filter pointsFilter,
+) (*sql.Rows, error) {
+	query, args := filter.query(pointsQuery(filter.table()), "devicetimestamp ASC", []any{from, to})
 
-	return env.database.Query(query, from, to)
+	return env.database.QueryContext(ctx, query, args...)
 }
 
-// renderDeviceRecordAsGeoJSON converts a DeviceRecord to a GeoJSON Feature.
-//
+// getPointsByDevice is getPoints ordered by user and device first, for exports that
+// group points into a track per device.
+func (env *Env) getPointsByDevice(
+	ctx context.Context,
+	from time.Time,
+	to time.Time,
+	filter pointsFilter,
+) (*sql.Rows, error) {
+	query, args := filter.query(pointsQuery(filter.table()), `"user", device, devicetimestamp ASC`, []any{from, to})
+
+	return env.database.QueryContext(ctx, query, args...)
+}
+
+func scanDeviceRecord(rows *sql.Rows) (DeviceRecord, error) {
+	var deviceRecord DeviceRecord
+
+	err := rows.Scan(
+		&deviceRecord.DeviceTimestamp,
+		&deviceRecord.Timestamp,
+		&deviceRecord.Accuracy,
+		&deviceRecord.Geocoding,
+		&deviceRecord.BatteryLevel,
+		&deviceRecord.ConnectionType,
+		&deviceRecord.Doze,
+		&deviceRecord.Latitude,
+		&deviceRecord.Longitude,
+		&deviceRecord.Speed,
+		&deviceRecord.Altitude,
+		&deviceRecord.VerticalAccuracy,
+		&deviceRecord.User,
+		&deviceRecord.Device,
+	)
+
+	return deviceRecord, err
+}
+
+// streamDeviceRecords passes each row to write as a DeviceRecord, calling flush
+// periodically so that the export reaches the client as it is produced. Rows that
+// can't be scanned are logged and skipped.
+func streamDeviceRecords(
+	ctx context.Context,
+	rows *sql.Rows,
+	flush func(),
+	write func(deviceRecord DeviceRecord) error,
+) error {
+	for counter := 0; rows.Next(); counter++ {
+		deviceRecord, err := scanDeviceRecord(rows)
+		if err != nil {
+			slog.With("err", err).
+				ErrorContext(ctx, "Error scanning row")
+		} else {
+			err = write(deviceRecord)
+			if err != nil {
+				return err
+			}
+		}
+
+		if counter%exportFlushEvery == 0 {
+			flush()
+		}
+	}
+
+	return rows.Err()
+}
+
+// flushExport flushes an export's gzip stream through to the client.
+func flushExport(w http.ResponseWriter, gzipWriter *gzip.Writer) func() {
+	return func() {
+		_ = gzipWriter.Flush()
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// geoJSONProperties are the properties renderDeviceRecordAsGeoJSON sets on a feature.
+var geoJSONProperties = []string{
+	"timestamp", "accuracy", "battery", "connection", "velocity", "vertical_accuracy",
+	"user", "device", "geocoding",
+}
+
+// parseGeoJSONFields parses a comma-separated list of feature properties to export,
+// each of which must be one of properties. It returns nil if the list is empty so that
+// every property is kept.
+func parseGeoJSONFields(value string, properties []string) (map[string]bool, error) {
+	if value == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	fields := map[string]bool{}
+
+	for field := range strings.SplitSeq(value, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(properties, field) {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(properties, ", "))
+		}
+
+		fields[field] = true
+	}
+
+	return fields, nil
+}
+
+// selectProperties removes the properties of a feature that aren't in fields, unless
+// fields is nil.
+func selectProperties(feature *geojson.Feature, fields map[string]bool) *geojson.Feature {
+	if fields == nil {
+		return feature
+	}
 
+	for property := range feature.Properties {
+		if !fields[property] {
+			delete(feature.Properties, property)
+		}
+	}
+
+	return feature
+}
+
+// renderDeviceRecordAsGeoJSON converts a DeviceRecord to a GeoJSON Feature.
 func renderDeviceRecordAsGeoJSON(deviceRecord DeviceRecord) *geojson.Feature {
 	var geometry *geojson.Geometry
 	if deviceRecord.Altitude == nil {
@@ -879,13 +826,21 @@ func renderDeviceRecordAsGeoJSON(deviceRecord DeviceRecord) *geojson.Feature {
 	feature.SetProperty("connection", deviceRecord.ConnectionType)
 	feature.SetProperty("velocity", deviceRecord.Speed)
 	feature.SetProperty("vertical_accuracy", deviceRecord.VerticalAccuracy)
+	feature.SetProperty("user", deviceRecord.User)
+	feature.SetProperty("device", deviceRecord.Device)
+
+	if deviceRecord.Geocoding != nil && json.Valid([]byte(*deviceRecord.Geocoding)) {
+		feature.SetProperty("geocoding", json.RawMessage(*deviceRecord.Geocoding))
+	} else {
+		feature.SetProperty("geocoding", nil)
+	}
 
 	return feature
 }
 
-func writeExportHTTPHeader(w http.ResponseWriter, filename string) *gzip.Writer {
+func writeExportHTTPHeader(w http.ResponseWriter, filename string, contentType string) *gzip.Writer {
 	header := w.Header()
-	header.Set("Content-Type", "application/json")
+	header.Set("Content-Type", contentType)
 	header.Set("Content-Disposition", "attachment; filename="+filename)
 	header.Set("Transfer-Encoding", "chunked")
 	header.Set("Content-Encoding", "gzip")
@@ -901,28 +856,55 @@ func writeExportHTTPHeader(w http.ResponseWriter, filename string) *gzip.Writer
 const featureCollectionHeader = `{"type":"FeatureCollection", "features":[`
 const featureCollectionFooter = `]}`
 
+// exportRange parses the RFC 3339 {from} and {to} URL parameters of an export.
+func exportRange(r *http.Request) (time.Time, time.Time, error) {
+	from, err := time.Parse(time.RFC3339, chi.URLParam(r, "from"))
+	if err != nil {
+		return from, time.Time{}, err
+	}
+
+	to, err := time.Parse(time.RFC3339, chi.URLParam(r, "to"))
+
+	return from, to, err
+}
+
 // ExportGeoJSON exports location data as a GeoJSON file.
-//
-//nolint:funlen,cyclop
 func (env *Env) ExportGeoJSON(w http.ResponseWriter, r *http.Request) {
-	fromParam := chi.URLParam(r, "from")
-	toParam := chi.URLParam(r, "to")
+	from, to, err := exportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	filter, err := env.exportFilter(r)
+	if err != nil {
+		requestError(w, err)
 
-	from, err := time.Parse(time.RFC3339, fromParam)
+		return
+	}
+
+	format, err := geoJSONFormat(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 
 		return
 	}
 
-	to, err := time.Parse(time.RFC3339, toParam)
+	if format == geoJSONFormatLineString {
+		env.exportTrackLines(w, r, from, to, filter)
+
+		return
+	}
+
+	fields, err := parseGeoJSONFields(r.URL.Query().Get("fields"), geoJSONProperties)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 
 		return
 	}
 
-	rows, err := env.getPoints(&from, &to)
+	rows, err := env.getPoints(r.Context(), from, to, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
@@ -937,7 +919,7 @@ func (env *Env) ExportGeoJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gzipWriter := writeExportHTTPHeader(w, "owntracks-geojson.json")
+	gzipWriter := writeExportHTTPHeader(w, "owntracks-geojson.json", "application/json")
 
 	defer func() {
 		_ = gzipWriter.Close()
@@ -947,58 +929,50 @@ func (env *Env) ExportGeoJSON(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	counter := 0
-	_, _ = gzipWriter.Write([]byte(featureCollectionHeader))
-
-	for rows.Next() {
-		var deviceRecord DeviceRecord
+	err = writeGeoJSONPoints(r.Context(), rows, gzipWriter, fields, flushExport(w, gzipWriter))
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(r.Context(), "Error streaming GeoJSON export")
+	}
+}
 
-		err := rows.Scan(
-			&deviceRecord.DeviceTimestamp,
-			&deviceRecord.Timestamp,
-			&deviceRecord.Accuracy,
-			&deviceRecord.Geocoding,
-			&deviceRecord.BatteryLevel,
-			&deviceRecord.ConnectionType,
-			&deviceRecord.Doze,
-			&deviceRecord.Latitude,
-			&deviceRecord.Longitude,
-			&deviceRecord.Speed,
-			&deviceRecord.Altitude,
-			&deviceRecord.VerticalAccuracy,
-			&deviceRecord.User,
-			&deviceRecord.Device,
-		)
+// writeGeoJSONPoints writes the locations in rows as a GeoJSON FeatureCollection of
+// Point features, keeping only the given properties unless fields is nil.
+func writeGeoJSONPoints(
+	ctx context.Context,
+	rows *sql.Rows,
+	w io.Writer,
+	fields map[string]bool,
+	flush func(),
+) error {
+	written := false
+	_, _ = io.WriteString(w, featureCollectionHeader)
+
+	err := streamDeviceRecords(ctx, rows, flush, func(deviceRecord DeviceRecord) error {
+		featureBytes, err := selectProperties(renderDeviceRecordAsGeoJSON(deviceRecord), fields).MarshalJSON()
 		if err != nil {
 			slog.With("err", err).
-				ErrorContext(r.Context(), "Error scanning row")
-		} else {
-			feature := renderDeviceRecordAsGeoJSON(deviceRecord)
+				ErrorContext(ctx, "Error marshalling feature to JSON")
 
-			featureBytes, err := feature.MarshalJSON()
-			if err != nil {
-				slog.With("err", err).
-					ErrorContext(r.Context(), "Error marshalling feature to JSON")
-			} else {
-				if counter > 0 {
-					_, _ = gzipWriter.Write([]byte(","))
-				}
-
-				_, _ = gzipWriter.Write(featureBytes)
-			}
+			return nil
 		}
 
-		if counter%100 == 0 {
-			_ = gzipWriter.Flush()
-			if flusher, ok := w.(http.Flusher); ok {
-				flusher.Flush()
-			}
+		if written {
+			_, _ = io.WriteString(w, ",")
 		}
 
-		counter++
+		_, err = w.Write(featureBytes)
+		written = true
+
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	_, _ = gzipWriter.Write([]byte(featureCollectionFooter))
+	_, err = io.WriteString(w, featureCollectionFooter)
+
+	return err
 }
 
 func respondJSON(w http.ResponseWriter, v any) {
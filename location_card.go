@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	cardType      = "card"
+	waypointType  = "waypoint"
+	waypointsType = "waypoints"
+)
+
+// Card is an OwnTracks card, which gives a user's display name and avatar.
+type Card struct {
+	Type      string `json:"_type"`
+	Name      string `json:"name,omitempty"`
+	Face      string `json:"face,omitempty"`
+	TrackerID string `json:"tid,omitempty"`
+}
+
+// Waypoint is an OwnTracks region defined on a device.
+type Waypoint struct {
+	Type        string  `json:"_type"`
+	Description string  `json:"desc"`
+	Latitude    float64 `json:"lat"`
+	Longitude   float64 `json:"lon"`
+	Radius      int     `json:"rad"`
+	Timestamp   int64   `json:"tst"`
+	RegionID    string  `json:"rid,omitempty"`
+}
+
+// Waypoints is the list of waypoints exported by an OwnTracks device.
+type Waypoints struct {
+	Type      string     `json:"_type"`
+	Waypoints []Waypoint `json:"waypoints"`
+}
+
+func nullIfEmpty(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// upsertCard stores the card for a user, or for one of their devices.
+func upsertCard(ctx context.Context, database *sql.DB, user, device string, card Card) error {
+	_, err := database.ExecContext(ctx, `insert into cards ("user", device, name, face, tid)
+values ($1, $2, $3, $4, $5)
+on conflict ("user", device) do update
+set name = excluded.name, face = excluded.face, tid = excluded.tid, updated_at = now()`,
+		user, device, nullIfEmpty(card.Name), nullIfEmpty(card.Face), nullIfEmpty(card.TrackerID),
+	)
+	if err != nil {
+		return fmt.Errorf("storing card for %s: %w", user, err)
+	}
+
+	return nil
+}
+
+// insertWaypoint stores a device's waypoint. It returns false if the waypoint was
+// already stored.
+func insertWaypoint(
+	ctx context.Context,
+	database *sql.DB,
+	user, device string,
+	waypoint Waypoint,
+) (bool, error) {
+	result, err := database.ExecContext(ctx, `insert into waypoints ("user", device, tst, description, point, radius, rid)
+values ($1, $2, $3, $4, ST_SetSRID(ST_MakePoint($5, $6), 4326), $7, $8)
+on conflict do nothing`,
+		user,
+		device,
+		time.Unix(waypoint.Timestamp, 0),
+		waypoint.Description,
+		waypoint.Longitude,
+		waypoint.Latitude,
+		waypoint.Radius,
+		nullIfEmpty(waypoint.RegionID),
+	)
+	if err != nil {
+		return false, fmt.Errorf("storing waypoint for %s/%s: %w", user, device, err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("storing waypoint for %s/%s: %w", user, device, err)
+	}
+
+	return inserted > 0, nil
+}
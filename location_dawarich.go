@@ -1,19 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
 	"time"
 )
 
-// dawarichPayload is the JSON body sent to POST /api/v1/owntracks/points.
+// ownTracksPayload is an OwnTracks location message, as sent to Dawarich's
+// POST /api/v1/owntracks/points and the OwnTracks Recorder's /pub.
 //
 //nolint:tagliatelle
-type dawarichPayload struct {
+type ownTracksPayload struct {
 	Type      string  `json:"_type"`
 	Latitude  float64 `json:"lat"`
 	Longitude float64 `json:"lon"`
@@ -33,36 +37,164 @@ type dawarichPayload struct {
 	TrackerID    string `json:"tid"`
 }
 
-// ForwardToDawarich drains the queue channel and forwards each location to the
-// configured Dawarich instance. It exits when the channel is closed.
-func (env *Env) ForwardToDawarich(ctx context.Context, queue <-chan MQTTMsg) {
-	slog.InfoContext(ctx, "Starting Dawarich forwarding goroutine")
+// DawarichAccount is a Dawarich API key that receives the points of one OwnTracks user,
+// or of one of their devices. Configured accounts always have a User; only the sink-wide
+// account that DawarichSink uses when no accounts are configured has an empty User, and
+// it receives the points of every user.
+//
+//nolint:tagliatelle
+type DawarichAccount struct {
+	User   string `json:"user"`
+	Device string `json:"device"`
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+}
+
+func (account DawarichAccount) String() string {
+	switch {
+	case account.User == "":
+		return "*"
+	case account.Device == "":
+		return account.User
+	default:
+		return account.User + "/" + account.Device
+	}
+}
+
+// endpoint returns the URL of a Dawarich API path, with the API key added to query.
+func (account DawarichAccount) endpoint(path string, query url.Values) string {
+	query.Set("api_key", account.APIKey)
+
+	return account.URL + path + "?" + query.Encode()
+}
+
+// DawarichSink forwards locations to Dawarich's OwnTracks-compatible points endpoint.
+// If Accounts are configured, each location goes to the account mapped to its user and
+// device, and locations from unmapped users are skipped. Otherwise everything goes to
+// URL with APIKey.
+type DawarichSink struct {
+	URL      string
+	APIKey   string
+	Accounts []DawarichAccount
+	template *template.Template
+}
+
+func newDawarichSink(config SinkConfig, tmpl *template.Template) (*DawarichSink, error) {
+	sink := &DawarichSink{URL: config.URL, APIKey: config.APIKey, template: tmpl}
+
+	for _, account := range config.Accounts {
+		if account.User == "" {
+			return nil, errors.New("dawarich account requires a user")
+		}
+
+		if account.URL == "" {
+			account.URL = config.URL
+		}
+
+		if account.URL == "" {
+			return nil, fmt.Errorf("dawarich account %s requires a url", account)
+		}
+
+		sink.Accounts = append(sink.Accounts, account)
+	}
+
+	if len(sink.Accounts) == 0 && config.URL == "" {
+		return nil, errors.New("dawarich sink requires a url")
+	}
+
+	return sink, nil
+}
+
+// parseDawarichAccounts parses a comma separated list of user[:device]=apikey[@url]
+// mappings. Accounts without a URL use the sink's.
+func parseDawarichAccounts(value string) ([]DawarichAccount, error) {
+	var accounts []DawarichAccount
+
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		owner, apiKey, found := strings.Cut(entry, "=")
+		if !found || owner == "" || apiKey == "" {
+			return nil, fmt.Errorf("invalid Dawarich account mapping %q", entry)
+		}
 
-	for {
-		msg, more := <-queue
-		if !more {
-			slog.InfoContext(ctx, "Dawarich forwarding goroutine shutting down")
+		apiKey, accountURL, found := strings.Cut(apiKey, "@")
+		if apiKey == "" || (found && accountURL == "") {
+			return nil, fmt.Errorf("invalid Dawarich account mapping %q", entry)
+		}
+
+		user, device, _ := strings.Cut(owner, ":")
+		accounts = append(accounts, DawarichAccount{
+			User:   user,
+			Device: device,
+			URL:    accountURL,
+			APIKey: apiKey,
+		})
+	}
+
+	return accounts, nil
+}
+
+// syncAccounts returns every account that points should be synced to.
+func (sink *DawarichSink) syncAccounts() []DawarichAccount {
+	if len(sink.Accounts) > 0 {
+		return sink.Accounts
+	}
+
+	return []DawarichAccount{sink.sinkAccount()}
+}
+
+// sinkAccount returns the account for the sink-wide URL and APIKey.
+func (sink *DawarichSink) sinkAccount() DawarichAccount {
+	return DawarichAccount{URL: sink.URL, APIKey: sink.APIKey}
+}
+
+// accountFor returns the account for a user and device, preferring a device-specific
+// mapping over a user-wide one.
+func (sink *DawarichSink) accountFor(user string, device string) (DawarichAccount, bool) {
+	if len(sink.Accounts) == 0 {
+		return sink.sinkAccount(), true
+	}
+
+	var (
+		userAccount DawarichAccount
+		found       bool
+	)
 
-			return
+	for _, account := range sink.Accounts {
+		if account.User != user {
+			continue
 		}
 
-		err := env.sendLocationToDawarich(ctx, msg)
-		if err != nil {
-			slog.With("err", err).
-				With("user", msg.User).
-				With("device", msg.Device).
-				With("timestamp", msg.DeviceTimestamp).
-				ErrorContext(ctx, "Failed to forward location to Dawarich")
+		if account.Device == device {
+			return account, true
+		}
+
+		if account.Device == "" && !found {
+			userAccount = account
+			found = true
 		}
 	}
+
+	return userAccount, found
 }
 
-func (env *Env) sendLocationToDawarich(ctx context.Context, msg MQTTMsg) error {
-	topic := fmt.Sprintf("owntracks/%s/%s", msg.User, msg.Device)
+// Accepts skips locations from users that have no Dawarich account.
+func (sink *DawarichSink) Accepts(msg MQTTMsg) bool {
+	_, ok := sink.accountFor(msg.User, msg.Device)
 
+	return ok
+}
+
+// newOwnTracksPayload converts a location into the OwnTracks JSON accepted by
+// Dawarich and the OwnTracks Recorder.
+func newOwnTracksPayload(msg MQTTMsg) ownTracksPayload {
 	deviceTime := time.Unix(msg.DeviceTimestampAsInt, 0).UTC()
 
-	payload := dawarichPayload{
+	return ownTracksPayload{
 		Type:         locationType,
 		Latitude:     msg.Latitude,
 		Longitude:    msg.Longitude,
@@ -75,44 +207,50 @@ func (env *Env) sendLocationToDawarich(ctx context.Context, msg MQTTMsg) error {
 		Conn:         msg.Connection,
 		Timestamp:    msg.DeviceTimestampAsInt,
 		ISOTimestamp: deviceTime.Format(time.RFC3339),
-		Topic:        topic,
+		Topic:        fmt.Sprintf("owntracks/%s/%s", msg.User, msg.Device),
 		TrackerID:    msg.TrackerID,
 	}
+}
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("marshalling Dawarich payload: %w", err)
-	}
+func (sink *DawarichSink) Send(ctx context.Context, msg MQTTMsg) error {
+	account, ok := sink.accountFor(msg.User, msg.Device)
+	if !ok {
+		slog.With("user", msg.User).
+			With("device", msg.Device).
+			DebugContext(ctx, "No Dawarich account for user, skipping")
 
-	url := fmt.Sprintf(
-		"%s/api/v1/owntracks/points?api_key=%s",
-		env.configuration.DawarichURL,
-		env.configuration.DawarichAPIKey,
-	)
+		return nil
+	}
 
-	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	return sink.sendToAccount(ctx, account, msg)
+}
 
-	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(body))
+func (sink *DawarichSink) sendToAccount(
+	ctx context.Context,
+	account DawarichAccount,
+	msg MQTTMsg,
+) error {
+	body, err := renderSinkPayload(sink.template, msg, func() ([]byte, error) {
+		return json.Marshal(newOwnTracksPayload(msg))
+	})
 	if err != nil {
-		return fmt.Errorf("creating Dawarich request: %w", err)
+		return fmt.Errorf("marshalling Dawarich payload: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	endpoint := account.endpoint("/api/v1/owntracks/points", url.Values{})
 
-	resp, err := http.DefaultClient.Do(req)
+	status, err := sendHTTPPayload(ctx, http.MethodPost, endpoint, jsonHeaders, body)
 	if err != nil {
 		return fmt.Errorf("sending to Dawarich: %w", err)
 	}
 
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("dawarich returned unexpected status %d", resp.StatusCode)
+	if status != http.StatusOK {
+		return fmt.Errorf("dawarich returned unexpected status %d", status)
 	}
 
 	slog.With("user", msg.User).
 		With("device", msg.Device).
+		With("account", account.String()).
 		DebugContext(ctx, "Forwarded location to Dawarich")
 
 	return nil
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -32,8 +33,8 @@ func testMQTTMsg() MQTTMsg {
 	}
 }
 
-func TestSendLocationToDawarich_Success(t *testing.T) {
-	var received dawarichPayload
+func TestDawarichSinkSend_Success(t *testing.T) {
+	var received ownTracksPayload
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, http.MethodPost, r.Method)
@@ -48,15 +49,10 @@ func TestSendLocationToDawarich_Success(t *testing.T) {
 	}))
 	defer server.Close()
 
-	env := &Env{
-		configuration: &Configuration{
-			DawarichURL:    server.URL,
-			DawarichAPIKey: "testkey",
-		},
-	}
+	sink := &DawarichSink{URL: server.URL, APIKey: "testkey"}
 
 	msg := testMQTTMsg()
-	err := env.sendLocationToDawarich(context.Background(), msg)
+	err := sink.Send(context.Background(), msg)
 	require.NoError(t, err)
 
 	assert.Equal(t, "location", received.Type)
@@ -70,70 +66,193 @@ func TestSendLocationToDawarich_Success(t *testing.T) {
 	assert.Equal(t, "w", received.Conn)
 }
 
-func TestSendLocationToDawarich_Non200Response(t *testing.T) {
+func TestDawarichSinkSend_Non200Response(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 	}))
 	defer server.Close()
 
-	env := &Env{
-		configuration: &Configuration{
-			DawarichURL:    server.URL,
-			DawarichAPIKey: "badkey",
-		},
-	}
+	sink := &DawarichSink{URL: server.URL, APIKey: "badkey"}
 
-	err := env.sendLocationToDawarich(context.Background(), testMQTTMsg())
+	err := sink.Send(context.Background(), testMQTTMsg())
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "401")
 }
 
-func TestSendLocationToDawarich_NetworkError(t *testing.T) {
-	env := &Env{
-		configuration: &Configuration{
-			DawarichURL:    "http://127.0.0.1:1", // nothing listening
-			DawarichAPIKey: "key",
-		},
+func TestDawarichSinkSend_NetworkError(t *testing.T) {
+	sink := &DawarichSink{
+		URL:    "http://127.0.0.1:1", // nothing listening
+		APIKey: "key",
 	}
 
-	err := env.sendLocationToDawarich(context.Background(), testMQTTMsg())
+	err := sink.Send(context.Background(), testMQTTMsg())
 	require.Error(t, err)
 }
 
-func TestForwardToDawarich_DrainAndShutdown(t *testing.T) {
-	received := make([]string, 0)
+func TestDeliverOutboxEntry(t *testing.T) {
+	status := http.StatusOK
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var p dawarichPayload
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	env := &Env{}
+	sink := &ForwardingSink{
+		Name:  "dawarich",
+		Sink:  &DawarichSink{URL: server.URL, APIKey: "key"},
+		Retry: RetryConfig{MaxAge: configDuration(time.Hour)}.policy(),
+	}
+
+	now := time.Now()
+	entry := outboxEntry{ID: 1, Payload: testMQTTMsg(), CreatedAt: now.Add(-time.Minute)}
+
+	outcome, err := env.deliverOutboxEntry(context.Background(), sink, entry, now)
+	require.NoError(t, err)
+	assert.Equal(t, outboxDelivered, outcome)
+
+	status = http.StatusServiceUnavailable
+
+	outcome, err = env.deliverOutboxEntry(context.Background(), sink, entry, now)
+	require.Error(t, err)
+	assert.Equal(t, outboxRetry, outcome)
+
+	entry.CreatedAt = now.Add(-2 * time.Hour)
+
+	outcome, err = env.deliverOutboxEntry(context.Background(), sink, entry, now)
+	require.Error(t, err)
+	assert.Equal(t, outboxAbandoned, outcome)
+}
+
+func TestOutboxPayloadRoundTrip(t *testing.T) {
+	msg := testMQTTMsg()
+
+	payload, err := json.Marshal(msg)
+	require.NoError(t, err)
+
+	var decoded MQTTMsg
+
+	require.NoError(t, json.Unmarshal(payload, &decoded))
+	assert.Equal(t, msg.User, decoded.User)
+	assert.Equal(t, msg.Device, decoded.Device)
+	assert.Equal(t, msg.TrackerID, decoded.TrackerID)
+	assert.True(t, msg.DeviceTimestamp.Equal(decoded.DeviceTimestamp))
+}
+
+func TestDawarichSinkAccountFor(t *testing.T) {
+	sink := &DawarichSink{
+		URL: "http://dawarich",
+		Accounts: []DawarichAccount{
+			{User: "alice", URL: "http://dawarich", APIKey: "alice-key"},
+			{User: "alice", Device: "ipad", URL: "http://other", APIKey: "alice-ipad-key"},
+			{User: "bob", URL: "http://dawarich", APIKey: "bob-key"},
+		},
+	}
+
+	account, ok := sink.accountFor("alice", "iphone")
+	require.True(t, ok)
+	assert.Equal(t, "alice-key", account.APIKey)
+
+	account, ok = sink.accountFor("alice", "ipad")
+	require.True(t, ok)
+	assert.Equal(t, "alice-ipad-key", account.APIKey)
+	assert.Equal(t, "http://other", account.URL)
+
+	_, ok = sink.accountFor("carol", "phone")
+	assert.False(t, ok)
 
-		_ = json.NewDecoder(r.Body).Decode(&p)
-		received = append(received, p.Topic)
+	assert.False(t, sink.Accepts(MQTTMsg{User: "carol"}))
+}
+
+func TestDawarichSinkSendUsesMappedAccount(t *testing.T) {
+	var keys []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.URL.Query().Get("api_key"))
 
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer server.Close()
 
-	env := &Env{
-		configuration: &Configuration{
-			DawarichURL:    server.URL,
-			DawarichAPIKey: "key",
-		},
+	accounts, err := parseDawarichAccounts("alice=alice-key, bob:android=bob-key")
+	require.NoError(t, err)
+
+	sink, err := newDawarichSink(SinkConfig{URL: server.URL, Accounts: accounts}, nil)
+	require.NoError(t, err)
+
+	alice := testMQTTMsg()
+	bob := testMQTTMsg()
+	bob.User = "bob"
+	bob.Device = "android"
+	bobsOtherDevice := testMQTTMsg()
+	bobsOtherDevice.User = "bob"
+
+	for _, msg := range []MQTTMsg{alice, bob, bobsOtherDevice} {
+		require.NoError(t, sink.Send(context.Background(), msg))
 	}
 
-	queue := make(chan MQTTMsg, 5)
+	assert.Equal(t, []string{"alice-key", "bob-key"}, keys)
+}
+
+func TestParseDawarichAccountsRejectsInvalidMapping(t *testing.T) {
+	_, err := parseDawarichAccounts("alice")
+	require.Error(t, err)
+
+	_, err = parseDawarichAccounts("=key")
+	require.Error(t, err)
+
+	_, err = parseDawarichAccounts("alice=key@")
+	require.Error(t, err)
+
+	_, err = parseDawarichAccounts("alice=@http://dawarich")
+	require.Error(t, err)
+}
+
+func TestParseDawarichAccountsWithURL(t *testing.T) {
+	accounts, err := parseDawarichAccounts("alice=alice-key, bob:android=bob-key@http://other:3000")
+	require.NoError(t, err)
+
+	assert.Equal(t, []DawarichAccount{
+		{User: "alice", APIKey: "alice-key"},
+		{User: "bob", Device: "android", URL: "http://other:3000", APIKey: "bob-key"},
+	}, accounts)
+
+	sink, err := newDawarichSink(SinkConfig{URL: "http://dawarich", Accounts: accounts}, nil)
+	require.NoError(t, err)
+
+	account, ok := sink.accountFor("alice", "iphone")
+	require.True(t, ok)
+	assert.Equal(t, "http://dawarich", account.URL)
+
+	account, ok = sink.accountFor("bob", "android")
+	require.True(t, ok)
+	assert.Equal(t, "http://other:3000", account.URL)
+}
 
-	msg1 := testMQTTMsg()
-	msg2 := testMQTTMsg()
-	msg2.User = "bob"
-	msg2.Device = "android"
+func TestDawarichSinkAccountWithoutMappings(t *testing.T) {
+	sink, err := newDawarichSink(SinkConfig{URL: "http://dawarich", APIKey: "key"}, nil)
+	require.NoError(t, err)
 
-	queue <- msg1
+	account, ok := sink.accountFor("alice", "iphone")
+	require.True(t, ok)
+	assert.Equal(t, "key", account.APIKey)
+	assert.Equal(t, "*", account.String())
+	assert.Equal(t, []DawarichAccount{account}, sink.syncAccounts())
 
-	queue <- msg2
+	_, err = newDawarichSink(SinkConfig{
+		URL:      "http://dawarich",
+		Accounts: []DawarichAccount{{APIKey: "key"}},
+	}, nil)
+	require.Error(t, err)
+}
 
-	close(queue)
+func TestDawarichAccountEndpointEscapesAPIKey(t *testing.T) {
+	account := DawarichAccount{URL: "http://dawarich", APIKey: "a&b=c d"}
 
-	env.ForwardToDawarich(context.Background(), queue)
+	endpoint, err := url.Parse(account.endpoint("/api/v1/points", url.Values{"page": {"2"}}))
+	require.NoError(t, err)
 
-	assert.Equal(t, []string{"owntracks/alice/iphone", "owntracks/bob/android"}, received)
+	assert.Equal(t, "/api/v1/points", endpoint.Path)
+	assert.Equal(t, "a&b=c d", endpoint.Query().Get("api_key"))
+	assert.Equal(t, "2", endpoint.Query().Get("page"))
 }
@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -28,24 +30,131 @@ type NominatimReverseGeocodeResult struct {
 	Lon         string `json:"lon"`
 	DisplayName string `json:"display_name"`
 	Address     struct {
-		HouseNumber  string `json:"house_number"`
-		Road         string `json:"road"`
-		Suburb       string `json:"suburb"`
-		Village      string `json:"village"`
-		Town         string `json:"town"`
-		City         string `json:"city"`
-		Municipality string `json:"municipality"`
-		County       string `json:"county"`
-		State        string `json:"state"`
-		Postcode     string `json:"postcode"`
-		Country      string `json:"country"`
-		CountryCode  string `json:"country_code"`
+		HouseNumber   string `json:"house_number"`
+		Road          string `json:"road"`
+		Neighbourhood string `json:"neighbourhood"`
+		Quarter       string `json:"quarter"`
+		Suburb        string `json:"suburb"`
+		Hamlet        string `json:"hamlet"`
+		Village       string `json:"village"`
+		Town          string `json:"town"`
+		City          string `json:"city"`
+		Municipality  string `json:"municipality"`
+		County        string `json:"county"`
+		State         string `json:"state"`
+		Region        string `json:"region"`
+		Postcode      string `json:"postcode"`
+		Country       string `json:"country"`
+		CountryCode   string `json:"country_code"`
 	} `json:"address"`
 	BoundingBox []string `json:"boundingbox"`
 }
 
-// GeocodedName extracts a sane name from the geocoded name component.
-func (location *Location) GeocodedName(ctx context.Context) string {
+// NormalisedAddress is a reverse geocoding result reduced to one value per level of
+// detail, whichever of Nominatim's alternative keys for that level it came from.
+//
+//nolint:tagliatelle
+type NormalisedAddress struct {
+	DisplayName   string `json:"display_name"`
+	HouseNumber   string `json:"house_number,omitempty"`
+	Road          string `json:"road,omitempty"`
+	Neighbourhood string `json:"neighbourhood,omitempty"`
+	City          string `json:"city,omitempty"`
+	Region        string `json:"region,omitempty"`
+	Postcode      string `json:"postcode,omitempty"`
+	Country       string `json:"country,omitempty"`
+	CountryCode   string `json:"country_code,omitempty"`
+}
+
+// Normalised reduces a reverse geocoding result to a NormalisedAddress.
+func (result NominatimReverseGeocodeResult) Normalised() NormalisedAddress {
+	address := result.Address
+
+	return NormalisedAddress{
+		DisplayName:   result.DisplayName,
+		HouseNumber:   address.HouseNumber,
+		Road:          address.Road,
+		Neighbourhood: firstNonEmpty(address.Neighbourhood, address.Suburb, address.Quarter, address.Hamlet),
+		City:          firstNonEmpty(address.City, address.Town, address.Village, address.Municipality),
+		Region:        firstNonEmpty(address.State, address.Region, address.County),
+		Postcode:      address.Postcode,
+		Country:       address.Country,
+		CountryCode:   address.CountryCode,
+	}
+}
+
+// PlacePrecision controls how much detail about a location is published.
+type PlacePrecision string
+
+const (
+	PlacePrecisionAddress       PlacePrecision = "address"
+	PlacePrecisionNeighbourhood PlacePrecision = "neighbourhood"
+	PlacePrecisionCity          PlacePrecision = "city"
+	PlacePrecisionRegion        PlacePrecision = "region"
+	PlacePrecisionCountry       PlacePrecision = "country"
+)
+
+// Decode implements envconfig.Decoder so that invalid precisions are rejected at startup.
+func (precision *PlacePrecision) Decode(value string) error {
+	switch candidate := PlacePrecision(strings.ToLower(value)); candidate {
+	case PlacePrecisionAddress,
+		PlacePrecisionNeighbourhood,
+		PlacePrecisionCity,
+		PlacePrecisionRegion,
+		PlacePrecisionCountry:
+		*precision = candidate
+
+		return nil
+	default:
+		return fmt.Errorf("invalid place precision %q", value)
+	}
+}
+
+// CoordinateDecimals is the number of decimal places that coordinates are rounded to
+// at this precision, roughly matching the size of the named area.
+func (precision PlacePrecision) CoordinateDecimals() int {
+	switch precision {
+	case PlacePrecisionAddress:
+		return 4
+	case PlacePrecisionNeighbourhood:
+		return 3
+	case PlacePrecisionRegion:
+		return 1
+	case PlacePrecisionCountry:
+		return 0
+	case PlacePrecisionCity:
+		fallthrough
+	default:
+		return 2
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func joinNonEmpty(values ...string) string {
+	var parts []string
+
+	for _, value := range values {
+		if value != "" {
+			parts = append(parts, value)
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// GeocodedName extracts a sane name from the geocoded name component at the given
+// precision. Where the requested level is missing, coarser levels are used instead,
+// never finer ones.
+func (location *Location) GeocodedName(ctx context.Context, precision PlacePrecision) string {
 	unknownLocation := "Unknown"
 
 	var geoLocation NominatimReverseGeocodeResult
@@ -59,28 +168,54 @@ func (location *Location) GeocodedName(ctx context.Context) string {
 		return unknownLocation
 	}
 
-	// Try to extract a meaningful location name
-	if geoLocation.Address.City != "" {
-		return geoLocation.Address.City
-	}
+	address := geoLocation.Address
+	country := address.Country
+	region := firstNonEmpty(address.State, address.Region, address.County)
+	city := firstNonEmpty(
+		address.City,
+		address.Town,
+		address.Village,
+		address.Municipality,
+		address.County,
+	)
+	neighbourhood := firstNonEmpty(
+		address.Neighbourhood,
+		address.Suburb,
+		address.Quarter,
+		address.Hamlet,
+	)
 
-	if geoLocation.Address.Town != "" {
-		return geoLocation.Address.Town
+	// Each precision is followed by the coarser levels to fall back to if it's missing
+	var names []string
+
+	switch precision {
+	case PlacePrecisionAddress:
+		street := strings.TrimSpace(address.HouseNumber + " " + address.Road)
+		names = []string{joinNonEmpty(street, city), region, country}
+	case PlacePrecisionNeighbourhood:
+		names = []string{joinNonEmpty(neighbourhood, city), region, country}
+	case PlacePrecisionRegion:
+		names = []string{region, country}
+	case PlacePrecisionCountry:
+		names = []string{country}
+	case PlacePrecisionCity:
+		fallthrough
+	default:
+		names = []string{city, region, country}
 	}
 
-	if geoLocation.Address.Village != "" {
-		return geoLocation.Address.Village
-	}
+	name := firstNonEmpty(names...)
 
-	if geoLocation.Address.Municipality != "" {
-		return geoLocation.Address.Municipality
+	// Locations redacted to a privacy zone only have its label
+	if name == "" && address == (NominatimReverseGeocodeResult{}).Address {
+		name = geoLocation.DisplayName
 	}
 
-	if geoLocation.Address.County != "" {
-		return geoLocation.Address.County
+	if name == "" {
+		return unknownLocation
 	}
 
-	return unknownLocation
+	return name
 }
 
 func (env *Env) GetGeocoding(
@@ -102,12 +237,12 @@ func (env *Env) GetGeocoding(
 	}
 
 	// Build Nominatim search URL
-	// Format: https://nominatim.example.com/search?q=PLACE&format=geojson
+	// Format: https://nominatim.example.com/search?q=PLACE&format=geojson&polygon_geojson=1
 	geocodingURL := fmt.Sprintf(
-		"%s/reverse?q=%s&format=geojson&addressdetails=1",
+		"%s/search?q=%s&format=geojson&polygon_geojson=1&addressdetails=1&limit=1",
 		env.configuration.GeocodeAPIURL,
 		url.QueryEscape(place),
-	)
+	) + env.acceptLanguageParameter()
 
 	geocodingResponse, err := fetchGeocodingResponse(ctx, geocodingURL)
 	if err != nil {
@@ -122,6 +257,16 @@ func (env *Env) GetGeocoding(
 	return featureCollection, nil
 }
 
+// acceptLanguageParameter returns the Nominatim accept-language query parameter for the
+// configured geocoding language, or an empty string if none is set.
+func (env *Env) acceptLanguageParameter() string {
+	if env.configuration.GeocodeLanguage == "" {
+		return ""
+	}
+
+	return "&accept-language=" + url.QueryEscape(env.configuration.GeocodeLanguage)
+}
+
 func RoundCoordinate(input float64) float64 {
 	rounded, err := strconv.ParseFloat(fmt.Sprintf("%.5f", input), 64)
 	if err != nil {
@@ -136,6 +281,13 @@ func RoundCoordinate(input float64) float64 {
 
 var reverseGeocodeCache = cache.New(cache.NoExpiration, 0)
 
+// reverseGeocodeCacheKey keys reverse geocoding results by rounded coordinates and the
+// language they were requested in, so that changing GeocodeLanguage doesn't reuse
+// addresses in the old language.
+func reverseGeocodeCacheKey(latitude float64, longitude float64, language string) string {
+	return fmt.Sprintf("%v,%v,%s", RoundCoordinate(latitude), RoundCoordinate(longitude), language)
+}
+
 func (location *Location) GetReverseGeocoding(ctx context.Context, env *Env) (string, error) {
 	if env.configuration.ReverseGeocodeAPIURL == "" {
 		err := errors.New("reverse Geocoding API should not be blank")
@@ -144,10 +296,10 @@ func (location *Location) GetReverseGeocoding(ctx context.Context, env *Env) (st
 		return "", err
 	}
 
-	cacheKey := fmt.Sprintf(
-		"%v%v",
-		RoundCoordinate(location.Latitude),
-		RoundCoordinate(location.Longitude),
+	cacheKey := reverseGeocodeCacheKey(
+		location.Latitude,
+		location.Longitude,
+		env.configuration.GeocodeLanguage,
 	)
 
 	if value, present := reverseGeocodeCache.Get(cacheKey); present {
@@ -170,7 +322,7 @@ func (location *Location) GetReverseGeocoding(ctx context.Context, env *Env) (st
 		env.configuration.ReverseGeocodeAPIURL,
 		location.Latitude,
 		location.Longitude,
-	)
+	) + env.acceptLanguageParameter()
 
 	geocodingResponse, err := fetchGeocodingResponse(ctx, geocodingURL)
 	slog.With("url", geocodingURL).
@@ -195,10 +347,87 @@ func (location *Location) GetReverseGeocoding(ctx context.Context, env *Env) (st
 	}
 
 	reverseGeocodeCache.Set(cacheKey, string(geocodingJSON), 0)
+	notifyLive(ctx, liveNotification{Geocode: &liveGeocode{Key: cacheKey, Geocoding: string(geocodingJSON)}})
 
 	return string(geocodingJSON), nil
 }
 
+// reverseGeocodeResponse is the response of ReverseGeocodeHandler. The coordinates are
+// rounded as they are in the reverse geocoding cache key.
+type reverseGeocodeResponse struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	NormalisedAddress
+}
+
+// validCoordinate returns whether a latitude or longitude is a finite number within
+// ±limit degrees.
+func validCoordinate(value float64, limit float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0) && value >= -limit && value <= limit
+}
+
+// parseCoordinate parses a latitude or longitude that must be within ±limit degrees.
+// ParseFloat accepts "NaN" and "Inf", which aren't coordinates.
+func parseCoordinate(name string, value string, limit float64) (float64, error) {
+	coordinate, err := strconv.ParseFloat(value, 64)
+	if err != nil || !validCoordinate(coordinate, limit) {
+		return 0, fmt.Errorf("%s %q should be a number between -%v and %v", name, value, limit, limit)
+	}
+
+	return coordinate, nil
+}
+
+// ReverseGeocodeHandler returns the normalised address of the lat and lon query
+// parameters. Coordinates that round to one already looked up are answered from the
+// reverse geocoding cache without calling the provider.
+func (env *Env) ReverseGeocodeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	latitude, err := parseCoordinate("lat", r.URL.Query().Get("lat"), 90)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	longitude, err := parseCoordinate("lon", r.URL.Query().Get("lon"), 180)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if env.configuration.ReverseGeocodeAPIURL == "" {
+		http.Error(w, "Reverse geocoding isn't configured", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	location := Location{Latitude: latitude, Longitude: longitude}
+
+	geocoding, err := location.GetReverseGeocoding(ctx, env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	var result NominatimReverseGeocodeResult
+
+	err = json.Unmarshal([]byte(geocoding), &result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	respondJSON(w, reverseGeocodeResponse{
+		Latitude:          RoundCoordinate(latitude),
+		Longitude:         RoundCoordinate(longitude),
+		NormalisedAddress: result.Normalised(),
+	})
+}
+
 func fetchGeocodingResponse(ctx context.Context, geocodingURL string) (string, error) {
 	defer timeTrack(ctx, time.Now())
 
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -36,7 +41,7 @@ func TestGeocodingShouldDecodeLocalityToTheRightName(t *testing.T) {
   ]
 }`
 	location := Location{Geocoding: testlocation}
-	name := location.GeocodedName(t.Context())
+	name := location.GeocodedName(t.Context(), PlacePrecisionCity)
 	require.Equal(t, "Münster", name)
 }
 
@@ -51,3 +56,149 @@ func TestRoundCoordinate(t *testing.T) {
 		require.InEpsilon(t, expected, RoundCoordinate(input), 0.0001)
 	}
 }
+
+func TestGeocodedNameAtEachPrecision(t *testing.T) {
+	geocoding := `{"address": {
+    "house_number": "10",
+    "road": "Downing Street",
+    "suburb": "Westminster",
+    "city": "London",
+    "state": "England",
+    "country": "United Kingdom"
+  }}`
+	location := Location{Geocoding: geocoding}
+
+	expected := map[PlacePrecision]string{
+		PlacePrecisionAddress:       "10 Downing Street, London",
+		PlacePrecisionNeighbourhood: "Westminster, London",
+		PlacePrecisionCity:          "London",
+		PlacePrecisionRegion:        "England",
+		PlacePrecisionCountry:       "United Kingdom",
+	}
+	for precision, name := range expected {
+		require.Equal(t, name, location.GeocodedName(t.Context(), precision), precision)
+	}
+}
+
+func TestGeocodedNameFallsBackToCoarserLevel(t *testing.T) {
+	location := Location{Geocoding: `{"address": {"village": "Little Snoring", "country": "United Kingdom"}}`}
+
+	require.Equal(t, "Little Snoring", location.GeocodedName(t.Context(), PlacePrecisionNeighbourhood))
+	require.Equal(t, "United Kingdom", location.GeocodedName(t.Context(), PlacePrecisionRegion))
+}
+
+func TestGeocodedNameNeverFallsBackToFinerLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   string
+		precision PlacePrecision
+		expected  string
+	}{
+		{"region without region", `{"city": "London", "country": "United Kingdom"}`, PlacePrecisionRegion, "United Kingdom"},
+		{"region with only city", `{"city": "London"}`, PlacePrecisionRegion, "Unknown"},
+		{"city without city", `{"road": "High Street", "state": "England"}`, PlacePrecisionCity, "England"},
+		{"city with only road", `{"road": "High Street"}`, PlacePrecisionCity, "Unknown"},
+		{"country without country", `{"city": "London", "state": "England"}`, PlacePrecisionCountry, "Unknown"},
+		{"neighbourhood with only region", `{"state": "England"}`, PlacePrecisionNeighbourhood, "England"},
+	}
+
+	for _, test := range tests {
+		location := Location{Geocoding: `{"address": ` + test.address + `}`}
+		assert.Equal(t, test.expected, location.GeocodedName(t.Context(), test.precision), test.name)
+	}
+}
+
+func TestPlacePrecisionDecode(t *testing.T) {
+	var precision PlacePrecision
+
+	require.NoError(t, precision.Decode("Neighbourhood"))
+	require.Equal(t, PlacePrecisionNeighbourhood, precision)
+	require.Equal(t, 3, precision.CoordinateDecimals())
+	require.Error(t, precision.Decode("street"))
+}
+
+func TestReverseGeocodeHandlerCachesLookups(t *testing.T) {
+	var requests atomic.Int32
+
+	nominatim := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		assert.Equal(t, "/reverse", r.URL.Path)
+		_, _ = w.Write([]byte(`{"display_name": "Tower Bridge, London", "address": {"road": "Tower Bridge",
+ "suburb": "Bermondsey", "city": "London", "state": "England", "country": "United Kingdom",
+ "country_code": "gb"}}`))
+	}))
+	t.Cleanup(nominatim.Close)
+
+	env := Env{configuration: &Configuration{ReverseGeocodeAPIURL: nominatim.URL}}
+	router := env.BuildRoutes(env.configuration)
+
+	for _, query := range []string{"lat=51.5054564&lon=-0.0753565", "lat=51.505458&lon=-0.075358"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/0/q?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response reverseGeocodeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, reverseGeocodeResponse{
+			Latitude:  51.50546,
+			Longitude: -0.07536,
+			NormalisedAddress: NormalisedAddress{
+				DisplayName:   "Tower Bridge, London",
+				Road:          "Tower Bridge",
+				Neighbourhood: "Bermondsey",
+				City:          "London",
+				Region:        "England",
+				Country:       "United Kingdom",
+				CountryCode:   "gb",
+			},
+		}, response)
+	}
+
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestReverseGeocodingCacheIsPerLanguage(t *testing.T) {
+	var languages []string
+
+	nominatim := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		language := r.URL.Query().Get("accept-language")
+		languages = append(languages, language)
+		_, _ = w.Write([]byte(`{"display_name": "` + language + `"}`))
+	}))
+	t.Cleanup(nominatim.Close)
+
+	location := Location{Latitude: 48.85837, Longitude: 2.29448}
+
+	for _, language := range []string{"en", "fr", "en"} {
+		t.Cleanup(func() {
+			reverseGeocodeCache.Delete(reverseGeocodeCacheKey(location.Latitude, location.Longitude, language))
+		})
+
+		env := Env{configuration: &Configuration{ReverseGeocodeAPIURL: nominatim.URL, GeocodeLanguage: language}}
+
+		geocoding, err := location.GetReverseGeocoding(t.Context(), &env)
+		require.NoError(t, err)
+		assert.Contains(t, geocoding, `"display_name":"`+language+`"`)
+	}
+
+	assert.Equal(t, []string{"en", "fr"}, languages)
+}
+
+func TestReverseGeocodeHandlerRejectsBadRequests(t *testing.T) {
+	env := Env{configuration: &Configuration{}}
+	router := env.BuildRoutes(env.configuration)
+
+	for query, code := range map[string]int{
+		"lat=51.5":           http.StatusBadRequest,
+		"lat=91&lon=0":       http.StatusBadRequest,
+		"lat=0&lon=east":     http.StatusBadRequest,
+		"lat=NaN&lon=0":      http.StatusBadRequest,
+		"lat=0&lon=-Inf":     http.StatusBadRequest,
+		"lat=Infinity&lon=0": http.StatusBadRequest,
+		"lat=51.5&lon=-0.1":  http.StatusServiceUnavailable,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/0/q?"+query, nil))
+		assert.Equal(t, code, w.Code, query)
+	}
+}
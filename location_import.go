@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	locationInsertColumns = `timestamp, devicetimestamp, accuracy, doze, batterylevel, connectiontype, point, altitude,
+ verticalaccuracy, speed, "user", device, cog, tid, motionactivities`
+	locationInsertParams = 16
+	importBatchSize      = 1000
+	importProgressEvery  = 10 * time.Second
+)
+
+// locationInsertQuery returns an insert statement for the given number of locations.
+// Locations that violate the table's uniqueness constraints are skipped rather than
+// raising an error, and the ids of the inserted rows are returned.
+func locationInsertQuery(rows int) string {
+	values := make([]string, 0, rows)
+
+	for row := range rows {
+		base := row * locationInsertParams
+		values = append(values, fmt.Sprintf(
+			"($%d, $%d, $%d, $%d, $%d, $%d, ST_SetSRID(ST_MakePoint($%d, $%d), 4326), $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			base+1, base+2, base+3, base+4, base+5, base+6, base+7,
+			base+8, base+9, base+10, base+11, base+12, base+13, base+14, base+15, base+16,
+		))
+	}
+
+	return "insert into locations (" + locationInsertColumns + ")\nvalues " +
+		strings.Join(values, ",\n       ") +
+		"\non conflict do nothing\nRETURNING id"
+}
+
+// locationImportQuery is locationInsertQuery returning enough of each inserted row to
+// tell which of the locations it was.
+func locationImportQuery(rows int) string {
+	return locationInsertQuery(rows) + `, "user", device, devicetimestamp, ST_Y(point::geometry), ST_X(point::geometry)`
+}
+
+// importedLocation identifies a location in an import batch by the columns that
+// locationImportQuery returns.
+type importedLocation struct {
+	User      string
+	Device    string
+	Timestamp int64
+	Latitude  float64
+	Longitude float64
+}
+
+func newImportedLocation(msg MQTTMsg) importedLocation {
+	return importedLocation{
+		User:   msg.User,
+		Device: msg.Device,
+		// Postgres keeps timestamps to the nearest microsecond
+		Timestamp: msg.DeviceTimestamp.Round(time.Microsecond).UnixMicro(),
+		Latitude:  msg.Latitude,
+		Longitude: msg.Longitude,
+	}
+}
+
+// locationInsertArgs returns the arguments for one location in locationInsertQuery.
+func locationInsertArgs(receivedAt time.Time, msg MQTTMsg) []any {
+	return []any{
+		receivedAt,
+		msg.DeviceTimestamp,
+		msg.Accuracy,
+		bool(msg.Doze),
+		msg.Battery,
+		msg.Connection,
+		msg.Longitude,
+		msg.Latitude,
+		msg.Altitude,
+		msg.VerticalAccuracy,
+		msg.Speed,
+		msg.User,
+		msg.Device,
+		msg.Course,
+		nullIfEmpty(msg.TrackerID),
+		pq.Array(msg.MotionActivities),
+	}
+}
+
+// ImportStats counts the outcome of a bulk import.
+type ImportStats struct {
+	Inserted   int `json:"inserted"`
+	Duplicates int `json:"duplicates"`
+	Invalid    int `json:"invalid"`
+	// Untimed counts KML LineString points skipped because nothing gave them a time
+	Untimed int `json:"untimed,omitempty"`
+}
+
+// locationImporter bulk-inserts locations in batches, skipping duplicates in the same
+// way as insertToDatabase, and periodically logs progress.
+type locationImporter struct {
+	database   *sql.DB
+	source     string
+	pending    []MQTTMsg
+	stats      ImportStats
+	lastReport time.Time
+}
+
+func (env *Env) newLocationImporter(source string) *locationImporter {
+	return &locationImporter{
+		database:   env.database,
+		source:     source,
+		pending:    make([]MQTTMsg, 0, importBatchSize),
+		lastReport: time.Now(),
+	}
+}
+
+// Add queues a location, inserting the queued batch once it is full.
+func (importer *locationImporter) Add(ctx context.Context, msg MQTTMsg) error {
+	if msg.DeviceTimestamp.IsZero() {
+		msg.DeviceTimestamp = time.Unix(msg.DeviceTimestampAsInt, 0)
+	}
+
+	importer.pending = append(importer.pending, msg)
+
+	if len(importer.pending) >= importBatchSize {
+		return importer.Flush(ctx)
+	}
+
+	return nil
+}
+
+// Flush inserts any queued locations, and publishes the ones that are new to live
+// subscribers as insertToDatabase does.
+func (importer *locationImporter) Flush(ctx context.Context) error {
+	if len(importer.pending) == 0 {
+		return nil
+	}
+
+	defer timeTrack(ctx, time.Now())
+
+	events, err := importer.insertPending(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		liveLocations.Publish(event)
+	}
+
+	inserted := len(events)
+	importer.stats.Inserted += inserted
+	importer.stats.Duplicates += len(importer.pending) - inserted
+	importer.pending = importer.pending[:0]
+
+	if time.Since(importer.lastReport) >= importProgressEvery {
+		importer.lastReport = time.Now()
+		slog.With("source", importer.source).
+			With("inserted", importer.stats.Inserted).
+			With("duplicates", importer.stats.Duplicates).
+			InfoContext(ctx, "Import progress")
+	}
+
+	return nil
+}
+
+// insertPending inserts the queued locations in a transaction that also announces them
+// to other instances, returning the events for those that were inserted.
+//
+//nolint:funlen
+func (importer *locationImporter) insertPending(ctx context.Context) ([]liveEvent, error) {
+	receivedAt := time.Now()
+	args := make([]any, 0, len(importer.pending)*locationInsertParams)
+	pending := make(map[importedLocation]MQTTMsg, len(importer.pending))
+
+	for _, msg := range importer.pending {
+		args = append(args, locationInsertArgs(receivedAt, msg)...)
+		pending[newImportedLocation(msg)] = msg
+	}
+
+	tx, err := importer.database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning import transaction: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, locationImportQuery(len(importer.pending)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("inserting imported locations: %w", err)
+	}
+
+	var events []liveEvent
+
+	for rows.Next() {
+		var (
+			id        int
+			inserted  importedLocation
+			timestamp time.Time
+		)
+
+		err = rows.Scan(&id, &inserted.User, &inserted.Device, &timestamp, &inserted.Latitude, &inserted.Longitude)
+		if err != nil {
+			_ = rows.Close()
+
+			return nil, fmt.Errorf("scanning imported location: %w", err)
+		}
+
+		inserted.Timestamp = timestamp.UnixMicro()
+
+		msg, ok := pending[inserted]
+		if !ok {
+			// The row still says enough about the location to announce it
+			msg = MQTTMsg{
+				User:            inserted.User,
+				Device:          inserted.Device,
+				Latitude:        inserted.Latitude,
+				Longitude:       inserted.Longitude,
+				DeviceTimestamp: timestamp,
+			}
+		}
+
+		events = append(events, newLiveEvent(id, msg))
+	}
+
+	_ = rows.Close()
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("inserting imported locations: %w", rows.Err())
+	}
+
+	err = notifyLiveEvents(ctx, tx, events)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("committing imported locations: %w", err)
+	}
+
+	return events, nil
+}
+
+// Close flushes any queued locations and returns the final counts.
+func (importer *locationImporter) Close(ctx context.Context) (ImportStats, error) {
+	err := importer.Flush(ctx)
+
+	slog.With("source", importer.source).
+		With("inserted", importer.stats.Inserted).
+		With("duplicates", importer.stats.Duplicates).
+		InfoContext(ctx, "Import finished")
+
+	return importer.stats, err
+}
@@ -33,6 +33,7 @@ type MQTTMsg struct {
 	Speed                float32            `json:"vel"`
 	Altitude             float32            `json:"alt"`
 	Course               int                `json:"cog"`
+	MotionActivities     []string           `json:"motionactivities,omitempty"`
 	DeviceTimestampAsInt int64              `json:"tst"   binding:"required"`
 	DeviceTimestamp      time.Time
 	User                 string
@@ -146,6 +147,40 @@ var reconnectingHandler mqtt.ReconnectHandler = func(_ mqtt.Client, _ *mqtt.Clie
 	slog.InfoContext(context.Background(), "MQTT Reconnecting")
 }
 
+// topicOwner returns the user and device that published to an OwnTracks topic: the
+// last two levels of the device's base topic, or the only level after the prefix.
+// Subtopics such as event and status are ignored.
+func topicOwner(topic string) (string, string) {
+	topicParts := strings.Split(topic, "/")
+
+	if len(topicParts) > 3 && slices.Contains([]string{"event", "status"}, topicParts[len(topicParts)-1]) {
+		topicParts = topicParts[:len(topicParts)-1]
+	}
+
+	if len(topicParts) == 2 {
+		return topicParts[1], ""
+	} else if len(topicParts) > 2 {
+		return topicParts[len(topicParts)-2], topicParts[len(topicParts)-1]
+	}
+
+	return "", ""
+}
+
+// publishLiveMessage publishes a message that isn't stored, such as a transition, to
+// live subscribers on every instance.
+func (env *Env) publishLiveMessage(ctx context.Context, messageType string, msg mqtt.Message) {
+	user, device := topicOwner(msg.Topic())
+
+	if env.configuration.FilterUsers != "" && !filterUsersContainsUser(env.configuration.FilterUsers, user) {
+		return
+	}
+
+	slog.With("msgType", messageType).With("user", user).With("device", device).
+		DebugContext(ctx, "Publishing live message")
+
+	publishLiveEvent(ctx, liveEvent{Type: messageType, User: user, Device: device, Payload: msg.Payload()})
+}
+
 func filterUsersContainsUser(filterUsers string, user string) bool {
 	return slices.Contains(strings.Split(filterUsers, ","), user)
 }
@@ -170,6 +205,14 @@ func (env *Env) mqttMessageHandler(_ mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
+	if locationMessage.Type == transitionType || locationMessage.Type == statusType ||
+		locationMessage.Type == lwtType {
+		env.publishLiveMessage(ctx, locationMessage.Type, msg)
+		msg.Ack()
+
+		return
+	}
+
 	if locationMessage.Type != locationType {
 		slog.With("msgType", locationMessage.Type).
 			With("topic", msg.Topic()).
@@ -180,14 +223,7 @@ func (env *Env) mqttMessageHandler(_ mqtt.Client, msg mqtt.Message) {
 	}
 
 	locationMessage.DeviceTimestamp = time.Unix(locationMessage.DeviceTimestampAsInt, 0)
-	topicParts := strings.Split(msg.Topic(), "/")
-
-	if len(topicParts) == 2 {
-		locationMessage.User = topicParts[1]
-	} else if len(topicParts) > 2 {
-		locationMessage.Device = topicParts[len(topicParts)-1]
-		locationMessage.User = topicParts[len(topicParts)-2]
-	}
+	locationMessage.User, locationMessage.Device = topicOwner(msg.Topic())
 
 	if env.configuration.FilterUsers != "" &&
 		!filterUsersContainsUser(env.configuration.FilterUsers, locationMessage.User) {
@@ -213,6 +249,7 @@ func (env *Env) mqttMessageHandler(_ mqtt.Client, msg mqtt.Message) {
 			err2 := insertToDatabase(ctx,
 				env.configuration.GeocodeOnInsert,
 				env.configuration.EnablePrometheus,
+				env.sinks,
 				env.metrics,
 				locationMessage,
 				msg,
@@ -239,6 +276,7 @@ func insertToDatabase(
 	ctx context.Context,
 	geoCodeOnInsert bool,
 	enablePrometheus bool,
+	sinks []*ForwardingSink,
 	metrics *Metrics,
 	locationMessage MQTTMsg,
 	msg mqtt.Message,
@@ -249,32 +287,22 @@ func insertToDatabase(
 	defer timeTrack(ctx, time.Now())
 	defer cancelFn()
 
-	dozeBoolean := bool(locationMessage.Doze)
-
 	var lastInsertID int
 
-	err := database.QueryRowContext(
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(ctx, "Unable to begin location insert transaction")
+
+		return err
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	err = tx.QueryRowContext(
 		ctx,
-		`insert into locations
-(timestamp, devicetimestamp, accuracy, doze, batterylevel, connectiontype, point, altitude, verticalaccuracy, speed,
- "user", device, cog)
-values ($1, $2, $3, $4, $5, $6, ST_SetSRID(ST_MakePoint($7, $8), 4326), $9, $10, $11, $12, $13, $14)
-RETURNING id`,
-
-		time.Now(),
-		locationMessage.DeviceTimestamp,
-		locationMessage.Accuracy,
-		dozeBoolean,
-		locationMessage.Battery,
-		locationMessage.Connection,
-		locationMessage.Longitude,
-		locationMessage.Latitude,
-		locationMessage.Altitude,
-		locationMessage.VerticalAccuracy,
-		locationMessage.Speed,
-		locationMessage.User,
-		locationMessage.Device,
-		locationMessage.Course,
+		locationInsertQuery(1),
+		locationInsertArgs(time.Now(), locationMessage)...,
 	).Scan(&lastInsertID)
 
 	if ctx.Err() != nil { // We may have timed out
@@ -286,11 +314,22 @@ RETURNING id`,
 		return ctx.Err()
 	}
 
+	if errors.Is(err, sql.ErrNoRows) {
+		// Duplicate point — skip it and move on.
+		slog.With("devicetimestamp", locationMessage.DeviceTimestamp.String()).
+			With("lat", locationMessage.Latitude).
+			With("lon", locationMessage.Longitude).
+			WarnContext(ctx, "Could not insert location: duplicate point")
+		msg.Ack()
+
+		return nil
+	}
+
 	if err != nil { // Database error
 		var dbErr *pq.Error
 		if errors.As(err, &dbErr) {
 			if dbErr.Code.Class().Name() == "integrity_constraint_violation" {
-				// Duplicate point — skip it and move on.
+				// Invalid point — skip it and move on.
 				slog.With("err", dbErr).
 					With("devicetimestamp", locationMessage.DeviceTimestamp.String()).
 					With("lat", locationMessage.Latitude).
@@ -317,11 +356,39 @@ RETURNING id`,
 		return err
 	}
 
+	forwarded, err := enqueueSinkOutbox(ctx, tx, sinks, lastInsertID, locationMessage)
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(ctx, "Unable to queue location for forwarding")
+
+		return err
+	}
+
+	event := newLiveEvent(lastInsertID, locationMessage)
+
+	err = notifyLiveEvents(ctx, tx, []liveEvent{event})
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(ctx, "Unable to announce location to other instances")
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		slog.With("err", err).
+			ErrorContext(ctx, "Unable to commit location insert")
+
+		return err
+	}
+
 	msg.Ack()
 	slog.With("id", lastInsertID).
 		With("messageId", locationMessage.MessageID).
 		DebugContext(ctx, "Inserted database location")
 
+	liveLocations.Publish(event)
+
 	if enablePrometheus {
 		metrics.locationsReceived.Inc()
 	}
@@ -330,13 +397,8 @@ RETURNING id`,
 		GeocodingWorkQueue <- lastInsertID
 	}
 
-	if DawarichForwardQueue != nil {
-		select {
-		case DawarichForwardQueue <- locationMessage:
-		default:
-			slog.With("id", lastInsertID).
-				WarnContext(ctx, "Dawarich forward queue full, dropping location")
-		}
+	if forwarded {
+		signalSinkOutbox()
 	}
 
 	return nil
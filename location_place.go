@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const placeResultLimit = 20
+
+var errNoPlaceGeometry = errors.New("no valid geometries found in geocoding response")
+
+//nolint:tagliatelle
+type LocationCountPerDay struct {
+	LocationCount int       `json:"count"`
+	Date          time.Time `json:"date"`
+}
+
+// PlaceSearchResult is the outcome of searching location history for a named place.
+//
+//nolint:tagliatelle
+type PlaceSearchResult struct {
+	Place       string                `json:"place"`
+	DisplayName string                `json:"display_name"`
+	Results     []LocationCountPerDay `json:"results"`
+}
+
+// placeSearchArea returns a SQL geography expression (and its arguments) describing
+// the area covered by a Nominatim search result. Areal geometries returned by
+// polygon_geojson are used as-is; anything else falls back to the feature's bbox.
+func placeSearchArea(feature *geojson.Feature) (string, []any, error) {
+	if feature.Geometry != nil && (feature.Geometry.IsPolygon() || feature.Geometry.IsMultiPolygon()) {
+		geometryJSON, err := feature.Geometry.MarshalJSON()
+		if err != nil {
+			return "", nil, fmt.Errorf("marshalling place geometry: %w", err)
+		}
+
+		return "ST_SetSRID(ST_GeomFromGeoJSON($1), 4326)::geography", []any{string(geometryJSON)}, nil
+	}
+
+	// GeoJSON bbox order is [min lon, min lat, max lon, max lat]
+	if len(feature.BoundingBox) == 4 {
+		return "ST_MakeEnvelope($1, $2, $3, $4, 4326)::geography", []any{
+			feature.BoundingBox[0],
+			feature.BoundingBox[1],
+			feature.BoundingBox[2],
+			feature.BoundingBox[3],
+		}, nil
+	}
+
+	return "", nil, errNoPlaceGeometry
+}
+
+// SearchPlace forward-geocodes the given place and counts the recorded locations
+// that fall within it, grouped by day. If the filter's user is set, only their locations
+// are counted.
+func (env *Env) SearchPlace(ctx context.Context, place string, filter pointsFilter) (*PlaceSearchResult, error) {
+	if env.database == nil {
+		return nil, errors.New("no database connection available")
+	}
+
+	defer timeTrack(ctx, time.Now())
+
+	geocoding, err := env.GetGeocoding(ctx, place)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PlaceSearchResult{Place: place}
+
+	if len(geocoding.Features) == 0 {
+		return result, nil
+	}
+
+	feature := geocoding.Features[0]
+
+	if displayName, ok := feature.Properties["display_name"].(string); ok {
+		result.DisplayName = displayName
+	}
+
+	area, args, err := placeSearchArea(feature)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions, args := filter.sql(args)
+
+	//nolint:gosec
+	query := fmt.Sprintf(`select count(*) as c, date(devicetimestamp)
+from %s
+where ST_Intersects(point, %s)
+%sgroup by date(devicetimestamp)
+order by c desc limit %d`, filter.table(), area, conditions, placeResultLimit)
+
+	rows, err := env.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var count LocationCountPerDay
+
+		err := rows.Scan(&count.LocationCount, &count.Date)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching values from database: %w", err)
+		}
+
+		result.Results = append(result.Results, count)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+func (env *Env) PlaceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024)
+	place := r.FormValue("place")
+
+	filter, err := env.authorizeRead(r, pointsFilter{User: r.FormValue("user"), Raw: true})
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	result, err := env.SearchPlace(ctx, place, filter)
+	if err != nil {
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	env.respondHTML(
+		w,
+		"placeResults.gohtml",
+		map[string]any{
+			resultsKey:  result.Results,
+			"place":     place,
+			"formatted": result.DisplayName,
+		},
+	)
+}
+
+// PlaceAPIHandler is the JSON equivalent of PlaceHandler, taking the place from the q parameter.
+func (env *Env) PlaceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	place := r.URL.Query().Get("q")
+	if place == "" {
+		http.Error(w, "q parameter is required", http.StatusBadRequest)
+
+		return
+	}
+
+	filter, err := env.authorizeRead(r, pointsFilter{User: r.URL.Query().Get("user"), Raw: true})
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	result, err := env.SearchPlace(ctx, place, filter)
+	if err != nil {
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, result)
+}
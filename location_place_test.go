@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetGeocodingUsesNominatimSearch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search", r.URL.Path)
+		assert.Equal(t, "Hyde Park", r.URL.Query().Get("q"))
+		assert.Equal(t, "geojson", r.URL.Query().Get("format"))
+		assert.Equal(t, "1", r.URL.Query().Get("polygon_geojson"))
+
+		_, _ = w.Write([]byte(`{"type":"FeatureCollection","features":[{"type":"Feature",
+"bbox":[-0.18,51.50,-0.15,51.51],
+"properties":{"display_name":"Hyde Park, London"},
+"geometry":{"type":"Polygon","coordinates":[[[-0.18,51.50],[-0.15,51.50],[-0.15,51.51],[-0.18,51.50]]]}}]}`))
+	}))
+	defer server.Close()
+
+	env := &Env{configuration: &Configuration{GeocodeAPIURL: server.URL}}
+
+	collection, err := env.GetGeocoding(t.Context(), "Hyde Park")
+	require.NoError(t, err)
+	require.Len(t, collection.Features, 1)
+	assert.True(t, collection.Features[0].Geometry.IsPolygon())
+	assert.Equal(t, "Hyde Park, London", collection.Features[0].Properties["display_name"])
+}
+
+func TestPlaceSearchAreaUsesPolygon(t *testing.T) {
+	feature := geojson.NewPolygonFeature([][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}})
+	feature.BoundingBox = []float64{0, 0, 1, 1}
+
+	area, args, err := placeSearchArea(feature)
+	require.NoError(t, err)
+	assert.Contains(t, area, "ST_GeomFromGeoJSON")
+	require.Len(t, args, 1)
+	assert.Contains(t, args[0], `"Polygon"`)
+}
+
+func TestPlaceSearchAreaFallsBackToBoundingBox(t *testing.T) {
+	feature := geojson.NewPointFeature([]float64{-0.1, 51.5})
+	feature.BoundingBox = []float64{-0.2, 51.4, 0.0, 51.6}
+
+	area, args, err := placeSearchArea(feature)
+	require.NoError(t, err)
+	assert.Contains(t, area, "ST_MakeEnvelope")
+	assert.Equal(t, []any{-0.2, 51.4, 0.0, 51.6}, args)
+}
+
+func TestPlaceSearchAreaWithoutGeometryOrBoundingBox(t *testing.T) {
+	feature := geojson.NewPointFeature([]float64{-0.1, 51.5})
+
+	_, _, err := placeSearchArea(feature)
+	require.ErrorIs(t, err, errNoPlaceGeometry)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
 	"errors"
@@ -17,10 +18,7 @@ import (
 	_ "github.com/lib/pq"
 )
 
-var (
-	GeocodingWorkQueue   chan int
-	DawarichForwardQueue chan MQTTMsg
-)
+var GeocodingWorkQueue chan int
 
 func InternalError(ctx context.Context, err error) {
 	slog.With("err", err).ErrorContext(ctx, "Internal Error")
@@ -32,20 +30,22 @@ type Env struct {
 	metrics       *Metrics
 	insertSem     chan struct{} // bounds concurrent DB inserts
 	tmpl          *template.Template
+	sinks         []*ForwardingSink
+	auth          *authenticator // nil if the HTTP API is public
 }
 
 func main() {
 	ctx := context.Background()
 
-	if len(os.Args) > 1 && (os.Args[1] == "sync-dawarich" || os.Args[2] == "sync-dawarich") {
-		syncCtx, cancelFunc := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	if command, args, ok := findSubcommand(os.Args); ok {
+		commandCtx, cancelFunc := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 
-		err := runSyncDawarich(syncCtx, os.Args[2:])
+		err := command(commandCtx, args)
 
 		cancelFunc()
 
 		if err != nil {
-			slog.With("err", err).ErrorContext(syncCtx, "Sync failed")
+			slog.With("err", err).ErrorContext(commandCtx, "Command failed")
 			os.Exit(1)
 		}
 
@@ -103,12 +103,25 @@ func run(ctx context.Context, _ []string) error {
 		)))
 	}
 
+	env.auth, err = env.newAuthenticator(configuration)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Unable to configure authentication")
+
+		return errInvalidConfig
+	}
+
+	if env.auth == nil {
+		slog.WarnContext(ctx, "No authentication is configured, the HTTP API is public")
+	}
+
 	if env.configuration.DbHost != "" {
 		err := env.setupDatabase(ctx)
 		if err != nil {
 			return fmt.Errorf("database setup failed: %w", err)
 		}
 
+		env.DoDatabaseMigrations(ctx)
+
 		GeocodingWorkQueue = make(chan int, 100)
 
 		go func() {
@@ -121,18 +134,24 @@ func run(ctx context.Context, _ []string) error {
 			go env.GeocodingCrawler(ctx)
 		}
 
-		if env.configuration.DawarichURL != "" {
-			DawarichForwardQueue = make(chan MQTTMsg, 100)
+		env.sinks, err = loadSinks(env.configuration)
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Unable to configure forwarding sinks")
+
+			return errInvalidConfig
+		}
 
-			go func() {
-				<-ctx.Done()
-				close(DawarichForwardQueue)
-			}()
+		if len(env.sinks) > 0 {
+			SinkOutboxSignal = make(chan struct{}, 1)
 
-			go env.ForwardToDawarich(ctx, DawarichForwardQueue)
+			go env.DrainSinkOutbox(ctx)
 		}
 
-		env.DoDatabaseMigrations(ctx)
+		if env.configuration.LiveNotify {
+			liveNotifyDatabase = env.database
+
+			go env.ListenLiveNotifications(ctx)
+		}
 
 		go func() {
 			err := env.SubscribeMQTT(ctx)
@@ -194,17 +213,21 @@ func (env *Env) closeDatabase(ctx context.Context) {
 	}()
 }
 
-func (env *Env) setupDatabase(ctx context.Context) error {
-	connectionString := fmt.Sprintf(
+// databaseConnectionString returns the lib/pq connection string for the configured
+// database.
+func (configuration *Configuration) databaseConnectionString() string {
+	return fmt.Sprintf(
 		"host=%s user=%s dbname=%s sslmode=%s password=%s",
-		env.configuration.DbHost,
-		env.configuration.DbUser,
-		env.configuration.DbName,
-		env.configuration.DbSslMode,
-		env.configuration.DbPassword,
+		configuration.DbHost,
+		configuration.DbUser,
+		configuration.DbName,
+		configuration.DbSslMode,
+		configuration.DbPassword,
 	)
+}
 
-	database, err := sql.Open("postgres", connectionString)
+func (env *Env) setupDatabase(ctx context.Context) error {
+	database, err := sql.Open("postgres", env.configuration.databaseConnectionString())
 	if err != nil {
 		return fmt.Errorf("error opening database connection: %w", err)
 	}
@@ -224,63 +247,421 @@ func (env *Env) setupDatabase(ctx context.Context) error {
 	return nil
 }
 
+// subcommands are run instead of the recorder when named on the command line.
+var subcommands = map[string]func(ctx context.Context, args []string) error{
+	"sync-dawarich":   runSyncDawarich,
+	"import-dawarich": runImportDawarich,
+	"import-recorder": runImportRecorder,
+	"import-google":   runImportGoogle,
+	"import-gpx":      runImportGPX,
+	"export-csv": func(ctx context.Context, args []string) error {
+		return runExportTable(ctx, args, tableFormatCSV)
+	},
+	"export-parquet": func(ctx context.Context, args []string) error {
+		return runExportTable(ctx, args, tableFormatParquet)
+	},
+}
+
+// findSubcommand returns the subcommand named by the first or second argument, along
+// with the arguments that follow it.
+func findSubcommand(args []string) (func(ctx context.Context, args []string) error, []string, bool) {
+	for position := 1; position <= 2 && position < len(args); position++ {
+		if command, ok := subcommands[args[position]]; ok {
+			return command, args[position+1:], true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// newCommandEnv connects to and migrates the database for a subcommand.
+func newCommandEnv(ctx context.Context, configuration *Configuration) (*Env, error) {
+	if configuration.Debug {
+		slog.SetDefault(
+			slog.New(slog.NewTextHandler(
+				os.Stdout,
+				&slog.HandlerOptions{Level: slog.LevelDebug},
+			)),
+		)
+	}
+
+	env := &Env{
+		configuration: configuration,
+		metrics:       NewMetrics(),
+	}
+
+	err := env.setupDatabase(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("database setup failed: %w", err)
+	}
+
+	env.DoDatabaseMigrations(ctx)
+
+	return env, nil
+}
+
+// configuredDawarichSink returns the Dawarich sink with the given name.
+func configuredDawarichSink(configuration *Configuration, name string) (*DawarichSink, error) {
+	sinks, err := loadSinks(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("loading sinks: %w", err)
+	}
+
+	forwardingSink := findSink(sinks, name)
+	if forwardingSink == nil {
+		return nil, fmt.Errorf("no sink named %q is configured", name)
+	}
+
+	dawarichSink, ok := forwardingSink.Sink.(*DawarichSink)
+	if !ok {
+		return nil, fmt.Errorf("sink %q is not a Dawarich sink", name)
+	}
+
+	return dawarichSink, nil
+}
+
+// parseTimeRange parses the optional RFC3339 --start and --end flags. The end
+// defaults to now.
+func parseTimeRange(startFlag, endFlag string) (time.Time, time.Time, error) {
+	var start time.Time
+
+	end := time.Now()
+
+	var err error
+
+	if startFlag != "" {
+		start, err = time.Parse(time.RFC3339, startFlag)
+		if err != nil {
+			return start, end, fmt.Errorf("parsing --start: %w", err)
+		}
+	}
+
+	if endFlag != "" {
+		end, err = time.Parse(time.RFC3339, endFlag)
+		if err != nil {
+			return start, end, fmt.Errorf("parsing --end: %w", err)
+		}
+	}
+
+	return start, end, nil
+}
+
 func runSyncDawarich(ctx context.Context, args []string) error {
 	fs := flag.NewFlagSet("sync-dawarich", flag.ExitOnError)
 	startFlag := fs.String("start", "", "Start time in RFC3339 format (optional)")
 	endFlag := fs.String("end", "", "End time in RFC3339 format (optional)")
+	sinkFlag := fs.String("sink", legacyDawarichSinkName, "Name of the Dawarich sink to sync to")
+	dryRunFlag := fs.Bool("dry-run", false, "Report missing points without posting them")
+	userFlag := fs.String("user", "", "Only sync points from this user (optional)")
+	deviceFlag := fs.String("device", "", "Only sync points from this device (optional)")
+	concurrencyFlag := fs.Int(
+		"concurrency",
+		defaultSyncConcurrency,
+		"Number of days to sync in parallel",
+	)
 
 	err := fs.Parse(args)
 	if err != nil {
 		return fmt.Errorf("parsing flags: %w", err)
 	}
 
+	start, end, err := parseTimeRange(*startFlag, *endFlag)
+	if err != nil {
+		return err
+	}
+
 	configuration, err := getConfiguration()
 	if err != nil {
 		return fmt.Errorf("loading configuration: %w", err)
 	}
 
-	if configuration.DawarichURL == "" {
-		return errors.New("DawarichURL is not set in configuration")
+	dawarichSink, err := configuredDawarichSink(configuration, *sinkFlag)
+	if err != nil {
+		return err
 	}
 
-	if configuration.Debug {
-		slog.SetDefault(
-			slog.New(slog.NewTextHandler(
-				os.Stdout,
-				&slog.HandlerOptions{Level: slog.LevelDebug},
-			)),
-		)
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
 	}
 
-	env := &Env{
-		configuration: configuration,
-		metrics:       NewMetrics(),
+	defer env.closeDatabase(ctx)
+
+	summary, err := env.SyncToDawarich(ctx, dawarichSink, start, end, dawarichSyncOptions{
+		DryRun:      *dryRunFlag,
+		User:        *userFlag,
+		Device:      *deviceFlag,
+		Concurrency: *concurrencyFlag,
+	})
+	if summary != nil {
+		summary.Print(os.Stdout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return summary.Err()
+}
+
+func runImportDawarich(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-dawarich", flag.ExitOnError)
+	startFlag := fs.String("start", "", "Start time in RFC3339 format (optional)")
+	endFlag := fs.String("end", "", "End time in RFC3339 format (optional)")
+	sinkFlag := fs.String("sink", legacyDawarichSinkName, "Name of the Dawarich sink to import from")
+	userFlag := fs.String(
+		"default-user",
+		"",
+		"OwnTracks user for points whose user can't be determined (optional)",
+	)
+	deviceFlag := fs.String(
+		"default-device",
+		dawarichImportDevice,
+		"OwnTracks device for points whose device can't be determined",
+	)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	start, end, err := parseTimeRange(*startFlag, *endFlag)
+	if err != nil {
+		return err
+	}
+
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+
+	configuration, err := getConfiguration()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	dawarichSink, err := configuredDawarichSink(configuration, *sinkFlag)
+	if err != nil {
+		return err
+	}
+
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
 	}
 
-	err = env.setupDatabase(ctx)
+	defer env.closeDatabase(ctx)
+
+	stats, err := env.ImportFromDawarich(ctx, dawarichSink, start, end, dawarichImportOptions{
+		DefaultUser:   *userFlag,
+		DefaultDevice: *deviceFlag,
+	})
+
+	_, _ = fmt.Fprintf(os.Stdout, "Imported %d points from Dawarich, %d already present\n",
+		stats.Inserted, stats.Duplicates)
+
+	return err
+}
+
+func runImportRecorder(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-recorder", flag.ExitOnError)
+	storeFlag := fs.String("store", "", "Path to the OwnTracks Recorder store directory")
+	cardsFlag := fs.Bool("cards", true, "Also import the store's cards")
+	waypointsFlag := fs.Bool("waypoints", true, "Also import the store's waypoints")
+
+	err := fs.Parse(args)
 	if err != nil {
-		return fmt.Errorf("database setup failed: %w", err)
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	if *storeFlag == "" {
+		return errors.New("--store is required")
+	}
+
+	configuration, err := getConfiguration()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
 	}
 
 	defer env.closeDatabase(ctx)
 
-	var start time.Time
+	summary, err := env.ImportRecorderStore(ctx, *storeFlag, recorderImportOptions{
+		Cards:     *cardsFlag,
+		Waypoints: *waypointsFlag,
+	})
+	summary.Print(os.Stdout)
+
+	return err
+}
+
+func runImportGoogle(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-google", flag.ExitOnError)
+	fileFlag := fs.String("file", "", "Path to Records.json, Timeline.json or location-history.json")
+	userFlag := fs.String("user", "", "OwnTracks user to import the points as")
+	deviceFlag := fs.String("device", "google", "OwnTracks device to import the points as")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	if *fileFlag == "" || *userFlag == "" || *deviceFlag == "" {
+		return errors.New("--file, --user and --device are required")
+	}
+
+	file, err := os.Open(*fileFlag) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("opening Google export: %w", err)
+	}
+
+	defer func() { _ = file.Close() }()
+
+	configuration, err := getConfiguration()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
+	}
 
-	if *startFlag != "" {
-		start, err = time.Parse(time.RFC3339, *startFlag)
+	defer env.closeDatabase(ctx)
+
+	stats, err := env.ImportGoogle(ctx, bufio.NewReader(file), googleImportOptions{
+		User:   *userFlag,
+		Device: *deviceFlag,
+	})
+
+	_, _ = fmt.Fprintf(os.Stdout, "Imported %d points from Google, %d already present, %d invalid\n",
+		stats.Inserted, stats.Duplicates, stats.Invalid)
+
+	return err
+}
+
+func runImportGPX(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-gpx", flag.ExitOnError)
+	userFlag := fs.String("user", "", "OwnTracks user to import the points as")
+	deviceFlag := fs.String("device", "", "OwnTracks device to import the points as")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	if *userFlag == "" || *deviceFlag == "" || fs.NArg() == 0 {
+		return errors.New("usage: import-gpx --user <user> --device <device> <file>...")
+	}
+
+	configuration, err := getConfiguration()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
+	}
+
+	defer env.closeDatabase(ctx)
+
+	for _, path := range fs.Args() {
+		err = importTrackFile(ctx, env, path, trackImportOptions{User: *userFlag, Device: *deviceFlag})
 		if err != nil {
-			return fmt.Errorf("parsing --start: %w", err)
+			return err
 		}
 	}
 
-	end := time.Now()
+	return nil
+}
+
+func importTrackFile(ctx context.Context, env *Env, path string, options trackImportOptions) error {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("opening track: %w", err)
+	}
 
-	if *endFlag != "" {
-		end, err = time.Parse(time.RFC3339, *endFlag)
+	defer func() { _ = file.Close() }()
+
+	stats, err := env.ImportTrack(ctx, file, options)
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", path, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "%s: imported %d points, %d already present, %d invalid\n",
+		path, stats.Inserted, stats.Duplicates, stats.Invalid)
+
+	if stats.Untimed > 0 {
+		_, _ = fmt.Fprintf(os.Stdout,
+			"%s: skipped %d LineString points whose Placemark has no TimeStamp or TimeSpan\n",
+			path, stats.Untimed)
+	}
+
+	return nil
+}
+
+func runExportTable(ctx context.Context, args []string, format string) error {
+	fs := flag.NewFlagSet("export-"+format, flag.ExitOnError)
+	startFlag := fs.String("start", "", "Start time in RFC3339 format (optional)")
+	endFlag := fs.String("end", "", "End time in RFC3339 format (optional)")
+	outputFlag := fs.String("output", "-", "File to write to, or - for stdout")
+	userFlag := fs.String("user", "", "Only export this user's locations (optional)")
+	deviceFlag := fs.String("device", "", "Only export this device's locations (optional)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	start, end, err := parseTimeRange(*startFlag, *endFlag)
+	if err != nil {
+		return err
+	}
+
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+
+	configuration, err := getConfiguration()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	env, err := newCommandEnv(ctx, configuration)
+	if err != nil {
+		return err
+	}
+
+	defer env.closeDatabase(ctx)
+
+	output := os.Stdout
+
+	if *outputFlag != "-" {
+		output, err = os.Create(*outputFlag) //nolint:gosec
 		if err != nil {
-			return fmt.Errorf("parsing --end: %w", err)
+			return fmt.Errorf("creating output: %w", err)
 		}
+
+		defer func() { _ = output.Close() }()
+	}
+
+	rows, err := env.getPoints(ctx, start, end, pointsFilter{User: *userFlag, Device: *deviceFlag, Raw: true})
+	if err != nil {
+		return fmt.Errorf("querying locations: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	buffered := bufio.NewWriter(output)
+
+	err = writeTable(ctx, rows, format, buffered, func() {})
+	if err != nil {
+		return fmt.Errorf("exporting %s: %w", format, err)
 	}
 
-	return env.SyncToDawarich(ctx, start, end)
+	return buffered.Flush()
 }
@@ -7,6 +7,7 @@ import (
 
 type Metrics struct {
 	locationsReceived prometheus.Counter
+	sinkDeliveries    *prometheus.CounterVec
 }
 
 func NewMetrics() *Metrics {
@@ -14,5 +15,17 @@ func NewMetrics() *Metrics {
 		Name: "location_messages_received_total",
 		Help: "Number of location messages received by the recorder",
 	}),
+		sinkDeliveries: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "sink_deliveries_total",
+			Help: "Number of location delivery attempts to forwarding sinks, by outcome",
+		}, []string{"sink", "outcome"}),
 	}
 }
+
+func (metrics *Metrics) sinkOutcome(sink string, outcome outboxOutcome) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.sinkDeliveries.WithLabelValues(sink, string(outcome)).Inc()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Formats of /api/0/locations, as in the OwnTracks Recorder.
+const (
+	otFormatJSON    = "json"
+	otFormatGeoJSON = "geojson"
+	otFormatGPX     = "gpx"
+	otFormatCSV     = "csv"
+	otFormatXML     = "xml"
+)
+
+// otTimeLayouts are the layouts accepted for the from and to parameters of
+// /api/0/locations. Times without a zone are UTC.
+var otTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	time.DateOnly,
+}
+
+// otLocationFields are the keys of a location in /api/0/locations JSON and XML, which
+// the fields parameter selects among.
+var otLocationFields = []string{
+	"_type", "tst", "lat", "lon", "acc", "alt", "vac", "vel", "cog", "addr", "username", "device",
+	"tid", "batt", "conn",
+}
+
+// otLastFields are the keys of a location in /api/0/last, which adds the device's card.
+var otLastFields = append(slices.Clip(otLocationFields), "name", "face")
+
+// otLocationsQuery is a parsed /api/0/locations request.
+type otLocationsQuery struct {
+	From   time.Time
+	To     time.Time
+	Filter pointsFilter
+	Format string
+	Fields map[string]bool
+}
+
+// parseOTTime parses a from or to parameter. A date on its own is the start of that
+// day, or if end is set the start of the next, so that to=2024-01-01 covers the day.
+func parseOTTime(value string, end bool) (time.Time, error) {
+	for _, layout := range otTimeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		if end && layout == time.DateOnly {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+
+		return parsed, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a date or a date and time", value)
+}
+
+// parseOTLocationsQuery parses the parameters of /api/0/locations. The range defaults to
+// the day before now.
+func parseOTLocationsQuery(r *http.Request, now time.Time) (otLocationsQuery, error) {
+	params := r.URL.Query()
+	query := otLocationsQuery{
+		From:   now.AddDate(0, 0, -1),
+		To:     now,
+		Filter: pointsFilter{User: params.Get("user"), Device: params.Get("device")},
+		Format: params.Get("format"),
+	}
+
+	var err error
+
+	if from := params.Get("from"); from != "" {
+		query.From, err = parseOTTime(from, false)
+		if err != nil {
+			return query, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	if to := params.Get("to"); to != "" {
+		query.To, err = parseOTTime(to, true)
+		if err != nil {
+			return query, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		query.Filter.Last, err = strconv.Atoi(limit)
+		if err != nil || query.Filter.Last <= 0 {
+			return query, fmt.Errorf("limit %q should be a positive number of locations", limit)
+		}
+	}
+
+	switch query.Format {
+	case "", otFormatJSON, otFormatXML:
+		if query.Format == "" {
+			query.Format = otFormatJSON
+		}
+
+		query.Fields, err = parseGeoJSONFields(params.Get("fields"), otLocationFields)
+	case otFormatGeoJSON:
+		query.Fields, err = parseGeoJSONFields(params.Get("fields"), geoJSONProperties)
+	case geoJSONFormatLineString, otFormatGPX, otFormatCSV:
+		// Line fields are parsed with the rest of the track parameters, and the
+		// columns of GPX and CSV are fixed
+	default:
+		return query, fmt.Errorf("unknown format %q", query.Format)
+	}
+
+	return query, err
+}
+
+// values returns a location's fields by their OwnTracks API key. Optional fields that
+// aren't set are left out, as they are in the location's JSON.
+func (location Location) values() map[string]any {
+	values := map[string]any{
+		"_type":    location.Type,
+		"tst":      location.Timestamp,
+		"lat":      location.Latitude,
+		"lon":      location.Longitude,
+		"acc":      location.Accuracy,
+		"alt":      location.Altitude,
+		"vac":      location.VerticalAccuracy,
+		"vel":      location.Speed,
+		"cog":      location.Course,
+		"addr":     location.Geocoding,
+		"username": location.Username,
+		"device":   location.Device,
+	}
+
+	optional := map[string]string{
+		"tid":  location.TrackerID,
+		"conn": location.Connection,
+		"name": location.Name,
+		"face": location.Face,
+	}
+
+	for key, value := range optional {
+		if value != "" {
+			values[key] = value
+		}
+	}
+
+	if location.Battery != nil {
+		values["batt"] = *location.Battery
+	}
+
+	return values
+}
+
+// selectLocationFields returns locations with only the given keys, or unchanged if
+// fields is nil.
+func selectLocationFields(locations []Location, fields map[string]bool) any {
+	if fields == nil {
+		return locations
+	}
+
+	selected := make([]map[string]any, len(locations))
+
+	for i, location := range locations {
+		selected[i] = map[string]any{}
+
+		for field, value := range location.values() {
+			if fields[field] {
+				selected[i][field] = value
+			}
+		}
+	}
+
+	return selected
+}
+
+// otXMLLocation is a location in /api/0/locations XML, with its fields as attributes.
+type otXMLLocation struct {
+	XMLName    xml.Name   `xml:"location"`
+	Attributes []xml.Attr `xml:",any,attr"`
+}
+
+// otXMLLocations is the document returned by /api/0/locations?format=xml.
+type otXMLLocations struct {
+	XMLName   xml.Name        `xml:"locations"`
+	Count     int             `xml:"count,attr"`
+	Locations []otXMLLocation `xml:"location"`
+}
+
+// writeOTLocationsXML writes locations as XML, keeping only the given fields unless
+// fields is nil.
+func writeOTLocationsXML(w io.Writer, locations []Location, fields map[string]bool) error {
+	document := otXMLLocations{Count: len(locations), Locations: make([]otXMLLocation, len(locations))}
+
+	for i, location := range locations {
+		values := location.values()
+
+		for _, field := range otLocationFields {
+			value, ok := values[field]
+			if ok && (fields == nil || fields[field]) {
+				document.Locations[i].Attributes = append(document.Locations[i].Attributes,
+					xml.Attr{Name: xml.Name{Local: field}, Value: fmt.Sprint(value)})
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	return encoder.Encode(document)
+}
+
+// OTLocationsHandler serves the OwnTracks Recorder's location history API. Unlike the
+// /export endpoints, user and device are optional filters, limit keeps only the latest
+// locations, and responses aren't compressed.
+func (env *Env) OTLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseOTLocationsQuery(r, time.Now())
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	query.Filter, err = env.authorizeRead(r, query.Filter)
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	switch query.Format {
+	case otFormatJSON, otFormatXML:
+		env.otLocations(w, r, query)
+	case geoJSONFormatLineString:
+		env.otTrackLines(w, r, query.From, query.To, query.Filter)
+	default:
+		env.otLocationsExport(w, r, query)
+	}
+}
+
+// otLocations responds with locations as JSON, in the recorder's data envelope, or as
+// XML.
+func (env *Env) otLocations(w http.ResponseWriter, r *http.Request, query otLocationsQuery) {
+	ctx := r.Context()
+
+	locations, err := env.GetLocationsBetweenDates(ctx, query.From, query.To, query.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if query.Format == otFormatXML {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusOK)
+
+		err = writeOTLocationsXML(w, locations, query.Fields)
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error writing locations as XML")
+		}
+
+		return
+	}
+
+	respondJSON(w, map[string]any{"count": len(locations), "data": selectLocationFields(locations, query.Fields)})
+}
+
+// otLocationsExport streams locations as GeoJSON points, GPX or CSV.
+func (env *Env) otLocationsExport(w http.ResponseWriter, r *http.Request, query otLocationsQuery) {
+	ctx := r.Context()
+
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	if query.Format == otFormatGPX {
+		rows, err = env.getTrackPoints(ctx, query.From, query.To, query.Filter)
+	} else {
+		rows, err = env.getPoints(ctx, query.From, query.To, query.Filter)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	flush := func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	switch query.Format {
+	case otFormatGeoJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = writeGeoJSONPoints(ctx, rows, w, query.Fields, flush)
+	case otFormatGPX:
+		w.Header().Set("Content-Type", "application/gpx+xml")
+		w.WriteHeader(http.StatusOK)
+
+		err = writeGPX(ctx, rows, w, defaultSegmentGap, flush)
+	case otFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		err = writeTable(ctx, rows, tableFormatCSV, w, flush)
+	}
+
+	if err != nil {
+		slog.With("err", err).With("format", query.Format).
+			ErrorContext(ctx, "Error streaming locations")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOTTime(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"2024-03-01T10:20:30":       time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+		"2024-03-01T10:20:30Z":      time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+		"2024-03-01T10:20:30+01:00": time.Date(2024, 3, 1, 9, 20, 30, 0, time.UTC),
+		"2024-03-01T10:20":          time.Date(2024, 3, 1, 10, 20, 0, 0, time.UTC),
+		"2024-03-01T10:20Z":         time.Date(2024, 3, 1, 10, 20, 0, 0, time.UTC),
+		"2024-03-01":                time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		parsed, err := parseOTTime(value, false)
+		require.NoError(t, err, value)
+		assert.True(t, expected.Equal(parsed), "%s parsed as %s", value, parsed)
+	}
+
+	end, err := parseOTTime("2024-03-01", true)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), end)
+
+	_, err = parseOTTime("yesterday", false)
+	assert.Error(t, err)
+}
+
+func TestParseOTLocationsQuery(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	query, err := parseOTLocationsQuery(httptest.NewRequest("GET", "/api/0/locations", nil), now)
+	require.NoError(t, err)
+	assert.Equal(t, otLocationsQuery{From: now.AddDate(0, 0, -1), To: now, Format: otFormatJSON}, query)
+
+	query, err = parseOTLocationsQuery(httptest.NewRequest("GET",
+		"/api/0/locations?user=alice&device=iphone&from=2024-01-01&to=2024-01-31&limit=10&fields=tst,lat,lon",
+		nil), now)
+	require.NoError(t, err)
+	assert.Equal(t, otLocationsQuery{
+		From:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Filter: pointsFilter{User: "alice", Device: "iphone", Last: 10},
+		Format: otFormatJSON,
+		Fields: map[string]bool{"tst": true, "lat": true, "lon": true},
+	}, query)
+
+	query, err = parseOTLocationsQuery(httptest.NewRequest("GET",
+		"/api/0/locations?format=geojson&fields=timestamp,user", nil), now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"timestamp": true, "user": true}, query.Fields)
+
+	for _, invalid := range []string{
+		"from=soon",
+		"to=2024-13-01",
+		"limit=0",
+		"limit=all",
+		"format=kml",
+		"fields=password",
+		"format=geojson&fields=tst",
+	} {
+		_, err := parseOTLocationsQuery(httptest.NewRequest("GET", "/api/0/locations?"+invalid, nil), now)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWriteOTLocationsXML(t *testing.T) {
+	locations := []Location{{
+		Type:      locationType,
+		Timestamp: 1704103200,
+		Latitude:  51.5,
+		Longitude: -0.12,
+		Accuracy:  10,
+		Geocoding: "High Street & Main Road",
+		Username:  "alice",
+		Device:    "iphone",
+	}}
+
+	var buffer bytes.Buffer
+
+	require.NoError(t, writeOTLocationsXML(&buffer, locations, nil))
+	assert.Contains(t, buffer.String(), `<locations count="1">`)
+	assert.Contains(t, buffer.String(),
+		`<location _type="location" tst="1704103200" lat="51.5" lon="-0.12" acc="10"`)
+	assert.Contains(t, buffer.String(), `addr="High Street &amp; Main Road" username="alice" device="iphone">`)
+
+	buffer.Reset()
+	require.NoError(t, writeOTLocationsXML(&buffer, locations, map[string]bool{"tst": true, "lat": true}))
+	assert.Contains(t, buffer.String(), `<location tst="1704103200" lat="51.5"></location>`)
+}
+
+func TestSelectLocationFields(t *testing.T) {
+	battery := 80
+	locations := []Location{
+		{Type: locationType, Timestamp: 1, Username: "alice", Device: "iphone", TrackerID: "AI", Battery: &battery,
+			Connection: "w", Name: "Alice", Face: "aGVsbG8="},
+		{Type: locationType, Timestamp: 2, Username: "alice", Device: "ipad"},
+	}
+
+	assert.Equal(t, locations, selectLocationFields(locations, nil))
+
+	fields, err := parseGeoJSONFields("device,tid,batt,conn,name", otLastFields)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"device": "iphone", "tid": "AI", "batt": 80, "conn": "w", "name": "Alice"},
+		{"device": "ipad"},
+	}, selectLocationFields(locations, fields))
+
+	_, err = parseGeoJSONFields("name", otLocationFields)
+	assert.Error(t, err)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const (
+	privacyZoneRequestMaxBytes = 64 * 1024
+	// privacyZoneMaxRadius keeps circles to a sensible size, in metres
+	privacyZoneMaxRadius = 50000
+
+	// redactedLocationsTable is the view of locations with privacy zones applied, read
+	// by everything that publishes locations beyond their user.
+	redactedLocationsTable = "redacted_locations"
+	locationsTable         = "locations"
+)
+
+var (
+	errPrivacyZoneNotFound    = errors.New("privacy zone not found")
+	errInvalidPrivacyZoneArea = errors.New("area isn't a valid polygon")
+)
+
+// privacyZoneAction is what happens to a location inside a privacy zone when it's
+// published.
+type privacyZoneAction string
+
+const (
+	// privacyZoneCentre moves the location to the zone's centre and names it by the
+	// zone's label
+	privacyZoneCentre privacyZoneAction = "centre"
+	// privacyZoneSuppress leaves the location out
+	privacyZoneSuppress privacyZoneAction = "suppress"
+)
+
+// privacyZone is a circle or polygon around a sensitive place of a user's, such as
+// their home. Locations inside it are redacted wherever they're published, while
+// the stored locations are left as they are.
+type privacyZone struct {
+	ID        int64             `json:"id"`
+	User      string            `json:"user"`
+	Label     string            `json:"label"`
+	Latitude  float64           `json:"lat"`
+	Longitude float64           `json:"lon"`
+	Radius    *float64          `json:"radius,omitempty"`
+	Area      *geojson.Geometry `json:"area,omitempty"`
+	Action    privacyZoneAction `json:"action"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// privacyZoneRequest is the body of a request to create a privacy zone: a circle
+// given by its centre and radius, or a polygon given as a GeoJSON area whose centre
+// defaults to its centroid.
+type privacyZoneRequest struct {
+	User      string            `json:"user"`
+	Label     string            `json:"label"`
+	Latitude  *float64          `json:"lat"`
+	Longitude *float64          `json:"lon"`
+	Radius    *float64          `json:"radius"`
+	Area      *geojson.Geometry `json:"area"`
+	Action    privacyZoneAction `json:"action"`
+}
+
+// parsePrivacyZoneRequest reads and validates a request to create a privacy zone.
+// Users who aren't admins can only create their own, and the action defaults to
+// centre.
+//
+//nolint:cyclop
+func parsePrivacyZoneRequest(r *http.Request) (privacyZoneRequest, error) {
+	var request privacyZoneRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return request, fmt.Errorf("invalid privacy zone request: %w", err)
+	}
+
+	request.User, err = authorizeUser(r, request.User)
+	if err != nil {
+		return request, err
+	}
+
+	switch request.Action {
+	case "":
+		request.Action = privacyZoneCentre
+	case privacyZoneCentre, privacyZoneSuppress:
+	default:
+		return request, fmt.Errorf("action %q should be %s or %s", request.Action, privacyZoneCentre, privacyZoneSuppress)
+	}
+
+	hasCentre := request.Latitude != nil && request.Longitude != nil
+
+	switch {
+	case request.User == "":
+		return request, errors.New("user is required")
+	case request.Label == "":
+		return request, errors.New("label is required")
+	case (request.Latitude == nil) != (request.Longitude == nil):
+		return request, errors.New("give both lat and lon, or neither")
+	case hasCentre && (*request.Latitude < -90 || *request.Latitude > 90 ||
+		*request.Longitude < -180 || *request.Longitude > 180):
+		return request, errors.New("lat and lon are out of range")
+	case (request.Radius == nil) == (request.Area == nil):
+		return request, errors.New("give either a radius or an area")
+	case request.Radius != nil && !hasCentre:
+		return request, errors.New("a circle needs lat and lon for its centre")
+	case request.Radius != nil && (*request.Radius <= 0 || *request.Radius > privacyZoneMaxRadius):
+		return request, fmt.Errorf("radius should be between 0 and %d metres", privacyZoneMaxRadius)
+	case request.Area != nil && !request.Area.IsPolygon() && !request.Area.IsMultiPolygon():
+		return request, errors.New("area should be a GeoJSON Polygon or MultiPolygon")
+	case request.Area != nil:
+		return request, validatePrivacyZoneArea(request.Area)
+	}
+
+	return request, nil
+}
+
+// validatePrivacyZoneArea checks that a Polygon or MultiPolygon has the shape PostGIS
+// expects: at least one ring in each polygon, each closed and of at least four
+// positions within range. Whether the rings cross is left to PostGIS.
+func validatePrivacyZoneArea(area *geojson.Geometry) error {
+	polygons := area.MultiPolygon
+	if area.IsPolygon() {
+		polygons = [][][][]float64{area.Polygon}
+	}
+
+	if len(polygons) == 0 {
+		return fmt.Errorf("%w: it has no polygons", errInvalidPrivacyZoneArea)
+	}
+
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return fmt.Errorf("%w: a polygon has no rings", errInvalidPrivacyZoneArea)
+		}
+
+		for _, ring := range polygon {
+			if len(ring) < 4 {
+				return fmt.Errorf("%w: a ring has fewer than four positions", errInvalidPrivacyZoneArea)
+			}
+
+			for _, position := range ring {
+				if len(position) < 2 || !validCoordinate(position[1], 90) || !validCoordinate(position[0], 180) {
+					return fmt.Errorf("%w: position %v is out of range", errInvalidPrivacyZoneArea, position)
+				}
+			}
+
+			if !slices.Equal(ring[0][:2], ring[len(ring)-1][:2]) {
+				return fmt.Errorf("%w: a ring isn't closed", errInvalidPrivacyZoneArea)
+			}
+		}
+	}
+
+	return nil
+}
+
+const privacyZoneColumns = `id, "user", label, ST_Y(centre::geometry), ST_X(centre::geometry), radius,
+       ST_AsGeoJSON(area), action, created_at`
+
+func scanPrivacyZone(row interface{ Scan(dest ...any) error }) (privacyZone, error) {
+	var (
+		zone privacyZone
+		area sql.NullString
+	)
+
+	err := row.Scan(
+		&zone.ID,
+		&zone.User,
+		&zone.Label,
+		&zone.Latitude,
+		&zone.Longitude,
+		&zone.Radius,
+		&area,
+		&zone.Action,
+		&zone.CreatedAt,
+	)
+	if err != nil {
+		return zone, err
+	}
+
+	if area.Valid {
+		zone.Area, err = geojson.UnmarshalGeometry([]byte(area.String))
+		if err != nil {
+			return zone, fmt.Errorf("parsing privacy zone area: %w", err)
+		}
+	}
+
+	return zone, nil
+}
+
+// createPrivacyZone stores a privacy zone.
+func (env *Env) createPrivacyZone(ctx context.Context, request privacyZoneRequest) (privacyZone, error) {
+	var area *string
+
+	if request.Area != nil {
+		areaJSON, err := request.Area.MarshalJSON()
+		if err != nil {
+			return privacyZone{}, fmt.Errorf("marshalling privacy zone area: %w", err)
+		}
+
+		areaText := string(areaJSON)
+		area = &areaText
+	}
+
+	// A polygon that intersects itself isn't inserted, rather than being stored to fail
+	// queries that test locations against it
+	zone, err := scanPrivacyZone(env.database.QueryRowContext(ctx, `with shape as (
+    select ST_SetSRID(ST_GeomFromGeoJSON($6::text), 4326) as area
+)
+insert into privacy_zones ("user", label, centre, radius, area, action)
+select $1,
+       $2,
+       coalesce(ST_SetSRID(ST_MakePoint($4::double precision, $3::double precision), 4326),
+                ST_Centroid(shape.area))::geography,
+       $5::double precision,
+       shape.area::geography,
+       $7
+from shape
+where shape.area is null
+   or ST_IsValid(shape.area)
+returning `+privacyZoneColumns,
+		request.User,
+		request.Label,
+		request.Latitude,
+		request.Longitude,
+		request.Radius,
+		area,
+		string(request.Action),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return zone, fmt.Errorf("%w: it intersects itself", errInvalidPrivacyZoneArea)
+	}
+
+	if err != nil {
+		return zone, fmt.Errorf("creating privacy zone: %w", err)
+	}
+
+	return zone, nil
+}
+
+// listPrivacyZones returns the privacy zones of a user, or of everyone if user is
+// empty.
+func (env *Env) listPrivacyZones(ctx context.Context, user string) ([]privacyZone, error) {
+	rows, err := env.database.QueryContext(ctx, `select `+privacyZoneColumns+`
+from privacy_zones
+where ($1 = '' or "user" = $1)
+order by "user", label`, user)
+	if err != nil {
+		return nil, fmt.Errorf("listing privacy zones: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	zones := []privacyZone{}
+
+	for rows.Next() {
+		zone, err := scanPrivacyZone(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning privacy zone: %w", err)
+		}
+
+		zones = append(zones, zone)
+	}
+
+	return zones, rows.Err()
+}
+
+// deletePrivacyZone removes a privacy zone, if it belongs to user or user is empty.
+// It returns whether there was such a zone.
+func (env *Env) deletePrivacyZone(ctx context.Context, id int64, user string) (bool, error) {
+	result, err := env.database.ExecContext(ctx,
+		`delete from privacy_zones where id = $1 and ($2 = '' or "user" = $2)`, id, user)
+	if err != nil {
+		return false, fmt.Errorf("deleting privacy zone: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return deleted > 0, err
+}
+
+// privacyZoneAt returns the user's privacy zone containing a point, as the
+// redacted_locations view would apply it, or nil if there isn't one. It can run in a
+// transaction.
+func privacyZoneAt(
+	ctx context.Context,
+	database interface {
+		QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	},
+	user string,
+	latitude float64,
+	longitude float64,
+) (*privacyZone, error) {
+	zone := privacyZone{User: user}
+
+	err := database.QueryRowContext(ctx, `select id, label, ST_Y(centre::geometry), ST_X(centre::geometry), action
+from privacy_zone_at($1, ST_SetSRID(ST_MakePoint($3, $2), 4326)::geography)`, user, latitude, longitude).
+		Scan(&zone.ID, &zone.Label, &zone.Latitude, &zone.Longitude, &zone.Action)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("looking up privacy zone: %w", err)
+	}
+
+	return &zone, nil
+}
+
+// privacyZoneGeocoding is the geocoding of a location redacted to a zone, naming it by
+// the zone's label as the redacted_locations view does.
+func privacyZoneGeocoding(label string) string {
+	geocoding, _ := json.Marshal(map[string]string{"display_name": label})
+
+	return string(geocoding)
+}
+
+// redactLocation applies its user's privacy zones to a location that wasn't read from
+// redacted_locations, such as one that has just been received. It returns false if
+// the location should be left out.
+func (env *Env) redactLocation(ctx context.Context, location Location) (Location, bool, error) {
+	if env.database == nil {
+		return location, true, nil
+	}
+
+	zone, err := privacyZoneAt(ctx, env.database, location.Username, location.Latitude, location.Longitude)
+	if err != nil || zone == nil {
+		return location, err == nil, err
+	}
+
+	if zone.Action == privacyZoneSuppress {
+		return location, false, nil
+	}
+
+	location.Latitude = zone.Latitude
+	location.Longitude = zone.Longitude
+	location.Geocoding = privacyZoneGeocoding(zone.Label)
+
+	return location, true, nil
+}
+
+// redactLiveLocation is redactLocation for locations being pushed live, which are left
+// out if their zones can't be checked.
+func (env *Env) redactLiveLocation(ctx context.Context, location Location) (Location, bool) {
+	location, ok, err := env.redactLocation(ctx, location)
+	if err != nil {
+		slog.With("err", err).With("user", location.Username).
+			WarnContext(ctx, "Unable to check privacy zones, leaving location out")
+
+		return location, false
+	}
+
+	return location, ok
+}
+
+// ListPrivacyZonesHandler lists the privacy zones of the user query parameter, or of
+// everyone. Users who aren't admins only see their own.
+func (env *Env) ListPrivacyZonesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := authorizeUser(r, r.URL.Query().Get("user"))
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	zones, err := env.listPrivacyZones(r.Context(), user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, zones)
+}
+
+// CreatePrivacyZoneHandler creates a privacy zone from the JSON body.
+func (env *Env) CreatePrivacyZoneHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, privacyZoneRequestMaxBytes)
+
+	request, err := parsePrivacyZoneRequest(r)
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	zone, err := env.createPrivacyZone(ctx, request)
+	if errors.Is(err, errInvalidPrivacyZoneArea) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err != nil {
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.With("id", zone.ID).With("user", zone.User).With("action", zone.Action).
+		InfoContext(ctx, "Created privacy zone")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(zone)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to encode JSON response")
+	}
+}
+
+// DeletePrivacyZoneHandler removes a privacy zone. Users who aren't admins can only
+// remove their own.
+func (env *Env) DeletePrivacyZoneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid privacy zone id", http.StatusBadRequest)
+
+		return
+	}
+
+	deleted, err := env.deletePrivacyZone(r.Context(), id, restrictedUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if !deleted {
+		http.Error(w, errPrivacyZoneNotFound.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
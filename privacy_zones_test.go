@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func privacyZoneRequestFor(user string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/0/privacy-zones", strings.NewReader(body))
+
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal{User: user}))
+}
+
+func TestParsePrivacyZoneRequest(t *testing.T) {
+	request, err := parsePrivacyZoneRequest(privacyZoneRequestFor("alice",
+		`{"label": "Home", "lat": 51.5, "lon": -0.1, "radius": 200}`))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", request.User)
+	assert.Equal(t, privacyZoneCentre, request.Action)
+	assert.InDelta(t, 200, *request.Radius, 1e-9)
+
+	request, err = parsePrivacyZoneRequest(privacyZoneRequestFor("alice", `{"label": "Work", "action": "suppress",
+		"area": {"type": "Polygon", "coordinates": [[[-0.1, 51.5], [-0.09, 51.5], [-0.09, 51.51], [-0.1, 51.5]]]}}`))
+	require.NoError(t, err)
+	assert.Equal(t, privacyZoneSuppress, request.Action)
+	assert.True(t, request.Area.IsPolygon())
+	assert.Nil(t, request.Latitude, "a polygon's centre defaults to its centroid")
+
+	_, err = parsePrivacyZoneRequest(privacyZoneRequestFor("alice",
+		`{"user": "bob", "label": "Home", "lat": 51.5, "lon": -0.1, "radius": 200}`))
+	require.ErrorIs(t, err, errForbidden)
+
+	for _, body := range []string{
+		`{"lat": 51.5, "lon": -0.1, "radius": 200}`,
+		`{"label": "Home", "lat": 51.5, "radius": 200}`,
+		`{"label": "Home", "lat": 91, "lon": -0.1, "radius": 200}`,
+		`{"label": "Home", "radius": 200}`,
+		`{"label": "Home", "lat": 51.5, "lon": -0.1, "radius": 0}`,
+		`{"label": "Home", "lat": 51.5, "lon": -0.1}`,
+		`{"label": "Home", "lat": 51.5, "lon": -0.1, "radius": 200, "action": "blur"}`,
+		`{"label": "Home", "area": {"type": "Point", "coordinates": [-0.1, 51.5]}}`,
+		`{"label": "Home", "area": {"type": "Polygon", "coordinates": []}}`,
+		`{"label": "Home", "area": {"type": "Polygon", "coordinates": [[[-0.1, 51.5], [-0.09, 51.5], [-0.1, 51.5]]]}}`,
+		`{"label": "Home", "area": {"type": "Polygon",
+			"coordinates": [[[-0.1, 51.5], [-0.09, 51.5], [-0.09, 51.51], [-0.1, 51.51]]]}}`,
+		`{"label": "Home", "area": {"type": "Polygon",
+			"coordinates": [[[-0.1, 51.5], [-0.09, 95], [-0.09, 51.51], [-0.1, 51.5]]]}}`,
+		`{"label": "Home", "area": {"type": "Polygon", "coordinates": [[[-0.1], [-0.09], [-0.09], [-0.1]]]}}`,
+		`{"label": "Home", "area": {"type": "MultiPolygon", "coordinates": [[]]}}`,
+	} {
+		_, err = parsePrivacyZoneRequest(privacyZoneRequestFor("alice", body))
+		assert.Error(t, err, body)
+	}
+}
+
+func TestPrivacyZoneLabelIsTheGeocodedName(t *testing.T) {
+	location := Location{Geocoding: privacyZoneGeocoding("Home")}
+
+	for _, precision := range []PlacePrecision{PlacePrecisionAddress, PlacePrecisionCity, PlacePrecisionCountry} {
+		assert.Equal(t, "Home", location.GeocodedName(t.Context(), precision), precision)
+	}
+}
+
+func TestPointsFilterReadsRedactedLocations(t *testing.T) {
+	assert.Equal(t, "redacted_locations", pointsFilter{}.table())
+	assert.Equal(t, "locations", pointsFilter{Raw: true}.table())
+}
+
+func TestPrivacyZoneRoutesRequireAuthentication(t *testing.T) {
+	configuration := &Configuration{AuthTokens: "alice:a-token"}
+	env := Env{configuration: configuration}
+	env.auth = testAuthenticator(t, configuration)
+	router := env.BuildRoutes(configuration)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/0/privacy-zones", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/0/privacy-zones?user=bob", nil)
+	r.Header.Set("Authorization", "Bearer a-token")
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, r)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recorderMaxLineLength bounds a single .rec line, which may carry a base64 encoded
+// card image.
+const recorderMaxLineLength = 16 * 1024 * 1024
+
+var errMalformedRecLine = errors.New("malformed .rec line")
+
+// recorderImportOptions are the command line options of the import-recorder subcommand.
+type recorderImportOptions struct {
+	Cards     bool
+	Waypoints bool
+}
+
+// recorderImportSummary counts the outcome of importing a Recorder store.
+type recorderImportSummary struct {
+	Locations ImportStats
+	Skipped   int
+	Malformed int
+	Cards     int
+	Waypoints int
+}
+
+// Print writes a human readable summary.
+func (summary recorderImportSummary) Print(w io.Writer) {
+	_, _ = fmt.Fprintln(w, "Recorder import summary")
+	_, _ = fmt.Fprintf(w, "  Locations inserted:  %d\n", summary.Locations.Inserted)
+	_, _ = fmt.Fprintf(w, "  Already present:     %d\n", summary.Locations.Duplicates)
+	_, _ = fmt.Fprintf(w, "  Other messages:      %d\n", summary.Skipped)
+	_, _ = fmt.Fprintf(w, "  Malformed lines:     %d\n", summary.Malformed)
+	_, _ = fmt.Fprintf(w, "  Cards:               %d\n", summary.Cards)
+	_, _ = fmt.Fprintf(w, "  Waypoints inserted:  %d\n", summary.Waypoints)
+}
+
+// parseRecLine parses a line of a Recorder .rec file, which has the form
+// "<iso timestamp>\t<topic suffix>\t<json>". It returns false for lines that aren't
+// locations.
+func parseRecLine(line string) (MQTTMsg, bool, error) {
+	var msg MQTTMsg
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return msg, false, nil
+	}
+
+	start := strings.IndexByte(line, '{')
+	if start < 0 {
+		return msg, false, errMalformedRecLine
+	}
+
+	err := json.Unmarshal([]byte(line[start:]), &msg)
+	if err != nil {
+		return msg, false, fmt.Errorf("%w: %w", errMalformedRecLine, err)
+	}
+
+	if msg.Type != locationType {
+		return msg, false, nil
+	}
+
+	if msg.DeviceTimestampAsInt == 0 {
+		prefix := strings.Fields(line[:start])
+		if len(prefix) == 0 {
+			return msg, false, fmt.Errorf("%w: no timestamp", errMalformedRecLine)
+		}
+
+		recorded, err := time.Parse(time.RFC3339, prefix[0])
+		if err != nil {
+			return msg, false, fmt.Errorf("%w: %w", errMalformedRecLine, err)
+		}
+
+		msg.DeviceTimestampAsInt = recorded.Unix()
+	}
+
+	msg.DeviceTimestamp = time.Unix(msg.DeviceTimestampAsInt, 0)
+
+	return msg, true, nil
+}
+
+// storeOwner returns the user and device encoded in a path of the form
+// <user>/<device>/<file> relative to a store subdirectory. The device is empty for
+// files directly under the user's directory.
+func storeOwner(root, path string) (string, string, bool) {
+	relative, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.Split(filepath.ToSlash(relative), "/")
+
+	switch len(parts) {
+	case 2:
+		return parts[0], "", true
+	case 3:
+		return parts[0], parts[1], true
+	default:
+		return "", "", false
+	}
+}
+
+// ImportRecorderStore imports the .rec files from an OwnTracks Recorder store
+// directory, and optionally its cards and waypoints.
+func (env *Env) ImportRecorderStore(
+	ctx context.Context,
+	store string,
+	options recorderImportOptions,
+) (recorderImportSummary, error) {
+	var summary recorderImportSummary
+
+	importer := env.newLocationImporter("recorder")
+	recRoot := filepath.Join(store, "rec")
+
+	err := filepath.WalkDir(recRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || filepath.Ext(path) != ".rec" {
+			return nil
+		}
+
+		user, device, ok := storeOwner(recRoot, path)
+		if !ok || device == "" {
+			slog.With("path", path).WarnContext(ctx, "Skipping .rec file outside rec/<user>/<device>/")
+
+			return nil
+		}
+
+		return importRecFile(ctx, importer, &summary, path, user, device)
+	})
+	if err != nil {
+		return summary, fmt.Errorf("importing %s: %w", recRoot, err)
+	}
+
+	summary.Locations, err = importer.Close(ctx)
+	if err != nil {
+		return summary, err
+	}
+
+	if options.Cards {
+		err = env.importRecorderCards(ctx, filepath.Join(store, "cards"), &summary)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	if options.Waypoints {
+		err = env.importRecorderWaypoints(ctx, filepath.Join(store, "waypoints"), &summary)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
+
+func importRecFile(
+	ctx context.Context,
+	importer *locationImporter,
+	summary *recorderImportSummary,
+	path, user, device string,
+) error {
+	slog.With("path", path).DebugContext(ctx, "Importing .rec file")
+
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), recorderMaxLineLength)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		msg, ok, err := parseRecLine(scanner.Text())
+		if err != nil {
+			slog.With("err", err, "path", path, "line", lineNumber).
+				WarnContext(ctx, "Skipping malformed line")
+
+			summary.Malformed++
+
+			continue
+		}
+
+		if !ok {
+			summary.Skipped++
+
+			continue
+		}
+
+		msg.User = user
+		msg.Device = device
+
+		err = importer.Add(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// importRecorderCards imports cards/<user>/*.json and cards/<user>/<device>/*.json.
+func (env *Env) importRecorderCards(ctx context.Context, root string, summary *recorderImportSummary) error {
+	return walkStoreJSON(ctx, root, func(path, user, device string, data []byte) error {
+		var card Card
+
+		err := json.Unmarshal(data, &card)
+		if err != nil || card.Type != cardType {
+			slog.With("err", err, "path", path).WarnContext(ctx, "Skipping file that isn't a card")
+
+			return nil
+		}
+
+		err = upsertCard(ctx, env.database, user, device, card)
+		if err != nil {
+			return err
+		}
+
+		summary.Cards++
+
+		return nil
+	})
+}
+
+// importRecorderWaypoints imports waypoints/<user>/<device>/, which holds single
+// waypoints as .json files and exported waypoint lists as .otrw files.
+func (env *Env) importRecorderWaypoints(ctx context.Context, root string, summary *recorderImportSummary) error {
+	return walkStoreJSON(ctx, root, func(path, user, device string, data []byte) error {
+		if device == "" {
+			return nil
+		}
+
+		var waypoints Waypoints
+
+		err := json.Unmarshal(data, &waypoints)
+		if err != nil {
+			slog.With("err", err, "path", path).WarnContext(ctx, "Skipping malformed waypoints file")
+
+			return nil //nolint:nilerr
+		}
+
+		switch waypoints.Type {
+		case waypointsType:
+		case waypointType:
+			var waypoint Waypoint
+
+			_ = json.Unmarshal(data, &waypoint)
+			waypoints.Waypoints = []Waypoint{waypoint}
+		default:
+			return nil
+		}
+
+		for _, waypoint := range waypoints.Waypoints {
+			inserted, err := insertWaypoint(ctx, env.database, user, device, waypoint)
+			if err != nil {
+				return err
+			}
+
+			if inserted {
+				summary.Waypoints++
+			}
+		}
+
+		return nil
+	})
+}
+
+// walkStoreJSON calls handle with the contents of every .json and .otrw file under
+// root. A missing root is not an error, since stores only have the directories for
+// the message types they have received.
+func walkStoreJSON(
+	ctx context.Context,
+	root string,
+	handle func(path, user, device string, data []byte) error,
+) error {
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		extension := filepath.Ext(path)
+		if entry.IsDir() || (extension != ".json" && extension != ".otrw") {
+			return nil
+		}
+
+		user, device, ok := storeOwner(root, path)
+		if !ok {
+			return nil
+		}
+
+		data, err := os.ReadFile(path) //nolint:gosec
+		if err != nil {
+			return err
+		}
+
+		return handle(path, user, device, data)
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.With("path", root).DebugContext(ctx, "Store directory not found, skipping")
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", root, err)
+	}
+
+	return nil
+}
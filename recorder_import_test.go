@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecLine(t *testing.T) {
+	msg, ok, err := parseRecLine("2024-01-01T00:00:00Z\t*                 \t" +
+		`{"_type":"location","tid":"AB","lat":51.5074,"lon":-0.1278,"acc":10,"batt":85,"tst":1704067200}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "AB", msg.TrackerID)
+	assert.InDelta(t, 51.5074, msg.Latitude, 0.00001)
+	assert.Equal(t, time.Unix(1704067200, 0), msg.DeviceTimestamp)
+}
+
+func TestParseRecLineUsesRecordedTimeWithoutTst(t *testing.T) {
+	msg, ok, err := parseRecLine(`2024-01-01T00:00:10Z  *  {"_type":"location","lat":1,"lon":2}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(1704067210), msg.DeviceTimestampAsInt)
+}
+
+func TestParseRecLineSkipsOtherMessages(t *testing.T) {
+	_, ok, err := parseRecLine("2024-01-01T00:00:00Z\tlwt\t" + `{"_type":"lwt","tst":1704067200}`)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = parseRecLine("")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestParseRecLineRejectsMalformedLines(t *testing.T) {
+	_, _, err := parseRecLine("2024-01-01T00:00:00Z\t*\tnot json")
+	require.ErrorIs(t, err, errMalformedRecLine)
+
+	_, _, err = parseRecLine(`2024-01-01T00:00:00Z * {"_type":"location",`)
+	require.ErrorIs(t, err, errMalformedRecLine)
+}
+
+func TestStoreOwner(t *testing.T) {
+	user, device, ok := storeOwner("/store/rec", "/store/rec/alice/iphone/2024-01.rec")
+	require.True(t, ok)
+	assert.Equal(t, "alice", user)
+	assert.Equal(t, "iphone", device)
+
+	user, device, ok = storeOwner("/store/cards", "/store/cards/alice/alice.json")
+	require.True(t, ok)
+	assert.Equal(t, "alice", user)
+	assert.Empty(t, device)
+
+	_, _, ok = storeOwner("/store/rec", "/store/rec/stray.rec")
+	assert.False(t, ok)
+}
+
+func TestWalkStoreJSON(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "waypoints")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "alice", "iphone"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "alice", "iphone", "iphone.otrw"), []byte(`{}`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "alice", "iphone", "notes.txt"), []byte(`{}`), 0o600))
+
+	var visited []string
+
+	err := walkStoreJSON(t.Context(), root, func(path, user, device string, _ []byte) error {
+		visited = append(visited, user+"/"+device+"/"+filepath.Base(path))
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice/iphone/iphone.otrw"}, visited)
+
+	require.NoError(t, walkStoreJSON(t.Context(), filepath.Join(t.TempDir(), "missing"), nil))
+}
@@ -17,35 +17,71 @@ func (env *Env) BuildRoutes(configuration *Configuration) http.Handler {
 	env.tmpl = template.Must(template.New("").ParseFS(embedFs, "templates/*.gohtml"))
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
 
 	if configuration.EnablePrometheus {
 		r.Handle("/metrics", promhttp.Handler())
 	}
 
-	r.Get("/place/", func(w http.ResponseWriter, r *http.Request) {
-		env.respondHTML(w, "place.gohtml", nil)
-	})
-	r.Post("/place/", env.PlaceHandler)
-	r.Get("/inaccurate/", env.GetInaccurateLocationPoints)
-	r.Delete("/points/{id}", env.DeleteLocationPoint)
-	r.Get("/points/{date}", env.GetPointsForDate)
-	r.Get("/export/geojson/{from}/{to}", env.ExportGeoJSON)
-
-	r.Route("/api/0", func(r chi.Router) {
-		r.Get("/list", env.OTListUserHandler)
-		r.Get("/last", env.OTLastPosHandler)
-		r.Get("/locations", env.OTLocationsHandler)
-		r.Get("/version", OTVersionHandler)
-	})
+	r.Get("/location/", env.LocationHandler)
+	r.Head("/location/", env.LocationHeadHandler)
+	r.Get("/api/0/version", OTVersionHandler)
 
-	r.Get("/ws/last", func(w http.ResponseWriter, r *http.Request) {
-		env.wshandler(w, r)
+	// Share links are their own authorization
+	r.Route("/share/{token}", func(r chi.Router) {
+		r.Get("/", env.withShare(env.SharePageHandler))
+		r.Get("/last", env.withShare(env.ShareLastHandler))
+		r.Get("/track", env.withShare(env.ShareTrackHandler))
+		r.Get("/ws", env.withShare(env.ShareWebsocketHandler))
 	})
 
-	r.Get("/location/", env.LocationHandler)
-	r.Head("/location/", env.LocationHeadHandler)
+	r.Group(func(r chi.Router) {
+		if env.auth != nil {
+			r.Use(env.auth.Middleware)
+		}
+
+		r.Get("/place/", func(w http.ResponseWriter, r *http.Request) {
+			env.respondHTML(w, "place.gohtml", nil)
+		})
+		r.Post("/place/", env.PlaceHandler)
+		r.Get("/export/geojson/{from}/{to}", env.ExportGeoJSON)
+		r.Get("/export/gpx/{from}/{to}", env.ExportGPX)
+		r.Get("/export/kml/{from}/{to}", env.ExportKML)
+		r.Get("/export/csv/{from}/{to}", env.ExportCSV)
+		r.Get("/export/parquet/{from}/{to}", env.ExportParquet)
+
+		r.Route("/api/0", func(r chi.Router) {
+			r.Get("/list", env.OTListUserHandler)
+			r.Get("/last", env.OTLastPosHandler)
+			r.Get("/locations", env.OTLocationsHandler)
+			r.Get("/place", env.PlaceAPIHandler)
+			r.Get("/q", env.ReverseGeocodeHandler)
+			r.Get("/stream", env.StreamHandler)
+			r.Post("/import", env.ImportHandler)
+			r.Get("/shares", env.ListSharesHandler)
+			r.Post("/shares", env.CreateShareHandler)
+			r.Delete("/shares/{id}", env.DeleteShareHandler)
+			r.Get("/privacy-zones", env.ListPrivacyZonesHandler)
+			r.Post("/privacy-zones", env.CreatePrivacyZoneHandler)
+			r.Delete("/privacy-zones/{id}", env.DeletePrivacyZoneHandler)
+		})
+
+		r.Get("/ws/last", env.LiveWebsocketHandler)
+		r.Get("/ws/live", env.LiveAllWebsocketHandler)
+
+		// Pages and actions that cover every user's points, and managing who sees whom
+		r.Group(func(r chi.Router) {
+			r.Use(requireAdmin)
+
+			r.Get("/inaccurate/", env.GetInaccurateLocationPoints)
+			r.Delete("/points/{id}", env.DeleteLocationPoint)
+			r.Get("/points/{date}", env.GetPointsForDate)
+			r.Get("/api/0/friendships", env.ListFriendshipsHandler)
+			r.Post("/api/0/friendships", env.SaveFriendshipHandler)
+			r.Delete("/api/0/friendships/{id}", env.DeleteFriendshipHandler)
+		})
+	})
 
 	return r
 }
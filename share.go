@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const (
+	shareRequestMaxBytes = 4096
+	// shareCheckInterval is how often a share's WebSocket checks that the share hasn't
+	// been revoked.
+	shareCheckInterval = time.Minute
+)
+
+var errShareNotFound = errors.New("share not found or expired")
+
+// share lets anyone with its token see a user's position, and their track since the
+// share was created, until it expires. Coordinates are rounded to its precision.
+type share struct {
+	ID        int64          `json:"id"`
+	User      string         `json:"user"`
+	Device    string         `json:"device,omitempty"`
+	Precision PlacePrecision `json:"precision"`
+	CreatedBy string         `json:"createdBy,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	ExpiresAt time.Time      `json:"expiresAt"`
+	// Token and URL are only returned when the share is created, as only a hash of the
+	// token is stored
+	Token string `json:"token,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// shareRequest is the body of a request to create a share. The expiry is given either
+// as a duration from now or as a time.
+type shareRequest struct {
+	User      string     `json:"user"`
+	Device    string     `json:"device"`
+	ExpiresIn string     `json:"expiresIn"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	Precision string     `json:"precision"`
+}
+
+// parseShareRequest reads and validates a request to create a share. Users who aren't
+// admins can only share their own location, and the precision defaults to address.
+func parseShareRequest(r *http.Request, now time.Time) (share, error) {
+	var request shareRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return share{}, fmt.Errorf("invalid share request: %w", err)
+	}
+
+	result := share{Device: request.Device, Precision: PlacePrecisionAddress}
+
+	result.User, err = authorizeUser(r, request.User)
+	if err != nil {
+		return result, err
+	}
+
+	if result.User == "" {
+		return result, errors.New("user is required")
+	}
+
+	if request.Precision != "" {
+		err = result.Precision.Decode(request.Precision)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	switch {
+	case request.ExpiresIn != "" && request.ExpiresAt != nil:
+		return result, errors.New("give one of expiresIn and expiresAt, not both")
+	case request.ExpiresIn != "":
+		duration, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || duration <= 0 {
+			return result, fmt.Errorf("expiresIn %q should be a positive duration such as 3h", request.ExpiresIn)
+		}
+
+		result.ExpiresAt = now.Add(duration)
+	case request.ExpiresAt != nil:
+		if !request.ExpiresAt.After(now) {
+			return result, errors.New("expiresAt should be in the future")
+		}
+
+		result.ExpiresAt = *request.ExpiresAt
+	default:
+		return result, errors.New("expiresIn or expiresAt is required")
+	}
+
+	return result, nil
+}
+
+func hashShareToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// shareURL returns the link to a share's page, absolute if the public domain is
+// configured.
+func (env *Env) shareURL(token string) string {
+	path := "/share/" + token
+
+	switch domain := strings.TrimSuffix(env.configuration.Domain, "/"); {
+	case domain == "":
+		return path
+	case strings.Contains(domain, "://"):
+		return domain + path
+	default:
+		return "https://" + domain + path
+	}
+}
+
+// createShare stores a share with a new token, which is returned in the share.
+func (env *Env) createShare(ctx context.Context, newShare share) (share, error) {
+	newShare.Token = rand.Text()
+
+	err := env.database.QueryRowContext(ctx, `insert into shares
+    (token_hash, "user", device, place_precision, created_by, expires_at)
+values ($1, $2, $3, $4, $5, $6)
+returning id, created_at`,
+		hashShareToken(newShare.Token),
+		newShare.User,
+		newShare.Device,
+		string(newShare.Precision),
+		newShare.CreatedBy,
+		newShare.ExpiresAt,
+	).Scan(&newShare.ID, &newShare.CreatedAt)
+	if err != nil {
+		return newShare, fmt.Errorf("creating share: %w", err)
+	}
+
+	newShare.URL = env.shareURL(newShare.Token)
+
+	return newShare, nil
+}
+
+const shareColumns = `id, "user", device, place_precision, created_by, created_at, expires_at`
+
+func scanShare(row interface{ Scan(dest ...any) error }) (share, error) {
+	var result share
+
+	err := row.Scan(
+		&result.ID,
+		&result.User,
+		&result.Device,
+		&result.Precision,
+		&result.CreatedBy,
+		&result.CreatedAt,
+		&result.ExpiresAt,
+	)
+
+	return result, err
+}
+
+// getShare returns the unexpired share with the given token.
+func (env *Env) getShare(ctx context.Context, token string) (share, error) {
+	if env.database == nil {
+		return share{}, errors.New("no database connection available")
+	}
+
+	result, err := scanShare(env.database.QueryRowContext(ctx,
+		`select `+shareColumns+` from shares where token_hash = $1 and expires_at > now()`,
+		hashShareToken(token),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errShareNotFound
+	}
+
+	return result, err
+}
+
+// listShares returns the unexpired shares of a user, or of everyone if user is empty.
+func (env *Env) listShares(ctx context.Context, user string) ([]share, error) {
+	rows, err := env.database.QueryContext(ctx, `select `+shareColumns+`
+from shares
+where ($1 = '' or "user" = $1)
+  and expires_at > now()
+order by expires_at`, user)
+	if err != nil {
+		return nil, fmt.Errorf("listing shares: %w", err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	shares := []share{}
+
+	for rows.Next() {
+		result, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning share: %w", err)
+		}
+
+		shares = append(shares, result)
+	}
+
+	return shares, rows.Err()
+}
+
+// deleteShare revokes a share, if it belongs to user or user is empty. It returns
+// whether there was such a share.
+func (env *Env) deleteShare(ctx context.Context, id int64, user string) (bool, error) {
+	result, err := env.database.ExecContext(ctx,
+		`delete from shares where id = $1 and ($2 = '' or "user" = $2)`, id, user)
+	if err != nil {
+		return false, fmt.Errorf("deleting share: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return deleted > 0, err
+}
+
+// CreateShareHandler creates a share from the JSON body, responding with its token
+// and link.
+func (env *Env) CreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, shareRequestMaxBytes)
+
+	newShare, err := parseShareRequest(r, time.Now())
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	if user, ok := requestPrincipal(r); ok {
+		newShare.CreatedBy = user.User
+	}
+
+	newShare, err = env.createShare(ctx, newShare)
+	if err != nil {
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.With("id", newShare.ID).With("user", newShare.User).With("expiresAt", newShare.ExpiresAt).
+		InfoContext(ctx, "Created share")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(newShare)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to encode JSON response")
+	}
+}
+
+// ListSharesHandler lists the unexpired shares of the user query parameter, or of
+// everyone. Users who aren't admins only see their own.
+func (env *Env) ListSharesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := authorizeUser(r, r.URL.Query().Get("user"))
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	shares, err := env.listShares(r.Context(), user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, shares)
+}
+
+// DeleteShareHandler revokes a share. Users who aren't admins can only revoke their
+// own.
+func (env *Env) DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid share id", http.StatusBadRequest)
+
+		return
+	}
+
+	deleted, err := env.deleteShare(r.Context(), id, restrictedUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if !deleted {
+		http.Error(w, errShareNotFound.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withShare looks up the share named by the token in the path, responding with 404 if
+// it doesn't exist or has expired. Shared responses aren't cached, and the token isn't
+// leaked to other sites as a referrer.
+func (env *Env) withShare(handler func(w http.ResponseWriter, r *http.Request, token string, shared share)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token := chi.URLParam(r, "token")
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		shared, err := env.getShare(ctx, token)
+		if errors.Is(err, errShareNotFound) {
+			http.Error(w, "This share doesn't exist or has expired", http.StatusNotFound)
+
+			return
+		}
+
+		if err != nil {
+			InternalError(ctx, err)
+			http.Error(w, "Unable to look up share", http.StatusInternalServerError)
+
+			return
+		}
+
+		handler(w, r, token, shared)
+	}
+}
+
+// sharedLocation is a location as seen through a share, with only its position, time,
+// device and place name, at the share's precision.
+type sharedLocation struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Timestamp int64   `json:"tst"`
+	Device    string  `json:"device"`
+	Name      string  `json:"name,omitempty"`
+}
+
+func roundCoordinate(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+
+	return math.Round(value*scale) / scale
+}
+
+// location reduces a location to what the share shows.
+func (shared share) location(ctx context.Context, location Location) sharedLocation {
+	decimals := shared.Precision.CoordinateDecimals()
+	result := sharedLocation{
+		Latitude:  roundCoordinate(location.Latitude, decimals),
+		Longitude: roundCoordinate(location.Longitude, decimals),
+		Timestamp: location.Timestamp,
+		Device:    location.Device,
+	}
+
+	if location.Geocoding != "" {
+		result.Name = location.GeocodedName(ctx, shared.Precision)
+	}
+
+	return result
+}
+
+// sharedLastLocations returns the latest location of each shared device, with privacy
+// zones applied.
+func (env *Env) sharedLastLocations(ctx context.Context, shared share) ([]sharedLocation, error) {
+	locations, err := env.GetRedactedLastLocations(ctx, shared.User, shared.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]sharedLocation, len(locations))
+	for i, location := range locations {
+		results[i] = shared.location(ctx, location)
+	}
+
+	return results, nil
+}
+
+// roundGeometry rounds the coordinates of a track's geometry in place.
+func roundGeometry(geometry *geojson.Geometry, decimals int) {
+	roundPoints := func(points [][]float64) {
+		for _, point := range points {
+			for i := range point {
+				point[i] = roundCoordinate(point[i], decimals)
+			}
+		}
+	}
+
+	switch geometry.Type {
+	case geojson.GeometryPoint:
+		roundPoints([][]float64{geometry.Point})
+	case geojson.GeometryLineString:
+		roundPoints(geometry.LineString)
+	case geojson.GeometryMultiPoint:
+		roundPoints(geometry.MultiPoint)
+	case geojson.GeometryMultiLineString:
+		for _, line := range geometry.MultiLineString {
+			roundPoints(line)
+		}
+	case geojson.GeometryPolygon, geojson.GeometryMultiPolygon, geojson.GeometryCollection:
+	}
+}
+
+// sharedTrack returns the share's track since it was created as GeoJSON lines,
+// simplified and rounded to its precision.
+func (env *Env) sharedTrack(ctx context.Context, shared share, now time.Time) (*geojson.FeatureCollection, error) {
+	decimals := shared.Precision.CoordinateDecimals()
+	tolerance := math.Pow(10, -float64(decimals)) * metresPerDegree
+
+	to := now
+	if shared.ExpiresAt.Before(to) {
+		to = shared.ExpiresAt
+	}
+
+	rows, err := env.getTrackLines(ctx, shared.CreatedAt, to,
+		pointsFilter{User: shared.User, Device: shared.Device}, defaultSegmentGap, tolerance)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	collection := geojson.NewFeatureCollection()
+
+	for rows.Next() {
+		line, err := scanTrackLine(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		feature, err := line.Feature()
+		if err != nil {
+			return nil, err
+		}
+
+		roundGeometry(feature.Geometry, decimals)
+		collection.AddFeature(feature)
+	}
+
+	return collection, rows.Err()
+}
+
+// SharePageHandler shows a share's positions and track on a map.
+func (env *Env) SharePageHandler(w http.ResponseWriter, _ *http.Request, token string, shared share) {
+	env.respondHTML(w, "share.gohtml", map[string]any{
+		"token":     token,
+		"user":      shared.User,
+		"expiresAt": shared.ExpiresAt,
+	})
+}
+
+// ShareLastHandler returns the share and the latest position of each shared device.
+func (env *Env) ShareLastHandler(w http.ResponseWriter, r *http.Request, _ string, shared share) {
+	locations, err := env.sharedLastLocations(r.Context(), shared)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, map[string]any{
+		"user":      shared.User,
+		"device":    shared.Device,
+		"precision": shared.Precision,
+		"expiresAt": shared.ExpiresAt,
+		"locations": locations,
+	})
+}
+
+// ShareTrackHandler returns the share's track since it was created, as GeoJSON.
+func (env *Env) ShareTrackHandler(w http.ResponseWriter, r *http.Request, _ string, shared share) {
+	track, err := env.sharedTrack(r.Context(), shared, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	respondJSON(w, track)
+}
+
+// ShareWebsocketHandler pushes the share's latest positions, then each new one, until
+// the share expires or is revoked.
+//
+//nolint:funlen,cyclop
+func (env *Env) ShareWebsocketHandler(w http.ResponseWriter, r *http.Request, token string, shared share) {
+	ctx := r.Context()
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     websocketCheckOrigin(env.configuration.WebsocketOrigins),
+	}
+
+	filter := liveFilter{Users: []string{shared.User}}
+	if shared.Device != "" {
+		filter.Devices = []string{shared.Device}
+	}
+
+	// Subscribe before reading the latest positions so that none are missed
+	subscriber := liveLocations.Subscribe(filter)
+	defer liveLocations.Unsubscribe(subscriber)
+
+	last, err := env.sharedLastLocations(ctx, shared)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to set websocket upgrade")
+
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	// Clients don't send anything, but reading handles pongs and notices them leaving
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn.SetReadLimit(liveMaxMessageSize)
+		_ = conn.SetReadDeadline(time.Now().Add(livePongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongWait))
+		})
+
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(messageType int, data []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+
+		return conn.WriteMessage(messageType, data)
+	}
+
+	writeLocation := func(location sharedLocation) error {
+		message, err := json.Marshal(location)
+		if err != nil {
+			return err
+		}
+
+		return write(websocket.TextMessage, message)
+	}
+
+	closeShare := func() {
+		_ = write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "share ended"))
+	}
+
+	for _, location := range last {
+		err = writeLocation(location)
+		if err != nil {
+			return
+		}
+	}
+
+	expiry := time.NewTimer(time.Until(shared.ExpiresAt))
+	defer expiry.Stop()
+
+	pings := time.NewTicker(livePingPeriod)
+	defer pings.Stop()
+
+	checks := time.NewTicker(shareCheckInterval)
+	defer checks.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-expiry.C:
+			closeShare()
+
+			return
+		case <-checks.C:
+			// Only a revoked share ends the stream, not a failure to check
+			_, err = env.getShare(ctx, token)
+			if errors.Is(err, errShareNotFound) {
+				closeShare()
+
+				return
+			}
+
+			err = nil
+		case <-pings.C:
+			err = write(websocket.PingMessage, nil)
+		case event, ok := <-subscriber.Events():
+			if !ok {
+				_ = write(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+
+				return
+			}
+
+			if event.Type != locationType {
+				continue
+			}
+
+			location, ok := env.redactLiveLocation(ctx, event.Location)
+			if ok {
+				err = writeLocation(shared.location(ctx, location))
+			}
+		}
+
+		if err != nil {
+			slog.With("err", err).WarnContext(ctx, "error writing message to share websocket")
+
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shareRequestFor(user principal, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/0/shares", strings.NewReader(body))
+	if user.User != "" {
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, user))
+	}
+
+	return r
+}
+
+func TestParseShareRequest(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	alice := principal{User: "alice"}
+
+	shared, err := parseShareRequest(shareRequestFor(alice, `{"expiresIn": "3h"}`), now)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", shared.User)
+	assert.Equal(t, PlacePrecisionAddress, shared.Precision)
+	assert.Equal(t, now.Add(3*time.Hour), shared.ExpiresAt)
+
+	shared, err = parseShareRequest(shareRequestFor(alice,
+		`{"device": "iphone", "precision": "city", "expiresAt": "2024-06-02T00:00:00Z"}`), now)
+	require.NoError(t, err)
+	assert.Equal(t, "iphone", shared.Device)
+	assert.Equal(t, PlacePrecisionCity, shared.Precision)
+	assert.Equal(t, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC), shared.ExpiresAt)
+
+	_, err = parseShareRequest(shareRequestFor(alice, `{"user": "bob", "expiresIn": "3h"}`), now)
+	require.ErrorIs(t, err, errForbidden)
+
+	for _, body := range []string{
+		`{"expiresIn": "3h", "precision": "street"}`,
+		`{"expiresIn": "-1h"}`,
+		`{"expiresAt": "2024-06-01T11:00:00Z"}`,
+		`{"expiresIn": "3h", "expiresAt": "2024-06-02T00:00:00Z"}`,
+		`{}`,
+	} {
+		_, err = parseShareRequest(shareRequestFor(alice, body), now)
+		assert.Error(t, err, body)
+	}
+
+	// Without authentication there's no one to default to
+	_, err = parseShareRequest(shareRequestFor(principal{}, `{"expiresIn": "3h"}`), now)
+	assert.Error(t, err)
+}
+
+func TestShareURL(t *testing.T) {
+	env := Env{configuration: &Configuration{}}
+	assert.Equal(t, "/share/abc", env.shareURL("abc"))
+
+	env.configuration.Domain = "where.example.com"
+	assert.Equal(t, "https://where.example.com/share/abc", env.shareURL("abc"))
+
+	env.configuration.Domain = "http://localhost:8080/"
+	assert.Equal(t, "http://localhost:8080/share/abc", env.shareURL("abc"))
+}
+
+func TestShareLocationIsReducedToPrecision(t *testing.T) {
+	battery := 80
+	shared := share{User: "alice", Precision: PlacePrecisionCity}
+
+	location := shared.location(t.Context(), Location{
+		Latitude:  51.50551,
+		Longitude: -0.07539,
+		Timestamp: 1717243200,
+		Device:    "iphone",
+		Battery:   &battery,
+		Geocoding: `{"address": {"road": "Tower Bridge Road", "city": "London"}}`,
+	})
+
+	assert.Equal(t, sharedLocation{
+		Latitude:  51.51,
+		Longitude: -0.08,
+		Timestamp: 1717243200,
+		Device:    "iphone",
+		Name:      "London",
+	}, location)
+}
+
+func TestRoundGeometry(t *testing.T) {
+	line := geojson.NewLineStringGeometry([][]float64{{-0.07539, 51.50551}, {-0.12345, 51.49999}})
+	roundGeometry(line, 2)
+	assert.Equal(t, [][]float64{{-0.08, 51.51}, {-0.12, 51.5}}, line.LineString)
+
+	lines := geojson.NewMultiLineStringGeometry([][]float64{{-0.07539, 51.50551}}, [][]float64{{1.23456, 2.34567}})
+	roundGeometry(lines, 1)
+	assert.Equal(t, [][][]float64{{{-0.1, 51.5}}, {{1.2, 2.3}}}, lines.MultiLineString)
+}
+
+func TestSharePageRenders(t *testing.T) {
+	env := Env{configuration: &Configuration{}}
+	env.BuildRoutes(env.configuration)
+
+	recorder := httptest.NewRecorder()
+	env.SharePageHandler(recorder, httptest.NewRequest(http.MethodGet, "/share/abc", nil), "abc", share{
+		User:      "alice",
+		ExpiresAt: time.Date(2024, 6, 1, 15, 0, 0, 0, time.UTC),
+	})
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `const token = "abc";`)
+	assert.Contains(t, recorder.Body.String(), "alice's location, shared until")
+}
+
+func TestShareRoutesArePublic(t *testing.T) {
+	configuration := &Configuration{AuthTokens: "alice:a-token"}
+	env := Env{configuration: configuration}
+	env.auth = testAuthenticator(t, configuration)
+	router := env.BuildRoutes(configuration)
+
+	// Without a database the share can't be found, but the request gets that far
+	for _, target := range []string{"/share/abc", "/share/abc/last", "/share/abc/track"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusInternalServerError, recorder.Code, target)
+		assert.Equal(t, "no-referrer", recorder.Header().Get("Referrer-Policy"), target)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/0/shares", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+const (
+	sinkTypeDawarich = "dawarich"
+	sinkTypeRecorder = "recorder"
+	sinkTypeWebhook  = "webhook"
+	sinkTypeMQTT     = "mqtt"
+	sinkTypeInfluxDB = "influxdb"
+
+	legacyDawarichSinkName = "dawarich"
+
+	defaultSinkMaxAge         = 168 * time.Hour
+	defaultSinkInitialBackoff = 10 * time.Second
+	defaultSinkMaxBackoff     = time.Hour
+)
+
+// Sink delivers a single location to an external system.
+type Sink interface {
+	Send(ctx context.Context, msg MQTTMsg) error
+}
+
+// sinkFilter is implemented by sinks that only accept some locations, in addition to
+// the users and devices filters common to every sink.
+type sinkFilter interface {
+	Accepts(msg MQTTMsg) bool
+}
+
+// ForwardingSink is a configured Sink together with the settings that are common
+// to every sink type: which locations it accepts and how failed deliveries are retried.
+type ForwardingSink struct {
+	Name    string
+	Type    string
+	Users   []string
+	Devices []string
+	Retry   RetryPolicy
+	Sink    Sink
+}
+
+// Accepts reports whether a location passes the sink's user and device filters.
+// An empty filter accepts everything.
+func (sink *ForwardingSink) Accepts(msg MQTTMsg) bool {
+	if len(sink.Users) > 0 && !stringSliceContains(sink.Users, msg.User) {
+		return false
+	}
+
+	if len(sink.Devices) > 0 && !stringSliceContains(sink.Devices, msg.Device) {
+		return false
+	}
+
+	if filter, ok := sink.Sink.(sinkFilter); ok {
+		return filter.Accepts(msg)
+	}
+
+	return true
+}
+
+// RetryPolicy describes how the outbox retries deliveries to a sink.
+type RetryPolicy struct {
+	MaxAge         time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Backoff returns how long to wait before the next delivery attempt, doubling with
+// each attempt up to MaxBackoff.
+func (policy RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := policy.InitialBackoff
+
+	for range attempts {
+		delay *= 2
+		if delay >= policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+
+	return delay
+}
+
+// configDuration is a time.Duration that unmarshals from a Go duration string.
+type configDuration time.Duration
+
+func (duration *configDuration) UnmarshalJSON(data []byte) error {
+	var asString string
+
+	err := json.Unmarshal(data, &asString)
+	if err != nil {
+		return fmt.Errorf("duration should be a string: %w", err)
+	}
+
+	parsed, err := time.ParseDuration(asString)
+	if err != nil {
+		return err
+	}
+
+	*duration = configDuration(parsed)
+
+	return nil
+}
+
+//nolint:tagliatelle
+type RetryConfig struct {
+	MaxAge         configDuration `json:"max_age"`
+	InitialBackoff configDuration `json:"initial_backoff"`
+	MaxBackoff     configDuration `json:"max_backoff"`
+}
+
+func (retryConfig RetryConfig) policy() RetryPolicy {
+	policy := RetryPolicy{
+		MaxAge:         time.Duration(retryConfig.MaxAge),
+		InitialBackoff: time.Duration(retryConfig.InitialBackoff),
+		MaxBackoff:     time.Duration(retryConfig.MaxBackoff),
+	}
+
+	if policy.MaxAge <= 0 {
+		policy.MaxAge = defaultSinkMaxAge
+	}
+
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultSinkInitialBackoff
+	}
+
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultSinkMaxBackoff
+	}
+
+	return policy
+}
+
+// SinkConfig is the configuration for a single sink, as read from the SinksConfig file.
+// Not every field applies to every sink type.
+//
+//nolint:tagliatelle
+type SinkConfig struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	URL         string            `json:"url"`
+	APIKey      string            `json:"api_key"`
+	Token       string            `json:"token"`
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	ClientID    string            `json:"client_id"`
+	Topic       string            `json:"topic"`
+	Measurement string            `json:"measurement"`
+	Headers     map[string]string `json:"headers"`
+	Users       []string          `json:"users"`
+	Devices     []string          `json:"devices"`
+	Template    string            `json:"template"`
+	Retry       RetryConfig       `json:"retry"`
+	Accounts    []DawarichAccount `json:"accounts"`
+}
+
+var sinkTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		marshalled, err := json.Marshal(v)
+
+		return string(marshalled), err
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+}
+
+// parseSinkTemplate parses an optional payload template. An empty template returns nil.
+func parseSinkTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	tmpl, err := template.New(name).Funcs(sinkTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template for sink %s: %w", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// renderSinkPayload renders msg through tmpl if one is configured, otherwise it
+// returns the sink's default payload.
+func renderSinkPayload(
+	tmpl *template.Template,
+	msg MQTTMsg,
+	defaultPayload func() ([]byte, error),
+) ([]byte, error) {
+	if tmpl == nil {
+		return defaultPayload()
+	}
+
+	var buffer bytes.Buffer
+
+	err := tmpl.Execute(&buffer, msg)
+	if err != nil {
+		return nil, fmt.Errorf("rendering payload template: %w", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func newSink(config SinkConfig) (*ForwardingSink, error) {
+	if config.Name == "" {
+		return nil, errors.New("sink name should not be blank")
+	}
+
+	tmpl, err := parseSinkTemplate(config.Name, config.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var sink Sink
+
+	switch config.Type {
+	case sinkTypeDawarich:
+		sink, err = newDawarichSink(config, tmpl)
+	case sinkTypeRecorder:
+		sink, err = newRecorderSink(config, tmpl)
+	case sinkTypeWebhook:
+		sink, err = newWebhookSink(config, tmpl)
+	case sinkTypeMQTT:
+		sink, err = newMQTTSink(config, tmpl)
+	case sinkTypeInfluxDB:
+		sink, err = newInfluxDBSink(config, tmpl)
+	default:
+		err = fmt.Errorf("unknown sink type %q", config.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("configuring sink %s: %w", config.Name, err)
+	}
+
+	return &ForwardingSink{
+		Name:    config.Name,
+		Type:    config.Type,
+		Users:   config.Users,
+		Devices: config.Devices,
+		Retry:   config.Retry.policy(),
+		Sink:    sink,
+	}, nil
+}
+
+// parseSinkConfigs builds sinks from a JSON array of SinkConfig.
+func parseSinkConfigs(data []byte) ([]*ForwardingSink, error) {
+	var configs []SinkConfig
+
+	err := json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("decoding sinks config: %w", err)
+	}
+
+	sinks := make([]*ForwardingSink, 0, len(configs))
+	names := make(map[string]struct{}, len(configs))
+
+	for _, config := range configs {
+		if _, duplicate := names[config.Name]; duplicate {
+			return nil, fmt.Errorf("duplicate sink name %q", config.Name)
+		}
+
+		names[config.Name] = struct{}{}
+
+		sink, err := newSink(config)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// loadSinks returns the sinks described by the SinksConfig file, plus a Dawarich sink
+// built from the DawarichURL/DawarichAPIKey settings if they are set.
+func loadSinks(configuration *Configuration) ([]*ForwardingSink, error) {
+	var sinks []*ForwardingSink
+
+	if configuration.SinksConfig != "" {
+		data, err := os.ReadFile(configuration.SinksConfig)
+		if err != nil {
+			return nil, fmt.Errorf("reading sinks config: %w", err)
+		}
+
+		sinks, err = parseSinkConfigs(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if configuration.DawarichURL != "" {
+		if findSink(sinks, legacyDawarichSinkName) != nil {
+			return nil, fmt.Errorf(
+				"sink name %q is reserved when DawarichURL is set",
+				legacyDawarichSinkName,
+			)
+		}
+
+		accounts, err := parseDawarichAccounts(configuration.DawarichAccounts)
+		if err != nil {
+			return nil, err
+		}
+
+		sink, err := newSink(SinkConfig{
+			Name:     legacyDawarichSinkName,
+			Type:     sinkTypeDawarich,
+			URL:      configuration.DawarichURL,
+			APIKey:   configuration.DawarichAPIKey,
+			Accounts: accounts,
+			Retry:    RetryConfig{MaxAge: configDuration(configuration.DawarichOutboxMaxAge)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+func findSink(sinks []*ForwardingSink, name string) *ForwardingSink {
+	for _, sink := range sinks {
+		if sink.Name == name {
+			return sink
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const sinkHTTPTimeout = 10 * time.Second
+
+var jsonHeaders = map[string]string{"Content-Type": "application/json"}
+
+// sendHTTPPayload sends body to url and returns the response status code.
+func sendHTTPPayload(
+	ctx context.Context,
+	method string,
+	url string,
+	headers map[string]string,
+	body []byte,
+) (int, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, sinkHTTPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("creating request: %w", err)
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// mergeHeaders returns a new map with the headers of each map in turn, so later maps
+// override earlier ones.
+func mergeHeaders(headers ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, header := range headers {
+		maps.Copy(merged, header)
+	}
+
+	return merged
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// RecorderSink forwards locations to another OwnTracks Recorder using its HTTP mode.
+type RecorderSink struct {
+	URL      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func newRecorderSink(config SinkConfig, tmpl *template.Template) (*RecorderSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("recorder sink requires a url")
+	}
+
+	return &RecorderSink{
+		URL:      strings.TrimSuffix(config.URL, "/") + "/pub",
+		headers:  mergeHeaders(jsonHeaders, config.Headers),
+		template: tmpl,
+	}, nil
+}
+
+func (sink *RecorderSink) Send(ctx context.Context, msg MQTTMsg) error {
+	body, err := renderSinkPayload(sink.template, msg, func() ([]byte, error) {
+		return json.Marshal(newOwnTracksPayload(msg))
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := mergeHeaders(map[string]string{"X-Limit-U": msg.User, "X-Limit-D": msg.Device}, sink.headers)
+
+	status, err := sendHTTPPayload(ctx, http.MethodPost, sink.URL, headers, body)
+	if err != nil {
+		return fmt.Errorf("sending to recorder: %w", err)
+	}
+
+	if !isSuccessStatus(status) {
+		return fmt.Errorf("recorder returned unexpected status %d", status)
+	}
+
+	return nil
+}
+
+// webhookPayload is the default JSON body sent by WebhookSink.
+type webhookPayload struct {
+	ownTracksPayload
+
+	User   string `json:"user"`
+	Device string `json:"device"`
+}
+
+// WebhookSink POSTs each location as JSON to an arbitrary URL.
+type WebhookSink struct {
+	URL      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func newWebhookSink(config SinkConfig, tmpl *template.Template) (*WebhookSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook sink requires a url")
+	}
+
+	return &WebhookSink{
+		URL:      config.URL,
+		headers:  mergeHeaders(jsonHeaders, config.Headers),
+		template: tmpl,
+	}, nil
+}
+
+func (sink *WebhookSink) Send(ctx context.Context, msg MQTTMsg) error {
+	body, err := renderSinkPayload(sink.template, msg, func() ([]byte, error) {
+		return json.Marshal(webhookPayload{
+			ownTracksPayload: newOwnTracksPayload(msg),
+			User:             msg.User,
+			Device:           msg.Device,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	status, err := sendHTTPPayload(ctx, http.MethodPost, sink.URL, sink.headers, body)
+	if err != nil {
+		return fmt.Errorf("sending to webhook: %w", err)
+	}
+
+	if !isSuccessStatus(status) {
+		return fmt.Errorf("webhook returned unexpected status %d", status)
+	}
+
+	return nil
+}
+
+// InfluxDBSink writes locations to an InfluxDB write endpoint using line protocol.
+type InfluxDBSink struct {
+	URL         string
+	Measurement string
+	headers     map[string]string
+	template    *template.Template
+}
+
+func newInfluxDBSink(config SinkConfig, tmpl *template.Template) (*InfluxDBSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("influxdb sink requires a url")
+	}
+
+	writeURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing influxdb url: %w", err)
+	}
+
+	// Timestamps are written in seconds
+	query := writeURL.Query()
+	query.Set("precision", "s")
+	writeURL.RawQuery = query.Encode()
+
+	measurement := config.Measurement
+	if measurement == "" {
+		measurement = locationType
+	}
+
+	headers := map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+	if config.Token != "" {
+		headers["Authorization"] = "Token " + config.Token
+	}
+
+	return &InfluxDBSink{
+		URL:         writeURL.String(),
+		Measurement: measurement,
+		headers:     mergeHeaders(headers, config.Headers),
+		template:    tmpl,
+	}, nil
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func formatInfluxFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatInfluxFloat32(value float32) string {
+	return strconv.FormatFloat(float64(value), 'f', -1, 32)
+}
+
+// lineProtocol renders a location as an InfluxDB line protocol record.
+func (sink *InfluxDBSink) lineProtocol(msg MQTTMsg) string {
+	var line strings.Builder
+
+	line.WriteString(influxTagEscaper.Replace(sink.Measurement))
+
+	for _, tag := range [][2]string{{"user", msg.User}, {"device", msg.Device}, {"tid", msg.TrackerID}} {
+		if tag[1] != "" {
+			line.WriteString("," + tag[0] + "=" + influxTagEscaper.Replace(tag[1]))
+		}
+	}
+
+	fields := []string{
+		"lat=" + formatInfluxFloat(msg.Latitude),
+		"lon=" + formatInfluxFloat(msg.Longitude),
+		"acc=" + formatInfluxFloat32(msg.Accuracy),
+		"alt=" + formatInfluxFloat32(msg.Altitude),
+		"vac=" + formatInfluxFloat32(msg.VerticalAccuracy),
+		"vel=" + formatInfluxFloat32(msg.Speed),
+		"cog=" + strconv.Itoa(msg.Course) + "i",
+		"batt=" + strconv.Itoa(msg.Battery) + "i",
+	}
+
+	line.WriteString(" " + strings.Join(fields, ","))
+	line.WriteString(" " + strconv.FormatInt(msg.DeviceTimestampAsInt, 10))
+
+	return line.String()
+}
+
+func (sink *InfluxDBSink) Send(ctx context.Context, msg MQTTMsg) error {
+	body, err := renderSinkPayload(sink.template, msg, func() ([]byte, error) {
+		return []byte(sink.lineProtocol(msg)), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	status, err := sendHTTPPayload(ctx, http.MethodPost, sink.URL, sink.headers, body)
+	if err != nil {
+		return fmt.Errorf("sending to influxdb: %w", err)
+	}
+
+	if !isSuccessStatus(status) {
+		return fmt.Errorf("influxdb returned unexpected status %d", status)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultMQTTSinkTopic    = "owntracks/{{.User}}/{{.Device}}"
+	mqttSinkPublishTimeout  = 10 * time.Second
+	defaultMQTTSinkClientID = "owntracks-pg-recorder-sink"
+)
+
+// MQTTSink republishes locations to another MQTT broker. The connection is made
+// lazily on the first send and reused afterwards.
+type MQTTSink struct {
+	options  *mqtt.ClientOptions
+	topic    *template.Template
+	template *template.Template
+
+	mutex  sync.Mutex
+	client mqtt.Client
+}
+
+func newMQTTSink(config SinkConfig, tmpl *template.Template) (*MQTTSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("mqtt sink requires a url")
+	}
+
+	topicText := config.Topic
+	if topicText == "" {
+		topicText = defaultMQTTSinkTopic
+	}
+
+	topic, err := template.New(config.Name + "-topic").Funcs(sinkTemplateFuncs).Parse(topicText)
+	if err != nil {
+		return nil, fmt.Errorf("parsing topic template: %w", err)
+	}
+
+	clientID := config.ClientID
+	if clientID == "" {
+		clientID = defaultMQTTSinkClientID + "-" + config.Name
+	}
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(config.URL)
+	options.SetClientID(clientID)
+	options.SetAutoReconnect(true)
+
+	if config.Username != "" {
+		options.SetUsername(config.Username)
+		options.SetPassword(config.Password)
+	}
+
+	return &MQTTSink{options: options, topic: topic, template: tmpl}, nil
+}
+
+func (sink *MQTTSink) connect() (mqtt.Client, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.client != nil {
+		return sink.client, nil
+	}
+
+	client := mqtt.NewClient(sink.options)
+
+	token := client.Connect()
+	if !token.WaitTimeout(mqttSinkPublishTimeout) {
+		return nil, errors.New("timed out connecting to mqtt sink broker")
+	}
+
+	if token.Error() != nil {
+		return nil, fmt.Errorf("connecting to mqtt sink broker: %w", token.Error())
+	}
+
+	sink.client = client
+
+	return client, nil
+}
+
+func (sink *MQTTSink) Send(_ context.Context, msg MQTTMsg) error {
+	var topic bytes.Buffer
+
+	err := sink.topic.Execute(&topic, msg)
+	if err != nil {
+		return fmt.Errorf("rendering topic: %w", err)
+	}
+
+	body, err := renderSinkPayload(sink.template, msg, func() ([]byte, error) {
+		return json.Marshal(newOwnTracksPayload(msg))
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := sink.connect()
+	if err != nil {
+		return err
+	}
+
+	token := client.Publish(topic.String(), 1, false, body)
+	if !token.WaitTimeout(mqttSinkPublishTimeout) {
+		return errors.New("timed out publishing to mqtt sink broker")
+	}
+
+	return token.Error()
+}
+
+// Close disconnects from the broker, if connected.
+func (sink *MQTTSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.client != nil {
+		sink.client.Disconnect(mqttDisconnectTimeoutMs)
+		sink.client = nil
+	}
+
+	return nil
+}
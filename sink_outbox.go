@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const sinkOutboxPollInterval = 5 * time.Second
+
+// SinkOutboxSignal wakes the outbox worker after new rows have been committed,
+// so that forwarding doesn't have to wait for the next poll.
+var SinkOutboxSignal chan struct{}
+
+type outboxEntry struct {
+	ID        int64
+	Sink      string
+	Payload   MQTTMsg
+	Attempts  int
+	CreatedAt time.Time
+}
+
+type outboxOutcome string
+
+const (
+	outboxDelivered outboxOutcome = "delivered"
+	outboxRetry     outboxOutcome = "retry"
+	outboxAbandoned outboxOutcome = "abandoned"
+)
+
+// enqueueSinkOutbox records a location for forwarding to every sink that accepts it,
+// as part of the caller's transaction, so that it is only forwarded if the location
+// insert commits. The user's privacy zones apply, so a location in one is forwarded at
+// the zone's centre or not at all. It returns whether anything was queued.
+//
+//nolint:cyclop
+func enqueueSinkOutbox(
+	ctx context.Context,
+	tx *sql.Tx,
+	sinks []*ForwardingSink,
+	locationID int,
+	msg MQTTMsg,
+) (bool, error) {
+	var payload []byte
+
+	queued := false
+
+	for _, sink := range sinks {
+		if !sink.Accepts(msg) {
+			continue
+		}
+
+		if payload == nil {
+			zone, err := privacyZoneAt(ctx, tx, msg.User, msg.Latitude, msg.Longitude)
+			if err != nil {
+				return false, err
+			}
+
+			if zone != nil && zone.Action == privacyZoneSuppress {
+				return false, nil
+			}
+
+			if zone != nil {
+				msg.Latitude = zone.Latitude
+				msg.Longitude = zone.Longitude
+			}
+
+			payload, err = json.Marshal(msg)
+			if err != nil {
+				return false, fmt.Errorf("marshalling outbox payload: %w", err)
+			}
+		}
+
+		_, err := tx.ExecContext(
+			ctx,
+			"insert into sink_outbox (location_id, sink, payload) values ($1, $2, $3)",
+			locationID,
+			sink.Name,
+			payload,
+		)
+		if err != nil {
+			return false, fmt.Errorf("inserting outbox row for sink %s: %w", sink.Name, err)
+		}
+
+		queued = true
+	}
+
+	return queued, nil
+}
+
+// signalSinkOutbox wakes the outbox worker without blocking.
+func signalSinkOutbox() {
+	if SinkOutboxSignal == nil {
+		return
+	}
+
+	select {
+	case SinkOutboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// DrainSinkOutbox forwards rows from the sink_outbox table to their sinks until the
+// context is cancelled. Failed deliveries are retried according to each sink's
+// RetryPolicy. Rows for sinks that aren't configured are left in the outbox, so that
+// they're delivered if the sink is configured again.
+func (env *Env) DrainSinkOutbox(ctx context.Context) {
+	slog.With("sinks", len(env.sinks)).InfoContext(ctx, "Starting sink outbox worker")
+
+	env.warnAboutParkedOutboxEntries(ctx)
+
+	ticker := time.NewTicker(sinkOutboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		env.drainDueOutboxEntries(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-SinkOutboxSignal:
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "Sink outbox worker shutting down")
+
+			for _, sink := range env.sinks {
+				if closer, ok := sink.Sink.(io.Closer); ok {
+					_ = closer.Close()
+				}
+			}
+
+			return
+		}
+	}
+}
+
+// sinkNames returns the names of the configured sinks.
+func (env *Env) sinkNames() []string {
+	names := make([]string, 0, len(env.sinks))
+	for _, sink := range env.sinks {
+		names = append(names, sink.Name)
+	}
+
+	return names
+}
+
+// warnAboutParkedOutboxEntries logs the outbox rows that won't be delivered because
+// their sink isn't configured.
+func (env *Env) warnAboutParkedOutboxEntries(ctx context.Context) {
+	rows, err := env.database.QueryContext(ctx, `select sink, count(*)
+from sink_outbox
+where not (sink = any($1))
+group by sink`, pq.Array(env.sinkNames()))
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error counting parked outbox rows")
+
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var (
+			sink  string
+			count int
+		)
+
+		err = rows.Scan(&sink, &count)
+		if err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Error counting parked outbox rows")
+
+			return
+		}
+
+		slog.With("sink", sink).
+			With("rows", count).
+			WarnContext(ctx, "Outbox has rows for a sink that isn't configured, keeping them")
+	}
+}
+
+func (env *Env) drainDueOutboxEntries(ctx context.Context) {
+	for ctx.Err() == nil {
+		processed, err := env.processNextOutboxEntry(ctx)
+		if err != nil {
+			slog.With("err", err).
+				ErrorContext(ctx, "Error processing sink outbox")
+
+			return
+		}
+
+		if !processed {
+			return
+		}
+	}
+}
+
+// processNextOutboxEntry locks and delivers a single due outbox row. It returns false
+// when there are no rows due.
+//
+//nolint:funlen
+func (env *Env) processNextOutboxEntry(ctx context.Context) (bool, error) {
+	tx, err := env.database.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("beginning outbox transaction: %w", err)
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		entry   outboxEntry
+		payload []byte
+	)
+
+	err = tx.QueryRowContext(ctx, `select id, sink, payload, attempts, created_at
+from sink_outbox
+where next_attempt_at <= now() and sink = any($1)
+order by id
+limit 1 for update skip locked`, pq.Array(env.sinkNames())).
+		Scan(&entry.ID, &entry.Sink, &payload, &entry.Attempts, &entry.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("fetching outbox row: %w", err)
+	}
+
+	sink := findSink(env.sinks, entry.Sink)
+
+	err = json.Unmarshal(payload, &entry.Payload)
+	if err != nil {
+		slog.With("err", err).
+			With("id", entry.ID).
+			With("sink", entry.Sink).
+			ErrorContext(ctx, "Undeliverable outbox row, discarding")
+
+		_, err = tx.ExecContext(ctx, "delete from sink_outbox where id = $1", entry.ID)
+		if err != nil {
+			return false, fmt.Errorf("deleting outbox row: %w", err)
+		}
+
+		return true, tx.Commit()
+	}
+
+	outcome, sendErr := env.deliverOutboxEntry(ctx, sink, entry, time.Now())
+	env.metrics.sinkOutcome(sink.Name, outcome)
+
+	switch outcome {
+	case outboxDelivered, outboxAbandoned:
+		_, err = tx.ExecContext(ctx, "delete from sink_outbox where id = $1", entry.ID)
+	case outboxRetry:
+		_, err = tx.ExecContext(ctx, `update sink_outbox
+set attempts = attempts + 1, next_attempt_at = $2, last_error = $3
+where id = $1`,
+			entry.ID,
+			time.Now().Add(sink.Retry.Backoff(entry.Attempts)),
+			sendErr.Error(),
+		)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("updating outbox row: %w", err)
+	}
+
+	return true, tx.Commit()
+}
+
+// deliverOutboxEntry attempts to send an outbox entry to its sink and decides what
+// should happen to its row.
+func (env *Env) deliverOutboxEntry(
+	ctx context.Context,
+	sink *ForwardingSink,
+	entry outboxEntry,
+	now time.Time,
+) (outboxOutcome, error) {
+	msg := entry.Payload
+
+	err := sink.Sink.Send(ctx, msg)
+	if err == nil {
+		slog.With("sink", sink.Name).
+			With("user", msg.User).
+			With("device", msg.Device).
+			DebugContext(ctx, "Forwarded location to sink")
+
+		return outboxDelivered, nil
+	}
+
+	logger := slog.With("err", err).
+		With("sink", sink.Name).
+		With("id", entry.ID).
+		With("attempts", entry.Attempts+1).
+		With("user", msg.User).
+		With("device", msg.Device).
+		With("timestamp", msg.DeviceTimestamp)
+
+	if now.Sub(entry.CreatedAt) >= sink.Retry.MaxAge {
+		logger.ErrorContext(ctx, "Giving up forwarding location to sink")
+
+		return outboxAbandoned, err
+	}
+
+	logger.WarnContext(ctx, "Failed to forward location to sink, will retry")
+
+	return outboxRetry, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSinkConfigs(t *testing.T) {
+	sinks, err := parseSinkConfigs([]byte(`[
+  {"name": "family", "type": "dawarich", "url": "http://dawarich:3000", "api_key": "abc",
+   "users": ["alice"], "retry": {"max_age": "24h", "initial_backoff": "1s"}},
+  {"name": "hook", "type": "webhook", "url": "http://hook", "devices": ["phone"]},
+  {"name": "influx", "type": "influxdb", "url": "http://influx:8086/api/v2/write?bucket=b"},
+  {"name": "broker", "type": "mqtt", "url": "tcp://broker:1883"},
+  {"name": "recorder", "type": "recorder", "url": "http://recorder:8083/"}
+]`))
+	require.NoError(t, err)
+	require.Len(t, sinks, 5)
+
+	assert.Equal(t, RetryPolicy{
+		MaxAge:         24 * time.Hour,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Hour,
+	}, sinks[0].Retry)
+	assert.IsType(t, &DawarichSink{}, sinks[0].Sink)
+	assert.IsType(t, &WebhookSink{}, sinks[1].Sink)
+	assert.IsType(t, &MQTTSink{}, sinks[3].Sink)
+	assert.Equal(t, "http://recorder:8083/pub", sinks[4].Sink.(*RecorderSink).URL)
+}
+
+func TestParseSinkConfigsRejectsBadConfig(t *testing.T) {
+	_, err := parseSinkConfigs([]byte(`[{"name": "x", "type": "carrier-pigeon"}]`))
+	require.Error(t, err)
+
+	_, err = parseSinkConfigs([]byte(`[{"name": "x", "type": "webhook"}]`))
+	require.Error(t, err)
+
+	_, err = parseSinkConfigs([]byte(`[
+  {"name": "x", "type": "webhook", "url": "http://a"},
+  {"name": "x", "type": "webhook", "url": "http://b"}
+]`))
+	require.Error(t, err)
+}
+
+func TestLoadSinksAddsLegacyDawarichSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sinks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "hook", "type": "webhook", "url": "http://hook"}]`), 0o600))
+
+	sinks, err := loadSinks(&Configuration{
+		SinksConfig:          path,
+		DawarichURL:          "http://dawarich",
+		DawarichAPIKey:       "key",
+		DawarichOutboxMaxAge: 2 * time.Hour,
+	})
+	require.NoError(t, err)
+	require.Len(t, sinks, 2)
+
+	dawarich := findSink(sinks, legacyDawarichSinkName)
+	require.NotNil(t, dawarich)
+	assert.Equal(t, 2*time.Hour, dawarich.Retry.MaxAge)
+}
+
+func TestForwardingSinkAccepts(t *testing.T) {
+	sink := &ForwardingSink{Users: []string{"alice"}, Devices: []string{"iphone"}}
+
+	msg := testMQTTMsg()
+	assert.True(t, sink.Accepts(msg))
+
+	msg.Device = "ipad"
+	assert.False(t, sink.Accepts(msg))
+
+	msg = testMQTTMsg()
+	msg.User = "bob"
+	assert.False(t, sink.Accepts(msg))
+
+	assert.True(t, (&ForwardingSink{}).Accepts(msg))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryConfig{}.policy()
+
+	assert.Equal(t, 10*time.Second, policy.Backoff(0))
+	assert.Equal(t, 20*time.Second, policy.Backoff(1))
+	assert.Equal(t, 80*time.Second, policy.Backoff(3))
+	assert.Equal(t, time.Hour, policy.Backoff(20))
+}
+
+func TestWebhookSinkRendersTemplate(t *testing.T) {
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		body, _ = io.ReadAll(r.Body)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sinks, err := parseSinkConfigs([]byte(`[{"name": "hook", "type": "webhook", "url": "` + server.URL + `",
+  "headers": {"X-Token": "secret"},
+  "template": "{\"who\": {{json .User}}, \"when\": \"{{rfc3339 .DeviceTimestamp}}\"}"}]`))
+	require.NoError(t, err)
+
+	require.NoError(t, sinks[0].Sink.Send(t.Context(), testMQTTMsg()))
+	assert.JSONEq(t, `{"who": "alice", "when": "2024-01-01T00:00:00Z"}`, string(body))
+}
+
+func TestWebhookSinkDefaultPayload(t *testing.T) {
+	var received map[string]any
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	sink, err := newWebhookSink(SinkConfig{URL: server.URL}, nil)
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(t.Context(), testMQTTMsg()))
+
+	assert.Equal(t, "alice", received["user"])
+	assert.Equal(t, "iphone", received["device"])
+	assert.Equal(t, "location", received["_type"])
+}
+
+func TestRecorderSinkSetsUserAndDevice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/pub", r.URL.Path)
+		assert.Equal(t, "alice", r.Header.Get("X-Limit-U"))
+		assert.Equal(t, "iphone", r.Header.Get("X-Limit-D"))
+	}))
+	defer server.Close()
+
+	sink, err := newRecorderSink(SinkConfig{URL: server.URL}, nil)
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(t.Context(), testMQTTMsg()))
+}
+
+func TestMergeHeaders(t *testing.T) {
+	headers := mergeHeaders(jsonHeaders, map[string]string{"Content-Type": "text/plain", "X-Token": "secret"})
+
+	assert.Equal(t, map[string]string{"Content-Type": "text/plain", "X-Token": "secret"}, headers)
+	assert.Equal(t, map[string]string{"Content-Type": "application/json"}, jsonHeaders)
+}
+
+func TestInfluxDBSinkLineProtocol(t *testing.T) {
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "s", r.URL.Query().Get("precision"))
+		assert.Equal(t, "b", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "Token tok", r.Header.Get("Authorization"))
+
+		body, _ = io.ReadAll(r.Body)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := newInfluxDBSink(SinkConfig{URL: server.URL + "/api/v2/write?bucket=b", Token: "tok"}, nil)
+	require.NoError(t, err)
+
+	msg := testMQTTMsg()
+	msg.Device = "my phone"
+
+	require.NoError(t, sink.Send(t.Context(), msg))
+	assert.Equal(t,
+		`location,user=alice,device=my\ phone,tid=AB `+
+			`lat=51.5074,lon=-0.1278,acc=10.5,alt=42,vac=3.2,vel=48,cog=270i,batt=85i 1704067200`,
+		string(body),
+	)
+}
+
+func TestSinkConfiguredHeadersOverrideDefaults(t *testing.T) {
+	config := SinkConfig{
+		URL:     "http://sink",
+		Token:   "tok",
+		Headers: map[string]string{"Content-Type": "application/x-custom", "Authorization": "Bearer other"},
+	}
+
+	recorder, err := newRecorderSink(config, nil)
+	require.NoError(t, err)
+
+	webhook, err := newWebhookSink(config, nil)
+	require.NoError(t, err)
+
+	influxDB, err := newInfluxDBSink(config, nil)
+	require.NoError(t, err)
+
+	for _, headers := range []map[string]string{recorder.headers, webhook.headers, influxDB.headers} {
+		assert.Equal(t, config.Headers, headers)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	tableFormatCSV     = "csv"
+	tableFormatParquet = "parquet"
+
+	// parquetRowGroupSize bounds how many rows the Parquet writer buffers in memory
+	parquetRowGroupSize = 50000
+)
+
+// tableRow is a location as written to CSV and Parquet exports: every DeviceRecord
+// column, with the geocoding JSON broken out into its address fields.
+type tableRow struct {
+	DeviceTimestamp  time.Time  `parquet:"device_timestamp,timestamp(microsecond)"`
+	Timestamp        *time.Time `parquet:"timestamp,optional,timestamp(microsecond)"`
+	User             string     `parquet:"user,dict"`
+	Device           string     `parquet:"device,dict"`
+	Latitude         float64    `parquet:"latitude"`
+	Longitude        float64    `parquet:"longitude"`
+	Accuracy         float32    `parquet:"accuracy"`
+	Altitude         *float32   `parquet:"altitude,optional"`
+	VerticalAccuracy *float32   `parquet:"vertical_accuracy,optional"`
+	Speed            *float32   `parquet:"speed,optional"`
+	BatteryLevel     *int       `parquet:"battery_level,optional"`
+	ConnectionType   *string    `parquet:"connection_type,optional,dict"`
+	Doze             *bool      `parquet:"doze,optional"`
+	DisplayName      *string    `parquet:"display_name,optional"`
+	HouseNumber      *string    `parquet:"house_number,optional"`
+	Road             *string    `parquet:"road,optional"`
+	Neighbourhood    *string    `parquet:"neighbourhood,optional"`
+	City             *string    `parquet:"city,optional,dict"`
+	Region           *string    `parquet:"region,optional,dict"`
+	Postcode         *string    `parquet:"postcode,optional"`
+	Country          *string    `parquet:"country,optional,dict"`
+	CountryCode      *string    `parquet:"country_code,optional,dict"`
+}
+
+var tableColumns = []string{
+	"device_timestamp", "timestamp", "user", "device", "latitude", "longitude", "accuracy",
+	"altitude", "vertical_accuracy", "speed", "battery_level", "connection_type", "doze",
+	"display_name", "house_number", "road", "neighbourhood", "city", "region", "postcode",
+	"country", "country_code",
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+func newTableRow(ctx context.Context, deviceRecord DeviceRecord) tableRow {
+	row := tableRow{
+		Timestamp:        deviceRecord.Timestamp,
+		User:             deviceRecord.User,
+		Device:           deviceRecord.Device,
+		Latitude:         deviceRecord.Latitude,
+		Longitude:        deviceRecord.Longitude,
+		Accuracy:         deviceRecord.Accuracy,
+		Altitude:         deviceRecord.Altitude,
+		VerticalAccuracy: deviceRecord.VerticalAccuracy,
+		Speed:            deviceRecord.Speed,
+		BatteryLevel:     deviceRecord.BatteryLevel,
+		ConnectionType:   deviceRecord.ConnectionType,
+		Doze:             deviceRecord.Doze,
+	}
+
+	if deviceRecord.DeviceTimestamp != nil {
+		row.DeviceTimestamp = *deviceRecord.DeviceTimestamp
+	}
+
+	if deviceRecord.Geocoding == nil {
+		return row
+	}
+
+	var geocoding NominatimReverseGeocodeResult
+
+	err := json.Unmarshal([]byte(*deviceRecord.Geocoding), &geocoding)
+	if err != nil {
+		slog.With("err", err).DebugContext(ctx, "Error decoding geocoding for export")
+
+		return row
+	}
+
+	address := geocoding.Normalised()
+	row.DisplayName = optionalString(address.DisplayName)
+	row.HouseNumber = optionalString(address.HouseNumber)
+	row.Road = optionalString(address.Road)
+	row.Neighbourhood = optionalString(address.Neighbourhood)
+	row.City = optionalString(address.City)
+	row.Region = optionalString(address.Region)
+	row.Postcode = optionalString(address.Postcode)
+	row.Country = optionalString(address.Country)
+	row.CountryCode = optionalString(address.CountryCode)
+
+	return row
+}
+
+func formatOptional[T any](value *T, format func(T) string) string {
+	if value == nil {
+		return ""
+	}
+
+	return format(*value)
+}
+
+func formatTableTime(value time.Time) string {
+	return value.UTC().Format(time.RFC3339)
+}
+
+func formatTableFloat32(value float32) string {
+	return strconv.FormatFloat(float64(value), 'f', -1, 32)
+}
+
+func identity(value string) string {
+	return value
+}
+
+// csvRecord returns the row's values in the order of tableColumns.
+func (row tableRow) csvRecord() []string {
+	return []string{
+		formatTableTime(row.DeviceTimestamp),
+		formatOptional(row.Timestamp, formatTableTime),
+		row.User,
+		row.Device,
+		strconv.FormatFloat(row.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(row.Longitude, 'f', -1, 64),
+		formatTableFloat32(row.Accuracy),
+		formatOptional(row.Altitude, formatTableFloat32),
+		formatOptional(row.VerticalAccuracy, formatTableFloat32),
+		formatOptional(row.Speed, formatTableFloat32),
+		formatOptional(row.BatteryLevel, strconv.Itoa),
+		formatOptional(row.ConnectionType, identity),
+		formatOptional(row.Doze, strconv.FormatBool),
+		formatOptional(row.DisplayName, identity),
+		formatOptional(row.HouseNumber, identity),
+		formatOptional(row.Road, identity),
+		formatOptional(row.Neighbourhood, identity),
+		formatOptional(row.City, identity),
+		formatOptional(row.Region, identity),
+		formatOptional(row.Postcode, identity),
+		formatOptional(row.Country, identity),
+		formatOptional(row.CountryCode, identity),
+	}
+}
+
+// tableWriter writes tableRows in one of the table export formats.
+type tableWriter interface {
+	Write(row tableRow) error
+	// Flush writes buffered rows where the format allows it
+	Flush() error
+	Close() error
+}
+
+type csvTableWriter struct {
+	writer *csv.Writer
+}
+
+func (writer *csvTableWriter) Write(row tableRow) error {
+	return writer.writer.Write(row.csvRecord())
+}
+
+func (writer *csvTableWriter) Flush() error {
+	writer.writer.Flush()
+
+	return writer.writer.Error()
+}
+
+func (writer *csvTableWriter) Close() error {
+	return writer.Flush()
+}
+
+type parquetTableWriter struct {
+	writer *parquet.GenericWriter[tableRow]
+}
+
+func (writer *parquetTableWriter) Write(row tableRow) error {
+	_, err := writer.writer.Write([]tableRow{row})
+
+	return err
+}
+
+// Flush does nothing, since flushing a Parquet writer ends the row group.
+func (writer *parquetTableWriter) Flush() error {
+	return nil
+}
+
+func (writer *parquetTableWriter) Close() error {
+	return writer.writer.Close()
+}
+
+func newTableWriter(format string, w io.Writer) (tableWriter, error) {
+	switch format {
+	case tableFormatCSV:
+		writer := csv.NewWriter(w)
+
+		err := writer.Write(tableColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		return &csvTableWriter{writer: writer}, nil
+	case tableFormatParquet:
+		return &parquetTableWriter{writer: parquet.NewGenericWriter[tableRow](w,
+			parquet.MaxRowsPerRowGroup(parquetRowGroupSize),
+			parquet.Compression(&parquet.Zstd),
+		)}, nil
+	default:
+		return nil, fmt.Errorf("unknown table format %q", format)
+	}
+}
+
+// writeTable writes the location rows to w in the given format, calling flush
+// periodically so that large exports are streamed rather than buffered.
+func writeTable(
+	ctx context.Context,
+	rows *sql.Rows,
+	format string,
+	w io.Writer,
+	flush func(),
+) error {
+	writer, err := newTableWriter(format, w)
+	if err != nil {
+		return err
+	}
+
+	err = streamDeviceRecords(ctx, rows, func() {
+		_ = writer.Flush()
+
+		flush()
+	}, func(deviceRecord DeviceRecord) error {
+		return writer.Write(newTableRow(ctx, deviceRecord))
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// exportTableRows parses the export range and filter and queries their locations,
+// responding with an error if any of those fail.
+func (env *Env) exportTableRows(w http.ResponseWriter, r *http.Request) (*sql.Rows, bool) {
+	from, to, err := exportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return nil, false
+	}
+
+	filter, err := env.exportFilter(r)
+	if err != nil {
+		requestError(w, err)
+
+		return nil, false
+	}
+
+	rows, err := env.getPoints(r.Context(), from, to, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return nil, false
+	}
+
+	return rows, true
+}
+
+// ExportCSV exports location data as a gzipped CSV file.
+func (env *Env) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rows, ok := env.exportTableRows(w, r)
+	if !ok {
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	gzipWriter := writeExportHTTPHeader(w, "owntracks.csv", "text/csv; charset=utf-8")
+
+	defer func() {
+		_ = gzipWriter.Close()
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}()
+
+	err := writeTable(ctx, rows, tableFormatCSV, gzipWriter, flushExport(w, gzipWriter))
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming CSV export")
+	}
+}
+
+// ExportParquet exports location data as a zstd-compressed Parquet file.
+func (env *Env) ExportParquet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rows, ok := env.exportTableRows(w, r)
+	if !ok {
+		return
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", "attachment; filename=owntracks.parquet")
+	w.WriteHeader(http.StatusOK)
+
+	err := writeTable(ctx, rows, tableFormatParquet, w, func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Error streaming Parquet export")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTableGeocoding = `{"display_name": "1, High Street, London", "address": {"house_number": "1",
+ "road": "High Street", "suburb": "Soho", "town": "London", "county": "Greater London",
+ "postcode": "W1", "country": "United Kingdom", "country_code": "gb"}}`
+
+func TestNewTableRowExtractsGeocoding(t *testing.T) {
+	row := newTableRow(t.Context(), testDeviceRecord("alice", "iphone", 0, testTableGeocoding))
+
+	assert.Equal(t, "alice", row.User)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), row.DeviceTimestamp)
+	require.NotNil(t, row.Road)
+	assert.Equal(t, "High Street", *row.Road)
+	assert.Equal(t, "Soho", *row.Neighbourhood)
+	assert.Equal(t, "London", *row.City)
+	assert.Equal(t, "Greater London", *row.Region)
+	assert.Equal(t, "gb", *row.CountryCode)
+
+	row = newTableRow(t.Context(), testDeviceRecord("alice", "iphone", 0, ""))
+	assert.Nil(t, row.City)
+}
+
+func TestCSVTableWriter(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer, err := newTableWriter(tableFormatCSV, &buffer)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(newTableRow(t.Context(), testDeviceRecord("alice", "iphone", 0, testTableGeocoding))))
+	require.NoError(t, writer.Write(newTableRow(t.Context(), testDeviceRecord("bob", "pixel", time.Minute, ""))))
+	require.NoError(t, writer.Close())
+
+	records, err := csv.NewReader(&buffer).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, tableColumns, records[0])
+	assert.Len(t, records[1], len(tableColumns))
+	assert.Equal(t, []string{"2024-01-01T10:00:00Z", "2024-01-01T10:00:00Z", "alice", "iphone", "51.5074", "-0.1278"},
+		records[1][:6])
+	assert.Equal(t, "42", records[1][7])
+	assert.Equal(t, "1, High Street, London", records[1][13])
+	assert.Empty(t, records[2][8])
+	assert.Empty(t, records[2][13])
+}
+
+func TestParquetTableWriter(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer, err := newTableWriter(tableFormatParquet, &buffer)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(newTableRow(t.Context(), testDeviceRecord("alice", "iphone", 0, testTableGeocoding))))
+	require.NoError(t, writer.Write(newTableRow(t.Context(), testDeviceRecord("bob", "pixel", time.Minute, ""))))
+	require.NoError(t, writer.Close())
+
+	rows, err := parquet.Read[tableRow](bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+
+	assert.Equal(t, "alice", rows[0].User)
+	assert.InDelta(t, 51.5074, rows[0].Latitude, 0.000001)
+	assert.True(t, rows[0].DeviceTimestamp.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	require.NotNil(t, rows[0].City)
+	assert.Equal(t, "London", *rows[0].City)
+	assert.Nil(t, rows[1].City)
+	assert.Nil(t, rows[1].BatteryLevel)
+}
+
+func TestNewTableWriterRejectsUnknownFormat(t *testing.T) {
+	_, err := newTableWriter("xlsx", &bytes.Buffer{})
+	require.Error(t, err)
+}
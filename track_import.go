@@ -0,0 +1,525 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trackUploadMaxBytes limits the size of files uploaded to ImportHandler.
+const trackUploadMaxBytes = 64 * 1024 * 1024
+
+// errInvalidTrack is returned for GPX and KML files that can't be parsed.
+var errInvalidTrack = errors.New("invalid track file")
+
+// errUntimedLineString is why a KML LineString whose Placemark has no TimeStamp or
+// TimeSpan isn't imported.
+var errUntimedLineString = errors.New("LineString has no TimeStamp or TimeSpan")
+
+// trackImportOptions are the user and device that imported track points belong to.
+type trackImportOptions struct {
+	User   string
+	Device string
+}
+
+// gpxPoint is a GPX 1.0 or 1.1 trkpt or wpt element. Speed and course are only
+// part of GPX 1.0.
+type gpxPoint struct {
+	Latitude  float64  `xml:"lat,attr"`
+	Longitude float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele"`
+	Time      string   `xml:"time"`
+	Speed     *float64 `xml:"speed"`
+	Course    *float64 `xml:"course"`
+}
+
+func (point gpxPoint) MQTTMsg() (MQTTMsg, error) {
+	timestamp, err := parseTrackTime(point.Time)
+	if err != nil {
+		return MQTTMsg{}, err
+	}
+
+	msg := newTrackMQTTMsg(point.Latitude, point.Longitude, timestamp)
+
+	if point.Elevation != nil {
+		msg.Altitude = float32(*point.Elevation)
+	}
+
+	if point.Speed != nil {
+		msg.Speed = float32(*point.Speed * metersPerSecondToKMH)
+	}
+
+	if point.Course != nil {
+		msg.Course = int(*point.Course)
+	}
+
+	return msg, nil
+}
+
+// kmlTrack is a gx:Track, whose when and gx:coord elements pair up in order.
+type kmlTrack struct {
+	When  []string `xml:"when"`
+	Coord []string `xml:"coord"`
+}
+
+type kmlLineString struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin"`
+	End   string `xml:"end"`
+}
+
+func parseTrackTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, errors.New("point has no time")
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		// KML allows times without a zone, which are taken as UTC
+		parsed, err = time.Parse("2006-01-02T15:04:05", value)
+	}
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing time %q: %w", value, err)
+	}
+
+	return parsed, nil
+}
+
+func newTrackMQTTMsg(latitude, longitude float64, timestamp time.Time) MQTTMsg {
+	return MQTTMsg{
+		Type:                 locationType,
+		Latitude:             latitude,
+		Longitude:            longitude,
+		DeviceTimestampAsInt: timestamp.Unix(),
+		DeviceTimestamp:      timestamp,
+	}
+}
+
+// parseKMLCoordinate parses a "lon,lat[,alt]" KML coordinate or a "lon lat [alt]"
+// gx:coord.
+func parseKMLCoordinate(value string) (float64, float64, float32, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) < 2 {
+		return 0, 0, 0, fmt.Errorf("invalid KML coordinate %q", value)
+	}
+
+	numbers := make([]float64, len(fields))
+
+	for i, field := range fields {
+		number, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid KML coordinate %q", value)
+		}
+
+		numbers[i] = number
+	}
+
+	var altitude float32
+	if len(numbers) > 2 {
+		altitude = float32(numbers[2])
+	}
+
+	return numbers[1], numbers[0], altitude, nil
+}
+
+// trackDecoder streams the points in a GPX or KML file.
+type trackDecoder struct {
+	ctx     context.Context //nolint:containedctx
+	emit    func(msg MQTTMsg) error
+	invalid int
+	// untimed counts LineString coordinates skipped for having no time at all
+	untimed int
+
+	// The time of the KML Placemark being decoded, for LineStrings
+	timeStamp *kmlTimeStamp
+	timeSpan  *kmlTimeSpan
+}
+
+func (decoder *trackDecoder) emitPoint(msg MQTTMsg, err error) error {
+	if err != nil {
+		decoder.invalid++
+
+		slog.With("err", err).DebugContext(decoder.ctx, "Skipping invalid track point")
+
+		return nil
+	}
+
+	return decoder.emit(msg)
+}
+
+func (decoder *trackDecoder) emitKMLTrack(track kmlTrack) error {
+	if len(track.When) != len(track.Coord) {
+		decoder.invalid += max(len(track.When), len(track.Coord))
+
+		return nil
+	}
+
+	for i, coord := range track.Coord {
+		timestamp, err := parseTrackTime(track.When[i])
+		if err != nil {
+			_ = decoder.emitPoint(MQTTMsg{}, err)
+
+			continue
+		}
+
+		lat, lon, alt, err := parseKMLCoordinate(coord)
+		msg := newTrackMQTTMsg(lat, lon, timestamp)
+		msg.Altitude = alt
+
+		err = decoder.emitPoint(msg, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lineStringTimes returns a time for each of count points in a LineString, spreading
+// them evenly across the Placemark's TimeSpan or using its TimeStamp for all of them. A
+// TimeSpan with only a begin or an end is used as a TimeStamp.
+//
+//nolint:cyclop
+func (decoder *trackDecoder) lineStringTimes(count int) ([]time.Time, error) {
+	times := make([]time.Time, count)
+
+	switch {
+	case decoder.timeSpan != nil && (decoder.timeSpan.Begin == "" || decoder.timeSpan.End == ""):
+		when, err := parseTrackTime(decoder.timeSpan.Begin + decoder.timeSpan.End)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range times {
+			times[i] = when
+		}
+	case decoder.timeSpan != nil:
+		begin, err := parseTrackTime(decoder.timeSpan.Begin)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseTrackTime(decoder.timeSpan.End)
+		if err != nil {
+			return nil, err
+		}
+
+		if end.Before(begin) {
+			return nil, fmt.Errorf("TimeSpan ends at %s before it begins", decoder.timeSpan.End)
+		}
+
+		for i := range times {
+			if count == 1 {
+				times[i] = begin
+
+				continue
+			}
+
+			times[i] = begin.Add(end.Sub(begin) * time.Duration(i) / time.Duration(count-1))
+		}
+	case decoder.timeStamp != nil:
+		when, err := parseTrackTime(decoder.timeStamp.When)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range times {
+			times[i] = when
+		}
+	default:
+		return nil, errUntimedLineString
+	}
+
+	return times, nil
+}
+
+func (decoder *trackDecoder) emitKMLLineString(lineString kmlLineString) error {
+	coordinates := strings.Fields(lineString.Coordinates)
+
+	times, err := decoder.lineStringTimes(len(coordinates))
+	if errors.Is(err, errUntimedLineString) {
+		decoder.untimed += len(coordinates)
+
+		slog.With("points", len(coordinates)).
+			WarnContext(decoder.ctx, "Skipping LineString without a TimeStamp or TimeSpan")
+
+		return nil
+	}
+
+	if err != nil {
+		decoder.invalid += len(coordinates)
+
+		slog.With("err", err).DebugContext(decoder.ctx, "Skipping LineString")
+
+		return nil
+	}
+
+	for i, coordinate := range coordinates {
+		lat, lon, alt, err := parseKMLCoordinate(coordinate)
+		msg := newTrackMQTTMsg(lat, lon, times[i])
+		msg.Altitude = alt
+
+		err = decoder.emitPoint(msg, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleElement decodes the elements that carry points or KML times. The children of
+// any other element are walked by the caller.
+func (decoder *trackDecoder) handleElement(xmlDecoder *xml.Decoder, start xml.StartElement) error {
+	var err error
+
+	switch start.Name.Local {
+	case "trkpt", "wpt":
+		var point gpxPoint
+
+		err = xmlDecoder.DecodeElement(&point, &start)
+		if err == nil {
+			err = decoder.emitPoint(point.MQTTMsg())
+		}
+	case "Placemark":
+		decoder.timeStamp = nil
+		decoder.timeSpan = nil
+	case "TimeStamp":
+		decoder.timeStamp = &kmlTimeStamp{}
+		err = xmlDecoder.DecodeElement(decoder.timeStamp, &start)
+	case "TimeSpan":
+		decoder.timeSpan = &kmlTimeSpan{}
+		err = xmlDecoder.DecodeElement(decoder.timeSpan, &start)
+	case "Track":
+		var track kmlTrack
+
+		err = xmlDecoder.DecodeElement(&track, &start)
+		if err == nil {
+			err = decoder.emitKMLTrack(track)
+		}
+	case "LineString":
+		var lineString kmlLineString
+
+		err = xmlDecoder.DecodeElement(&lineString, &start)
+		if err == nil {
+			err = decoder.emitKMLLineString(lineString)
+		}
+	}
+
+	return err
+}
+
+// Decode reads a GPX, KML or KMZ file.
+func (decoder *trackDecoder) Decode(reader io.Reader) error {
+	buffered := bufio.NewReader(reader)
+
+	magic, _ := buffered.Peek(4)
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		return decoder.decodeKMZ(buffered)
+	}
+
+	xmlDecoder := xml.NewDecoder(buffered)
+	root := ""
+
+	for {
+		token, err := xmlDecoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidTrack, err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if root == "" {
+			root = start.Name.Local
+			if root != "gpx" && root != "kml" {
+				return fmt.Errorf("%w: unexpected root element %q", errInvalidTrack, root)
+			}
+		}
+
+		err = decoder.handleElement(xmlDecoder, start)
+		if err != nil {
+			var syntaxError *xml.SyntaxError
+			if errors.As(err, &syntaxError) {
+				return fmt.Errorf("%w: %w", errInvalidTrack, err)
+			}
+
+			return err
+		}
+	}
+
+	if root == "" {
+		return fmt.Errorf("%w: no GPX or KML document found", errInvalidTrack)
+	}
+
+	return nil
+}
+
+// decodeKMZ reads the first KML document in a KMZ archive.
+func (decoder *trackDecoder) decodeKMZ(reader io.Reader) error {
+	// A zip is read from its end, so it's spooled to a file rather than held in memory
+	spool, err := os.CreateTemp("", "owntracks-import-*.kmz")
+	if err != nil {
+		return fmt.Errorf("buffering KMZ: %w", err)
+	}
+
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		return fmt.Errorf("reading KMZ: %w", err)
+	}
+
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidTrack, err)
+	}
+
+	for _, file := range archive.File {
+		if strings.EqualFold(path.Ext(file.Name), ".kml") {
+			kml, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %w", errInvalidTrack, err)
+			}
+
+			defer func() { _ = kml.Close() }()
+
+			return decoder.Decode(kml)
+		}
+	}
+
+	return fmt.Errorf("%w: no KML document in KMZ", errInvalidTrack)
+}
+
+// ImportTrack imports the points in a GPX, KML or KMZ file for a user and device.
+func (env *Env) ImportTrack(
+	ctx context.Context,
+	reader io.Reader,
+	options trackImportOptions,
+) (ImportStats, error) {
+	importer := env.newLocationImporter("track")
+
+	decoder := &trackDecoder{ctx: ctx, emit: func(msg MQTTMsg) error {
+		msg.User = options.User
+		msg.Device = options.Device
+
+		return importer.Add(ctx, msg)
+	}}
+
+	err := decoder.Decode(reader)
+	if err != nil {
+		return importer.stats, err
+	}
+
+	stats, err := importer.Close(ctx)
+	stats.Invalid = decoder.invalid
+	stats.Untimed = decoder.untimed
+
+	return stats, err
+}
+
+// trackUpload returns the uploaded file, which is either the "file" field of a
+// multipart form or the whole request body.
+func trackUpload(r *http.Request) (io.Reader, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+
+	multipartReader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidTrack, err)
+	}
+
+	for {
+		part, err := multipartReader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: no file field in form", errInvalidTrack)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidTrack, err)
+		}
+
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// ImportHandler imports an uploaded GPX, KML or KMZ file for the user and device
+// given in the query string. A user who isn't an admin can only import their own
+// tracks, and the user defaults to them.
+func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	device := r.URL.Query().Get("device")
+
+	user, err := authorizeUser(r, r.URL.Query().Get("user"))
+	if err != nil {
+		requestError(w, err)
+
+		return
+	}
+
+	if user == "" || device == "" {
+		http.Error(w, "user and device parameters are required", http.StatusBadRequest)
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, trackUploadMaxBytes)
+
+	reader, err := trackUpload(r)
+	if err == nil {
+		var stats ImportStats
+
+		stats, err = env.ImportTrack(ctx, reader, trackImportOptions{User: user, Device: device})
+		if err == nil {
+			respondJSON(w, stats)
+
+			return
+		}
+	}
+
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidTrack):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		InternalError(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeTrack(t *testing.T, track []byte) ([]MQTTMsg, int) {
+	t.Helper()
+
+	var points []MQTTMsg
+
+	decoder := &trackDecoder{ctx: t.Context(), emit: func(msg MQTTMsg) error {
+		points = append(points, msg)
+
+		return nil
+	}}
+
+	require.NoError(t, decoder.Decode(bytes.NewReader(track)))
+
+	return points, decoder.invalid
+}
+
+func TestDecodeGPX11(t *testing.T) {
+	points, invalid := decodeTrack(t, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <wpt lat="51.5" lon="-0.12"><ele>30</ele><time>2024-01-01T09:00:00Z</time><name>Start</name></wpt>
+  <wpt lat="51.6" lon="-0.13"><name>Undated</name></wpt>
+  <trk><trkseg>
+    <trkpt lat="51.5074" lon="-0.1278"><ele>42.5</ele><time>2024-01-01T10:00:00.500Z</time></trkpt>
+    <trkpt lat="51.5075" lon="-0.1279"><time>2024-01-01T10:00:05Z</time></trkpt>
+  </trkseg></trk>
+</gpx>`))
+
+	require.Len(t, points, 3)
+	assert.Equal(t, 1, invalid)
+	assert.InDelta(t, 30, points[0].Altitude, 0.001)
+	assert.InDelta(t, 51.5074, points[1].Latitude, 0.000001)
+	assert.InDelta(t, 42.5, points[1].Altitude, 0.001)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Unix(), points[1].DeviceTimestampAsInt)
+}
+
+func TestDecodeGPX10SpeedAndCourse(t *testing.T) {
+	points, _ := decodeTrack(t, []byte(`<gpx version="1.0" xmlns="http://www.topografix.com/GPX/1/0">
+  <trk><trkseg><trkpt lat="1" lon="2"><time>2024-01-01T10:00:00Z</time><speed>10</speed><course>180.4</course></trkpt></trkseg></trk>
+</gpx>`))
+
+	require.Len(t, points, 1)
+	assert.InDelta(t, 36, points[0].Speed, 0.001)
+	assert.Equal(t, 180, points[0].Course)
+}
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+<Document>
+  <Placemark>
+    <gx:Track>
+      <when>2024-01-01T10:00:00Z</when>
+      <when>2024-01-01T10:01:00Z</when>
+      <gx:coord>-0.1278 51.5074 42</gx:coord>
+      <gx:coord>-0.1279 51.5075 43</gx:coord>
+    </gx:Track>
+  </Placemark>
+  <Placemark>
+    <TimeSpan><begin>2024-01-02T10:00:00Z</begin><end>2024-01-02T10:10:00Z</end></TimeSpan>
+    <LineString><coordinates>
+      -0.1,51.1,10 -0.2,51.2,20 -0.3,51.3,30
+    </coordinates></LineString>
+  </Placemark>
+  <Placemark>
+    <LineString><coordinates>-0.4,51.4</coordinates></LineString>
+  </Placemark>
+</Document>
+</kml>`
+
+func TestDecodeKML(t *testing.T) {
+	var points []MQTTMsg
+
+	decoder := &trackDecoder{ctx: t.Context(), emit: func(msg MQTTMsg) error {
+		points = append(points, msg)
+
+		return nil
+	}}
+	require.NoError(t, decoder.Decode(strings.NewReader(testKML)))
+
+	require.Len(t, points, 5)
+	assert.Zero(t, decoder.invalid)
+	assert.Equal(t, 1, decoder.untimed, "the last LineString has no time")
+
+	assert.InDelta(t, 51.5074, points[0].Latitude, 0.000001)
+	assert.InDelta(t, -0.1278, points[0].Longitude, 0.000001)
+	assert.InDelta(t, 42, points[0].Altitude, 0.001)
+
+	assert.InDelta(t, 51.2, points[3].Latitude, 0.000001)
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 5, 0, 0, time.UTC).Unix(), points[3].DeviceTimestampAsInt)
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 10, 0, 0, time.UTC).Unix(), points[4].DeviceTimestampAsInt)
+}
+
+func TestDecodeKMLLineStringTimes(t *testing.T) {
+	decode := func(placemark string) []MQTTMsg {
+		points, invalid := decodeTrack(t, []byte(`<kml><Document><Placemark>`+placemark+
+			`<LineString><coordinates>-0.1,51.1 -0.2,51.2</coordinates></LineString></Placemark></Document></kml>`))
+		assert.Zero(t, invalid, placemark)
+
+		return points
+	}
+
+	noon := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC).Unix()
+
+	for _, placemark := range []string{
+		`<TimeStamp><when>2024-01-02T12:00:00Z</when></TimeStamp>`,
+		`<TimeSpan><begin>2024-01-02T12:00:00Z</begin></TimeSpan>`,
+		`<TimeSpan><end>2024-01-02T12:00:00Z</end></TimeSpan>`,
+	} {
+		points := decode(placemark)
+		require.Len(t, points, 2, placemark)
+		assert.Equal(t, noon, points[0].DeviceTimestampAsInt, placemark)
+		assert.Equal(t, noon, points[1].DeviceTimestampAsInt, placemark)
+	}
+
+	points, invalid := decodeTrack(t, []byte(`<kml><Placemark>
+<TimeSpan><begin>2024-01-02T12:00:00Z</begin><end>2024-01-02T11:00:00Z</end></TimeSpan>
+<LineString><coordinates>-0.1,51.1</coordinates></LineString></Placemark></kml>`))
+	assert.Empty(t, points)
+	assert.Equal(t, 1, invalid)
+}
+
+func TestDecodeKMZ(t *testing.T) {
+	var archive bytes.Buffer
+
+	writer := zip.NewWriter(&archive)
+	file, err := writer.Create("doc.kml")
+	require.NoError(t, err)
+	_, err = file.Write([]byte(testKML))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	points, _ := decodeTrack(t, archive.Bytes())
+	assert.Len(t, points, 5)
+}
+
+func TestDecodeTrackRejectsOtherXML(t *testing.T) {
+	decoder := &trackDecoder{ctx: t.Context(), emit: func(MQTTMsg) error { return nil }}
+
+	require.ErrorIs(t, decoder.Decode(strings.NewReader(`<html></html>`)), errInvalidTrack)
+	require.ErrorIs(t, decoder.Decode(strings.NewReader(`<gpx><trkpt`)), errInvalidTrack)
+	require.ErrorIs(t, decoder.Decode(strings.NewReader(``)), errInvalidTrack)
+}
+
+func TestImportHandlerRequiresUserAndDevice(t *testing.T) {
+	env := &Env{}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/0/import?user=alice", strings.NewReader(`<gpx/>`))
+	w := httptest.NewRecorder()
+
+	env.ImportHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestImportHandlerRejectsInvalidUpload(t *testing.T) {
+	env := &Env{}
+
+	var body bytes.Buffer
+
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "track.gpx")
+	require.NoError(t, err)
+	_, err = part.Write([]byte("not a track"))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/0/import?user=alice&device=gps", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	w := httptest.NewRecorder()
+
+	env.ImportHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}